@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"testing"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"bufio"
 	"strings"
+	"time"
 	"../internal"
 	"../lib/support/client"
 	"../lib/support/rpc"
@@ -55,7 +61,7 @@ func TestBasic(t *testing.T) {
 
 func displayoptions(server *rpc.ServerRemote) bool {
 	reader := bufio.NewReader(os.Stdin)
-        fmt.Print("Please select an option...\n1...Log in to an existing account\n2...Create a new account\n")
+        fmt.Print("Please select an option...\n1...Log in to an existing account\n2...Create a new account\n3...Download from a public link\n")
         chosenoption, readErr := reader.ReadString('\n')
         if readErr != nil {
                 fmt.Fprintf(os.Stderr, "error reading option: %v\n", readErr)
@@ -79,6 +85,9 @@ func displayoptions(server *rpc.ServerRemote) bool {
 	        }
 		fmt.Print("New user created!\n")
 		return true
+	case "3\n":
+		linkDownload(server)
+		return true
 	default:
 		return true
 	}
@@ -136,6 +145,52 @@ func newUserDetails(server *rpc.ServerRemote) bool {
 
 
 
+// Downloads a file through a public link, which needs no account, or lists a directory made
+// available through one. For a link to a directory, a path inside it picks what to download.
+func linkDownload(server *rpc.ServerRemote) {
+	reader := bufio.NewReader(os.Stdin)
+	var answers []string
+	for _, prompt := range []string{"Enter link token: ", "Enter link password (leave empty if it has none): ", "Enter path inside the link (leave empty for what it is to): "} {
+		fmt.Print(prompt)
+		answer, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			fmt.Fprintf(os.Stderr, "error reading answer: %v\n", readErr)
+			return
+		}
+		answers = append(answers, strings.TrimRight(answer, "\r\n"))
+	}
+
+	var ret internal.LinkDownloadReturn
+	err := server.Call("link-download", &ret, strings.TrimSpace(answers[0]), answers[1], strings.TrimSpace(answers[2]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error downloading: %v\n", err)
+		return
+	}
+	if ret.Err != "" {
+		fmt.Fprintf(os.Stderr, "error downloading: %v\n", ret.Err)
+		return
+	}
+	if ret.IsDir {
+		for _, e := range ret.Entries {
+			fmt.Println(client.FileInfoString(fileInfo(e)))
+		}
+		return
+	}
+
+	fmt.Print("Save as: ")
+	localpath, readErr := reader.ReadString('\n')
+	if readErr != nil {
+		fmt.Fprintf(os.Stderr, "error reading path: %v\n", readErr)
+		return
+	}
+	err = ioutil.WriteFile(strings.TrimRight(localpath, "\r\n"), ret.Body, 0664)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving file: %v\n", err)
+		return
+	}
+	fmt.Printf("Downloaded %v bytes\n", len(ret.Body))
+}
+
 func AskCreds(server *rpc.ServerRemote) bool {
 	reader := bufio.NewReader(os.Stdin)
         fmt.Print("Enter username: ")
@@ -153,17 +208,32 @@ func AskCreds(server *rpc.ServerRemote) bool {
 	user = strings.TrimRight(username, " \r\n")	
 	currdir = "./userfs/" + user + "/"
 
+	//the device token the server gave us the last time we logged in as user, if any
+	device, _ := ioutil.ReadFile(deviceFile())
+
         var ret internal.AuthReturn
-        err := server.Call("authenticate", &ret, strings.TrimRight(username, " \r\n"), strings.TrimRight(password, " \r\n"))
+        err := server.Call("authenticate", &ret, strings.TrimRight(username, " \r\n"), strings.TrimRight(password, " \r\n"), string(device))
 	if err != nil {
                 fmt.Fprintf(os.Stderr, "error authenticating: %v\n", err)
                 return false
         }
 	sessionid = ret.Session
+	if ret.Auth && ret.Device != string(device) {
+		err = ioutil.WriteFile(deviceFile(), []byte(ret.Device), 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error saving device token: %v\n", err)
+		}
+	}
 	return ret.Auth
 	
 }  
 
+// Returns the file the device token for logging in as user is kept in, so that someone getting
+// user's password wrong elsewhere can't stop us logging in.
+func deviceFile() string {
+	return ".dropbox-device-" + url.PathEscape(user)
+}
+
 
 type Client struct {
 	server *rpc.ServerRemote
@@ -208,6 +278,18 @@ func (c *Client) Share(path string, sharee string, perm string) (err error) {
         return nil
 }
 
+func (c *Client) ShareUntil(path string, sharee string, perm string, expires time.Duration) (err error) {
+	var ret string
+	err = c.server.Call("share-until", &ret, currdir+path, sharee, perm, int64(expires/time.Second), user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		return remoteError(ret)
+	}
+	return nil
+}
+
 
 func (c *Client) Unshare(path string, sharee string) (err error) {
 	var ret string
@@ -270,6 +352,167 @@ func (c *Client) Download(path string) (body []byte, err error) {
 	return ret.Body, nil
 }
 
+// Turns an error message from the server into an error, logging out if the session expired.
+func remoteError(ret string) error {
+	if(ret == "reauth"){
+		fmt.Print("Your session has expired. Please log in again.\n")
+		os.Exit(1)
+	}
+	return fmt.Errorf(ret)
+}
+
+// How many times a call made while streaming is retried after the connection to the server is
+// lost, and how long to wait before the first retry. The wait doubles with every retry.
+const streamRetries = 8
+const streamRetryWait = time.Second
+
+// Makes a call like c.server.Call does, making it again after a pause whenever it fails. Every
+// call made while streaming is safe to repeat, so this is how interrupted transfers resume.
+func (c *Client) callRetrying(method string, ret interface{}, args ...interface{}) (err error) {
+	wait := streamRetryWait
+	for i := 0; ; i++ {
+		err = c.server.Call(method, ret, args...)
+		if err == nil || i == streamRetries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "lost the connection to the server (%v), retrying in %v\n", err, wait)
+		time.Sleep(wait)
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
+
+func (c *Client) UploadStream(path string, r io.ReadSeeker, size int64) (err error) {
+	var begin internal.UploadBeginReturn
+	err = c.callRetrying("upload-begin", &begin, currdir+path, size, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if begin.Err != "" {
+		return remoteError(begin.Err)
+	}
+	var status internal.UploadStatusReturn
+	err = c.callRetrying("upload-status", &status, begin.ID, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if status.Err != "" {
+		return remoteError(status.Err)
+	}
+
+	var ret string
+	if status.Received > 0 {
+		// An earlier upload to the same path was interrupted. It is only carried on if what the
+		// server has is the start of this file; otherwise it is thrown away and this one starts over.
+		h := sha256.New()
+		_, err = io.CopyN(h, r, status.Received)
+		if err == nil && hex.EncodeToString(h.Sum(nil)) == status.Digest {
+			fmt.Printf("Resuming upload: %v of %v bytes are already on the server\n", status.Received, size)
+		} else {
+			_, err = r.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			err = c.callRetrying("upload-abort", &ret, begin.ID, user, sessionid)
+			if err == nil {
+				begin = internal.UploadBeginReturn{}
+				err = c.callRetrying("upload-begin", &begin, currdir+path, size, user, sessionid)
+			}
+			if err != nil {
+				return client.MakeFatalError(err)
+			}
+			if begin.Err != "" {
+				return remoteError(begin.Err)
+			}
+			status = internal.UploadStatusReturn{}
+		}
+	}
+
+	buf := make([]byte, internal.TransferPieceSize)
+	for seq := status.Pieces; ; seq++ {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if n == 0 {
+			break
+		}
+		err = c.callRetrying("upload-put", &ret, begin.ID, seq, buf[:n], user, sessionid)
+		if err != nil {
+			return client.MakeFatalError(err)
+		}
+		if ret != "" {
+			return remoteError(ret)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	err = c.callRetrying("upload-commit", &ret, begin.ID, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		return remoteError(ret)
+	}
+	return nil
+}
+
+func (c *Client) DownloadStream(path string, w io.Writer) (err error) {
+	var open internal.DownloadOpenReturn
+	err = c.server.Call("download-open", &open, currdir+path, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if open.Err != "" {
+		return remoteError(open.Err)
+	}
+	var ret string
+	defer c.server.Call("download-close", &ret, open.ID, user, sessionid)
+
+	for offset := int64(0); offset < open.Size; {
+		var piece internal.DownloadReturn
+		err = c.server.Call("download-read", &piece, open.ID, offset, internal.TransferPieceSize, user, sessionid)
+		if err != nil {
+			return client.MakeFatalError(err)
+		}
+		if piece.Err != "" {
+			return remoteError(piece.Err)
+		}
+		if len(piece.Body) == 0 {
+			return fmt.Errorf("the file ended after %v of %v bytes", offset, open.Size)
+		}
+		_, err = w.Write(piece.Body)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(piece.Body))
+	}
+	return nil
+}
+
+func (c *Client) DownloadRange(path string, offset int64, length int64) (body []byte, size int64, err error) {
+	// the server sends a piece at a time, so longer ranges take more than one call
+	for {
+		var ret internal.DownloadRangeReturn
+		err = c.server.Call("download_range", &ret, currdir+path, offset, length-int64(len(body)), user, sessionid)
+		if err != nil {
+			return nil, 0, client.MakeFatalError(err)
+		}
+		if ret.Err != "" {
+			return nil, 0, remoteError(ret.Err)
+		}
+		size = ret.Size
+		body = append(body, ret.Body...)
+		if len(ret.Body) == 0 || int64(len(body)) >= length {
+			return body, size, nil
+		}
+		offset += int64(len(ret.Body))
+	}
+}
+
 func (c *Client) List(path string) (entries []client.DirEnt, err error) {
 	var ret internal.ListReturn
 	if path == "" {
@@ -294,6 +537,59 @@ func (c *Client) List(path string) (entries []client.DirEnt, err error) {
 	return ents, nil
 }
 
+// Turns a directory entry sent by the server into a client.FileInfo.
+func fileInfo(e internal.DirEnt) client.FileInfo {
+	info := client.FileInfo{
+		Name:     e.Name_,
+		IsDir:    e.IsDir_,
+		Size:     e.Size,
+		ModTime:  time.Unix(e.ModTime, 0),
+		Hash:     e.Hash,
+		SharedBy: e.SharedBy,
+		Perm:     e.Perm,
+		Expires:  unixTime(e.Expires),
+	}
+	for _, s := range e.Shares {
+		info.Shares = append(info.Shares, client.Share{User: s.User, Perm: s.Perm, Expires: unixTime(s.Expires)})
+	}
+	return info
+}
+
+// Returns the time t seconds after the Unix epoch, or the zero time if t is 0.
+func unixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+func (c *Client) ListLong(path string) (entries []client.FileInfo, err error) {
+	var ret internal.ListReturn
+	err = c.server.Call("list", &ret, currdir+path, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, remoteError(ret.Err)
+	}
+	for _, e := range ret.Entries {
+		entries = append(entries, fileInfo(e))
+	}
+	return entries, nil
+}
+
+func (c *Client) Stat(path string) (info client.FileInfo, err error) {
+	var ret internal.StatReturn
+	err = c.server.Call("stat", &ret, currdir+path, user, sessionid)
+	if err != nil {
+		return info, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return info, remoteError(ret.Err)
+	}
+	return fileInfo(ret.Entry), nil
+}
+
 func (c *Client) Mkdir(path string) (err error) {
 	var ret string
 	if path == "" {
@@ -338,6 +634,54 @@ func (c *Client) Remove(path string) (err error) {
 	return nil
 }
 
+func (c *Client) RemoveAll(path string) (summary client.RemoveSummary, err error) {
+	var ret internal.RemoveReturn
+	err = c.server.Call("remove-all", &ret, currdir+path, user, sessionid)
+	if err != nil {
+		return summary, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		if(ret.Err=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return summary, fmt.Errorf(ret.Err)
+	}
+	return client.RemoveSummary{Files: ret.Files, Dirs: ret.Dirs, Shares: ret.Shares}, nil
+}
+
+func (c *Client) Move(from string, to string) (err error) {
+	var ret string
+	err = c.server.Call("move", &ret, currdir+from, currdir+to, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		if(ret=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return fmt.Errorf(ret)
+	}
+	return nil
+}
+
+func (c *Client) Copy(from string, to string, recursive bool) (err error) {
+	var ret string
+	err = c.server.Call("copy", &ret, currdir+from, currdir+to, recursive, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		if(ret=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return fmt.Errorf(ret)
+	}
+	return nil
+}
+
 func (c *Client) PWD() (path string, err error) {
 	var ret internal.PWDReturn
 	// don't actually have any information in this return value
@@ -378,3 +722,259 @@ func (c *Client) CD(path string) (err error) {
 
 	return nil
 }
+
+func (c *Client) Quota() (used int64, limit int64, err error) {
+	var ret internal.QuotaReturn
+	err = c.server.Call("quota", &ret, user, sessionid)
+	if err != nil {
+		return 0, 0, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		if(ret.Err=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return 0, 0, fmt.Errorf(ret.Err)
+	}
+	return ret.Used, ret.Limit, nil
+}
+
+func (c *Client) History(path string) (versions []client.Version, err error) {
+	var ret internal.HistoryReturn
+	err = c.server.Call("history", &ret, currdir+path, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		if(ret.Err=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return nil, fmt.Errorf(ret.Err)
+	}
+	for _, v := range ret.Versions {
+		versions = append(versions, client.Version{Number: v.Number, Size: v.Size, Saved: time.Unix(v.Saved, 0)})
+	}
+	return versions, nil
+}
+
+func (c *Client) Restore(path string, version int) (err error) {
+	var ret string
+	err = c.server.Call("restore", &ret, currdir+path, version, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		if(ret == "reauth"){
+			fmt.Print("Your session has expired. Please log in again.\n")
+			os.Exit(1)
+		}
+		return fmt.Errorf(ret)
+	}
+	return nil
+}
+
+func (c *Client) Trash() (entries []client.TrashEntry, err error) {
+	var ret internal.TrashReturn
+	err = c.server.Call("trash", &ret, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		if(ret.Err=="reauth"){
+                        fmt.Print("Your session has expired. Please log in again.\n")
+                        os.Exit(1)
+                }
+		return nil, fmt.Errorf(ret.Err)
+	}
+	for _, e := range ret.Entries {
+		entries = append(entries, client.TrashEntry{ID: e.ID, Path: e.Path, IsDir: e.IsDir, Deleted: time.Unix(e.Deleted, 0)})
+	}
+	return entries, nil
+}
+
+func (c *Client) RestoreTrash(id int64, path string) (err error) {
+	var ret string
+	if path != "" {
+		path = currdir + path
+	}
+	err = c.server.Call("restore-trash", &ret, id, path, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		if(ret == "reauth"){
+			fmt.Print("Your session has expired. Please log in again.\n")
+			os.Exit(1)
+		}
+		return fmt.Errorf(ret)
+	}
+	return nil
+}
+
+func (c *Client) EmptyTrash() (err error) {
+	var ret string
+	err = c.server.Call("empty-trash", &ret, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		if(ret == "reauth"){
+			fmt.Print("Your session has expired. Please log in again.\n")
+			os.Exit(1)
+		}
+		return fmt.Errorf(ret)
+	}
+	return nil
+}
+
+func (c *Client) Shares(path string, who string) (out []client.OutgoingShare, in []client.IncomingShare, err error) {
+	var ret internal.SharesReturn
+	if path != "" {
+		path = currdir + path
+	}
+	err = c.server.Call("shares", &ret, path, who, user, sessionid)
+	if err != nil {
+		return nil, nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, nil, remoteError(ret.Err)
+	}
+	for _, e := range ret.Out {
+		out = append(out, client.OutgoingShare{Path: e.Path, Sharee: e.Sharee, Perm: e.Perm, Expires: unixTime(e.Expires), Pending: e.Pending, Via: e.Via})
+	}
+	for _, e := range ret.In {
+		in = append(in, client.IncomingShare{Name: e.Name, Sharer: e.Sharer, Origname: e.Origname, Perm: e.Perm, Group: e.Group, Expires: unixTime(e.Expires), Via: e.Via})
+	}
+	return out, in, nil
+}
+
+func (c *Client) Invites() (invites []client.Invite, err error) {
+	var ret internal.InvitesReturn
+	err = c.server.Call("invites", &ret, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, remoteError(ret.Err)
+	}
+	for _, i := range ret.Invites {
+		invites = append(invites, client.Invite{ID: i.ID, Sharer: i.Sharer, Owner: i.Owner, Name: i.Name, IsDir: i.IsDir, Perm: i.Perm, Expires: unixTime(i.Expires), Sent: time.Unix(i.Sent, 0), Transfer: i.Transfer, Group: i.Group})
+	}
+	return invites, nil
+}
+
+func (c *Client) Accept(id int64, name string) (err error) {
+	return c.plainCall("accept", id, name)
+}
+
+func (c *Client) Decline(id int64) (err error) {
+	return c.plainCall("decline", id)
+}
+
+func (c *Client) AutoAccepts() (users []string, err error) {
+	var ret internal.AutoAcceptReturn
+	err = c.server.Call("autoaccepts", &ret, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, remoteError(ret.Err)
+	}
+	return ret.Users, nil
+}
+
+func (c *Client) SetAutoAccept(sharer string, accept bool) (err error) {
+	return c.plainCall("autoaccept", sharer, accept)
+}
+
+func (c *Client) Transfer(path string, recipient string) (err error) {
+	return c.plainCall("transfer", currdir+path, recipient)
+}
+
+func (c *Client) CancelTransfer(path string, recipient string) (err error) {
+	return c.plainCall("transfer-cancel", currdir+path, recipient)
+}
+
+func (c *Client) Groups() (groups []client.Group, err error) {
+	var ret internal.GroupsReturn
+	err = c.server.Call("groups", &ret, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, remoteError(ret.Err)
+	}
+	for _, g := range ret.Groups {
+		groups = append(groups, client.Group{Name: g.Name, Owner: g.Owner, Members: g.Members, Invited: g.Invited})
+	}
+	return groups, nil
+}
+
+// Makes a call to one of the RPCs that return only an error, such as the group RPCs.
+func (c *Client) plainCall(method string, args ...interface{}) (err error) {
+	var ret string
+	err = c.server.Call(method, &ret, append(args, user, sessionid)...)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		return remoteError(ret)
+	}
+	return nil
+}
+
+func (c *Client) CreateGroup(name string) (err error) {
+	return c.plainCall("group-create", name)
+}
+
+func (c *Client) DeleteGroup(name string) (err error) {
+	return c.plainCall("group-delete", name)
+}
+
+func (c *Client) AddToGroup(name string, member string) (err error) {
+	return c.plainCall("group-add", name, member)
+}
+
+func (c *Client) RemoveFromGroup(name string, member string) (err error) {
+	return c.plainCall("group-remove", name, member)
+}
+
+func (c *Client) CreateLink(path string, expires time.Duration, maxDownloads int, password string) (token string, err error) {
+	var ret internal.LinkReturn
+	err = c.server.Call("link", &ret, currdir+path, int64(expires/time.Second), maxDownloads, password, user, sessionid)
+	if err != nil {
+		return "", client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return "", remoteError(ret.Err)
+	}
+	return ret.Token, nil
+}
+
+func (c *Client) Links() (links []client.Link, err error) {
+	var ret internal.LinksReturn
+	err = c.server.Call("links", &ret, user, sessionid)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err != "" {
+		return nil, remoteError(ret.Err)
+	}
+	for _, l := range ret.Links {
+		links = append(links, client.Link{Token: l.Token, Path: l.Path, IsDir: l.IsDir, Created: time.Unix(l.Created, 0), Expires: unixTime(l.Expires), MaxDownloads: l.MaxDownloads, Downloads: l.Downloads, Password: l.Password})
+	}
+	return links, nil
+}
+
+func (c *Client) RevokeLink(token string) (err error) {
+	var ret string
+	err = c.server.Call("link-revoke", &ret, token, user, sessionid)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret != "" {
+		return remoteError(ret)
+	}
+	return nil
+}
@@ -13,8 +13,22 @@ package internal
 // use the type once it gets the method's return
 // value). Thus, put it here in this shared library.
 type DirEnt struct {
-	IsDir_ bool   // True if the entry is a directory; false if it is a file
-	Name_  string // Name of the entry
+	IsDir_   bool       // True if the entry is a directory; false if it is a file
+	Name_    string     // Name of the entry
+	Size     int64      // Size of the file in bytes; 0 for directories
+	ModTime  int64      // When it was last modified, in seconds since the Unix epoch
+	Hash     string     // Hash of the file's contents; empty for directories
+	Shares   []ShareEnt // Who the user shares it with
+	SharedBy string     // Who shared it with the user; empty unless it is in Shared_with_me
+	Perm     string     // The user's permissions on it if it was shared with them: "r", "rw" or "rws"
+	Expires  int64      // When the share with the user expires, in seconds since the Unix epoch; 0 if it doesn't
+}
+
+// One user something is shared with.
+type ShareEnt struct {
+	User    string // Who it is shared with
+	Perm    string // Their permissions: "r", "rw" or "rws"
+	Expires int64  // When the share expires, in seconds since the Unix epoch; 0 if it doesn't
 }
 
 // DirEnt implements the client.DirEnt interface.
@@ -31,6 +45,16 @@ type ListReturn struct {
 	Err     string // If no error was encountered, this will be empty
 }
 
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type StatReturn struct {
+	Entry DirEnt
+	Err   string // If no error was encountered, this will be empty
+}
+
 // This type is returned by a method on the server,
 // so it has to be accessible from both the server
 // (so it can return it) and the client (so it can
@@ -51,9 +75,248 @@ type DownloadReturn struct {
 	Err  string // If no error was encountered, this will be empty
 }
 
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type QuotaReturn struct {
+	Used  int64 // Bytes the user is being charged for
+	Limit int64 // The user's quota in bytes, or -1 if they have none
+	Err   string // If no error was encountered, this will be empty
+}
+
+// One saved version of a file.
+type VersionEnt struct {
+	Number int   // Version number, counting up from 1 in the order versions were saved
+	Size   int64 // Size of the file in bytes
+	Saved  int64 // When the version was replaced, in seconds since the Unix epoch
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type HistoryReturn struct {
+	Versions []VersionEnt // Oldest first
+	Err      string       // If no error was encountered, this will be empty
+}
+
+// One entry in a user's trash.
+type TrashEnt struct {
+	ID      int64  // What to pass to restore-trash
+	Path    string // Where it was removed from, relative to the user's root
+	IsDir   bool   // True if a directory was removed; false if a file was
+	Deleted int64  // When it was removed, in seconds since the Unix epoch
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type TrashReturn struct {
+	Entries []TrashEnt // Oldest first
+	Err     string     // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type RemoveReturn struct {
+	Files  int    // Files removed
+	Dirs   int    // Directories removed, including the one removed itself
+	Shares int    // Shares of the removed files that were revoked
+	Err    string // If no error was encountered, this will be empty
+}
+
+// The largest piece of a file that is sent in a single call
+// while streaming it with the upload and download sessions.
+// Both the server and the client need to agree on it.
+const TransferPieceSize = 1 << 20
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type UploadBeginReturn struct {
+	ID  string // Identifies the upload session in later calls
+	Err string // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type UploadStatusReturn struct {
+	Size     int64  // Size the upload session was begun with
+	Received int64  // Bytes the server has received
+	Pieces   int    // Pieces the server has received; the next one to send has this number
+	Digest   string // Hex encoded SHA-256 of the bytes received
+	Done     bool   // True if the upload has been committed
+	Err      string // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type DownloadOpenReturn struct {
+	ID   string // Identifies the download session in later calls
+	Size int64  // Size of the file in bytes
+	Err  string // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type DownloadRangeReturn struct {
+	Body []byte
+	Size int64  // Size of the whole file in bytes
+	Err  string // If no error was encountered, this will be empty
+}
+
+// Something the user shares with someone.
+type OutShareEnt struct {
+	Path    string // Relative to the user's root
+	Sharee  string // A user, or "@" and the name of a group
+	Perm    string // "r", "rw" or "rws"
+	Expires int64  // In seconds since the Unix epoch; 0 if it doesn't expire
+	Pending bool   // True if the sharee hasn't accepted it yet
+	Via     string // Who shared it onward, if it wasn't the user
+}
+
+// Something someone shares with the user.
+type InShareEnt struct {
+	Name     string // Where it is, relative to the user's root
+	Sharer   string
+	Origname string // What the sharer calls it
+	Perm     string // "r", "rw" or "rws"
+	Group    string // The group the user got it through, if it was shared with a group
+	Expires  int64  // In seconds since the Unix epoch; 0 if it doesn't expire
+	Via      string // Who shared it onward with the user, if the sharer didn't
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type SharesReturn struct {
+	Out []OutShareEnt // Sorted by path, then sharee
+	In  []InShareEnt  // Sorted by name
+	Err string        // If no error was encountered, this will be empty
+}
+
+// A group and who is in it.
+type GroupEnt struct {
+	Name    string
+	Owner   string   // Who made it, the only one who can change its members
+	Members []string // Sorted by name
+	Invited []string // Who was invited to join and hasn't accepted or declined yet, sorted by name
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type GroupsReturn struct {
+	Groups []GroupEnt // Sorted by name
+	Err    string     // If no error was encountered, this will be empty
+}
+
+// An invitation to share something or to join a group, or an offer to take over a file, that the
+// user hasn't accepted or declined yet.
+type InviteEnt struct {
+	ID       int64
+	Sharer   string
+	Owner    string // Whose it is, if the sharer is sharing onward something shared with them
+	Name     string // What the sharer calls it; empty for an invitation to join a group
+	IsDir    bool
+	Perm     string // "r", "rw" or "rws"
+	Expires  int64  // When the share expires, in seconds since the Unix epoch; 0 if it doesn't
+	Sent     int64  // In seconds since the Unix epoch
+	Transfer bool   // True if it is an offer to take over the file rather than to share it
+	Group    string // The group it is an invitation to join, if it is one rather than to share
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type InvitesReturn struct {
+	Invites []InviteEnt // Oldest first
+	Err     string      // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type AutoAcceptReturn struct {
+	Users []string // Sorted by name
+	Err   string   // If no error was encountered, this will be empty
+}
+
+// A public link the user has made.
+type LinkEnt struct {
+	Token        string
+	Path         string // Relative to the user's root
+	IsDir        bool
+	Created      int64 // In seconds since the Unix epoch
+	Expires      int64 // In seconds since the Unix epoch; 0 if it never expires
+	MaxDownloads int   // 0 if there is no limit
+	Downloads    int   // How many times a file has been downloaded through it
+	Password     bool  // True if it needs a password
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type LinkReturn struct {
+	Token string
+	Err   string // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type LinksReturn struct {
+	Links []LinkEnt // Oldest first
+	Err   string    // If no error was encountered, this will be empty
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type LinkDownloadReturn struct {
+	IsDir   bool
+	Body    []byte   // The file's contents, if it is a file
+	Entries []DirEnt // What is in it, if it is a directory; only names, sizes and times are set
+	Err     string   // If no error was encountered, this will be empty
+}
+
 type AuthReturn struct {
         Auth bool
         Session string
+        Device string // The device token to log in with next time; see server/devices.go
 }
 
 
@@ -2,10 +2,14 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // RunCLI accepts an already-authenticated Client, and runs a command-line
@@ -75,14 +79,33 @@ func RunCLI(c Client) error {
 			}
 			fmt.Println(pwd)
 		case "ls":
+			long := len(args) > 0 && args[0] == "-l"
+			if long {
+				args = args[1:]
+			}
 			if len(args) != 0 && len(args) != 1 {
-				fmt.Printf("Usage: %v [<path>]\n", parts[0])
+				fmt.Printf("Usage: %v [-l] [<path>]\n", parts[0])
 				break
 			}
 			path := "."
 			if len(args) == 1 {
 				path = args[0]
 			}
+			if long {
+				infos, err := c.ListLong(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error listing: %v\n", err)
+					if isFatal(err) {
+						fmt.Fprintln(os.Stderr, "fatal error; aborting")
+						return err
+					}
+					break
+				}
+				for _, f := range infos {
+					fmt.Println(FileInfoString(f))
+				}
+				break
+			}
 			ents, err := c.List(path)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error listing: %v\n", err)
@@ -95,18 +118,64 @@ func RunCLI(c Client) error {
 			for _, e := range ents {
 				fmt.Println(DirEntString(e))
 			}
+		case "stat":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <path>\n", parts[0])
+				break
+			}
+			f, err := c.Stat(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error stat'ing: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			kind := "file"
+			if f.IsDir {
+				kind = "directory"
+			}
+			fmt.Printf("Name:     %v\n", f.Name)
+			fmt.Printf("Type:     %v\n", kind)
+			fmt.Printf("Size:     %v\n", f.Size)
+			fmt.Printf("Modified: %v\n", f.ModTime.Format("2006-01-02 15:04:05"))
+			if f.Hash != "" {
+				fmt.Printf("Hash:     %v\n", f.Hash)
+			}
+			if len(f.Shares) > 0 {
+				fmt.Printf("Shared with: %v\n", sharesString(f.Shares))
+			}
+			if f.SharedBy != "" {
+				fmt.Printf("Shared by: %v (%v)\n", f.SharedBy, f.Perm)
+			}
 		case "upload":
 			if len(args) != 2 {
 				fmt.Printf("Usage: %v <localpath> <remotepath>\n", parts[0])
 				break
 			}
-			body, err := ioutil.ReadFile(args[0])
+			fi, err := os.Stat(args[0])
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error reading file: %v\n", err)
 				break
 			}
-
-			err = c.Upload(args[1], body)
+			if fi.Size() > StreamThreshold {
+				// too big to read into memory, so it goes in pieces
+				f, err := os.Open(args[0])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error reading file: %v\n", err)
+					break
+				}
+				err = c.UploadStream(args[1], f, fi.Size())
+				f.Close()
+			} else {
+				var body []byte
+				body, err = ioutil.ReadFile(args[0])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error reading file: %v\n", err)
+					break
+				}
+				err = c.Upload(args[1], body)
+			}
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error uploading: %v\n", err)
 				if isFatal(err) {
@@ -132,26 +201,87 @@ func RunCLI(c Client) error {
 				fmt.Printf("Usage: %v <remotepath> <localpath>\n", parts[0])
 				break
 			}
-			body, err := c.Download(args[0])
+			// files of any size are received in pieces and written out as they come
+			f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
 			if err != nil {
+				fmt.Fprintf(os.Stderr, "error writing file: %v\n", err)
+				break
+			}
+			err = c.DownloadStream(args[0], f)
+			if cerr := f.Close(); err == nil && cerr != nil {
+				fmt.Fprintf(os.Stderr, "error writing file: %v\n", cerr)
+				break
+			}
+			if err != nil {
+				os.Remove(args[1])
 				fmt.Fprintf(os.Stderr, "error downloading: %v\n", err)
 				if isFatal(err) {
 					return err
 				}
 				break
 			}
-
-			err = ioutil.WriteFile(args[1], body, 0664)
+		case "cat":
+			offset, length := int64(0), int64(-1)
+			var path string
+			usage := false
+			for i := 0; i < len(args); i++ {
+				if (args[i] == "--offset" || args[i] == "--length") && i+1 < len(args) {
+					n, err := strconv.ParseInt(args[i+1], 10, 64)
+					if err != nil || n < 0 {
+						usage = true
+					} else if args[i] == "--offset" {
+						offset = n
+					} else {
+						length = n
+					}
+					i++
+				} else if path == "" {
+					path = args[i]
+				} else {
+					usage = true
+				}
+			}
+			if usage || path == "" {
+				fmt.Printf("Usage: %v [--offset <bytes>] [--length <bytes>] <remotepath>\n", parts[0])
+				break
+			}
+			var err error
+			if offset == 0 && length < 0 {
+				err = c.DownloadStream(path, os.Stdout)
+			} else {
+				err = writeRange(c, path, offset, length, os.Stdout)
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "error writing file: %v\n", err)
+				fmt.Fprintf(os.Stderr, "error downloading: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
 				break
 			}
-		case "cat":
-			if len(args) != 1 {
-				fmt.Printf("Usage: %v <remotepath>\n", parts[0])
+		case "head", "tail":
+			lines, n, path, ok := parseCount(args)
+			if !ok {
+				fmt.Printf("Usage: %v [-n <lines> | -c <bytes>] <remotepath>\n", parts[0])
 				break
 			}
-			body, err := c.Download(args[0])
+			var err error
+			if parts[0] == "head" && lines {
+				err = headLines(c, path, n, os.Stdout)
+			} else if parts[0] == "head" {
+				err = writeRange(c, path, 0, n, os.Stdout)
+			} else if lines {
+				err = tailLines(c, path, n, os.Stdout)
+			} else {
+				var size int64
+				_, size, err = c.DownloadRange(path, 0, 0)
+				if err == nil {
+					offset := size - n
+					if offset < 0 {
+						offset = 0
+					}
+					err = writeRange(c, path, offset, -1, os.Stdout)
+				}
+			}
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error downloading: %v\n", err)
 				if isFatal(err) {
@@ -159,11 +289,21 @@ func RunCLI(c Client) error {
 				}
 				break
 			}
-
-			os.Stdout.Write(body)
 		case "rm":
+			if len(args) == 2 && args[0] == "-r" {
+				summary, err := c.RemoveAll(args[1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error removing: %v\n", err)
+					if isFatal(err) {
+						return err
+					}
+					break
+				}
+				fmt.Printf("Removed %v files and %v directories, revoked %v shares\n", summary.Files, summary.Dirs, summary.Shares)
+				break
+			}
 			if len(args) != 1 {
-				fmt.Printf("Usage: %v <path>\n")
+				fmt.Printf("Usage: %v [-r] <path>\n", parts[0])
 				break
 			}
 			err := c.Remove(args[0])
@@ -174,6 +314,36 @@ func RunCLI(c Client) error {
 				}
 				break
 			}
+		case "mv":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <from> <to>\n", parts[0])
+				break
+			}
+			err := c.Move(args[0], args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error moving: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "cp":
+			recursive := len(args) == 3 && args[0] == "-r"
+			if recursive {
+				args = args[1:]
+			}
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v [-r] <from> <to>\n", parts[0])
+				break
+			}
+			err := c.Copy(args[0], args[1], recursive)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error copying: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
 		case "help":
 			if len(args) != 0 {
 				fmt.Printf("Usage: %v\n", parts[0])
@@ -183,15 +353,38 @@ func RunCLI(c Client) error {
 			cmds := []string{
 				"cd [<path>]",
 				"pwd",
-				"ls [<path>]",
+				"ls [-l] [<path>]",
+				"stat <path>",
 				"mkdir <path>",
 				"upload <localpath> <remotepath>",
 				"download <remotepath> <localpath>",
-				"cat <remotepath>",
-				"rm <path>",
-				"share <filepath> <user> <permissions(r/rw)>",
-				"unshare <filepath> <user>",
-				"<filepath> <user> <permissions(r/rw)>",
+				"cat [--offset <bytes>] [--length <bytes>] <remotepath>",
+				"head [-n <lines> | -c <bytes>] <remotepath>",
+				"tail [-n <lines> | -c <bytes>] <remotepath>",
+				"rm [-r] <path>",
+				"mv <from> <to>",
+				"cp [-r] <from> <to>",
+				"share <path> <user|@group> <permissions(r/rw/rws)> [--expires <duration>]",
+				"unshare <path> <user|@group>",
+				"chperm <path> <user|@group> <permissions(r/rw/rws)>",
+				"quota",
+				"history <filepath>",
+				"restore <filepath> <version>",
+				"trash",
+				"restore-trash <id> [<path>]",
+				"empty-trash",
+				"shares [--in | --out] [--user <user|@group>] [<path>]",
+				"invites",
+				"accept <id> [as <name>]",
+				"decline <id>",
+				"autoaccept [add|remove <user>]",
+				"transfer [--cancel] <path> <user>",
+				"groups",
+				"group create|delete <name>",
+				"group add|remove <name> <user>",
+				"link create [--expires <duration>] [--max <downloads>] [--password <password>] <path>",
+				"link list",
+				"link revoke <token>",
 				"quit",
 				"exit",
 				"help",
@@ -201,7 +394,7 @@ func RunCLI(c Client) error {
 			}
 		case "chperm":
 			if len(args) != 3 {
-                                fmt.Printf("Usage: %v <filepath> <user> <permissions(r/rw)>\n", parts[0])
+                                fmt.Printf("Usage: %v <path> <user> <permissions(r/rw/rws)>\n", parts[0])
                                 break
                         }
                         err = c.Chperm(args[0], args[1], args[2])
@@ -213,11 +406,24 @@ func RunCLI(c Client) error {
                                 break
                         }
 		case "share":
+			var expires time.Duration
+			if len(args) == 5 && args[3] == "--expires" {
+				expires, err = time.ParseDuration(args[4])
+				if err != nil || expires <= 0 {
+					fmt.Printf("Usage: %v <path> <user|@group> <permissions(r/rw/rws)> [--expires <duration>]\n", parts[0])
+					break
+				}
+				args = args[:3]
+			}
 			if len(args) != 3 {
-                                fmt.Printf("Usage: %v <filepath> <user> <permissions(r/rw)>\n", parts[0])
+                                fmt.Printf("Usage: %v <path> <user|@group> <permissions(r/rw/rws)> [--expires <duration>]\n", parts[0])
                                 break
                         }
-                        err = c.Share(args[0], args[1], args[2])
+                        if expires != 0 {
+                                err = c.ShareUntil(args[0], args[1], args[2], expires)
+                        } else {
+                                err = c.Share(args[0], args[1], args[2])
+                        }
                         if err != nil {
                                 fmt.Fprintf(os.Stderr, "error share: %v\n", err)
                                 if isFatal(err) {
@@ -227,7 +433,7 @@ func RunCLI(c Client) error {
                         }
 		case "unshare":
 			if len(args) != 2 {
-                                fmt.Printf("Usage: %v <filepath> <user>\n", parts[0])
+                                fmt.Printf("Usage: %v <path> <user>\n", parts[0])
                                 break
                         }
                         err = c.Unshare(args[0], args[1])
@@ -238,6 +444,349 @@ func RunCLI(c Client) error {
                                 }
                                 break
                         }
+		case "quota":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			used, limit, err := c.Quota()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error getting quota: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if limit < 0 {
+				fmt.Printf("%v bytes used (no quota)\n", used)
+			} else {
+				fmt.Printf("%v of %v bytes used\n", used, limit)
+			}
+		case "history":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <filepath>\n", parts[0])
+				break
+			}
+			versions, err := c.History(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error getting history: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if len(versions) == 0 {
+				fmt.Println("No previous versions")
+			}
+			for _, v := range versions {
+				fmt.Printf("%4d  %10d bytes  %v\n", v.Number, v.Size, v.Saved.Format("2006-01-02 15:04:05"))
+			}
+		case "restore":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <filepath> <version>\n", parts[0])
+				break
+			}
+			version, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Printf("Usage: %v <filepath> <version>\n", parts[0])
+				break
+			}
+			err = c.Restore(args[0], version)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error restoring: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "trash":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			entries, err := c.Trash()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error listing trash: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if len(entries) == 0 {
+				fmt.Println("The trash is empty")
+			}
+			for _, e := range entries {
+				kind := "-"
+				if e.IsDir {
+					kind = "d"
+				}
+				fmt.Printf("%4d  %v %v  %v\n", e.ID, kind, e.Deleted.Format("2006-01-02 15:04:05"), e.Path)
+			}
+		case "restore-trash":
+			if len(args) != 1 && len(args) != 2 {
+				fmt.Printf("Usage: %v <id> [<path>]\n", parts[0])
+				break
+			}
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				fmt.Printf("Usage: %v <id> [<path>]\n", parts[0])
+				break
+			}
+			path := ""
+			if len(args) == 2 {
+				path = args[1]
+			}
+			err = c.RestoreTrash(id, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error restoring: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "empty-trash":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			err := c.EmptyTrash()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error emptying trash: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "shares":
+			in, out, ok := true, true, true
+			var path, who string
+			for i := 0; i < len(args); i++ {
+				switch {
+				case args[i] == "--in":
+					out = false
+				case args[i] == "--out":
+					in = false
+				case args[i] == "--user" && i+1 < len(args):
+					i++
+					who = args[i]
+				case path == "" && !strings.HasPrefix(args[i], "-"):
+					path = args[i]
+				default:
+					ok = false
+				}
+			}
+			if !ok || (!in && !out) {
+				fmt.Printf("Usage: %v [--in | --out] [--user <user|@group>] [<path>]\n", parts[0])
+				break
+			}
+			outgoing, incoming, err := c.Shares(path, who)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error listing shares: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if out {
+				fmt.Println("Shared by you:")
+				if len(outgoing) == 0 {
+					fmt.Println("\tnothing")
+				}
+				for _, e := range outgoing {
+					via := ""
+					if e.Via != "" {
+						via = " via " + e.Via
+					}
+					pending := ""
+					if e.Pending {
+						pending = " (not accepted yet)"
+					}
+					fmt.Printf("\t%v  with %v%v (%v%v)%v\n", e.Path, e.Sharee, via, e.Perm, UntilString(e.Expires), pending)
+				}
+			}
+			if in {
+				fmt.Println("Shared with you:")
+				if len(incoming) == 0 {
+					fmt.Println("\tnothing")
+				}
+				for _, e := range incoming {
+					via := ""
+					if e.Via != "" {
+						via = " via " + e.Via
+					}
+					if e.Group != "" {
+						via = " through @" + e.Group
+					}
+					fmt.Printf("\t%v  from %v, who calls it %v (%v%v)%v\n", e.Name, e.Sharer, e.Origname, e.Perm, UntilString(e.Expires), via)
+				}
+			}
+		case "invites":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			invites, err := c.Invites()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error listing invitations: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if len(invites) == 0 {
+				fmt.Println("You have no invitations")
+			}
+			for _, i := range invites {
+				if i.Group != "" {
+					fmt.Printf("%4d  @%v  from %v (to join), sent %v\n", i.ID, i.Group, i.Sharer, i.Sent.Format("2006-01-02 15:04"))
+					continue
+				}
+				kind := "-"
+				if i.IsDir {
+					kind = "d"
+				}
+				if i.Transfer {
+					fmt.Printf("%4d  %v %v  from %v (to take over), sent %v\n", i.ID, kind, i.Name, i.Sharer, i.Sent.Format("2006-01-02 15:04"))
+					continue
+				}
+				owner := ""
+				if i.Owner != "" {
+					owner = ", who got it from " + i.Owner
+				}
+				fmt.Printf("%4d  %v %v  from %v%v (%v%v), sent %v\n", i.ID, kind, i.Name, i.Sharer, owner, i.Perm, UntilString(i.Expires), i.Sent.Format("2006-01-02 15:04"))
+			}
+		case "accept", "decline":
+			var id int64
+			var err error
+			if len(args) == 1 || (parts[0] == "accept" && len(args) == 3 && args[1] == "as") {
+				id, err = strconv.ParseInt(args[0], 10, 64)
+			}
+			if id == 0 || err != nil {
+				if parts[0] == "accept" {
+					fmt.Printf("Usage: %v <id> [as <name>]\n", parts[0])
+				} else {
+					fmt.Printf("Usage: %v <id>\n", parts[0])
+				}
+				break
+			}
+			if parts[0] == "accept" {
+				name := ""
+				if len(args) == 3 {
+					name = args[2]
+				}
+				err = c.Accept(id, name)
+			} else {
+				err = c.Decline(id)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error %v: %v\n", parts[0], err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "autoaccept":
+			var err error
+			switch {
+			case len(args) == 0:
+				var users []string
+				users, err = c.AutoAccepts()
+				if err == nil && len(users) == 0 {
+					fmt.Println("You don't accept shares from anyone without being asked")
+				}
+				for _, u := range users {
+					fmt.Println(u)
+				}
+			case len(args) == 2 && args[0] == "add":
+				err = c.SetAutoAccept(args[1], true)
+			case len(args) == 2 && args[0] == "remove":
+				err = c.SetAutoAccept(args[1], false)
+			default:
+				fmt.Printf("Usage: %v [add|remove <user>]\n", parts[0])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error %v: %v\n", parts[0], err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "transfer":
+			cancel := len(args) == 3 && args[0] == "--cancel"
+			if cancel {
+				args = args[1:]
+			}
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v [--cancel] <path> <user>\n", parts[0])
+				break
+			}
+			var err error
+			if cancel {
+				err = c.CancelTransfer(args[0], args[1])
+			} else {
+				err = c.Transfer(args[0], args[1])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error transfer: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "groups":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			groups, err := c.Groups()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error listing groups: %v\n", err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+			if len(groups) == 0 {
+				fmt.Println("You aren't in any groups")
+			}
+			for _, g := range groups {
+				invited := ""
+				if len(g.Invited) > 0 {
+					invited = " (invited: " + strings.Join(g.Invited, ", ") + ")"
+				}
+				fmt.Printf("@%v (owner %v): %v%v\n", g.Name, g.Owner, strings.Join(g.Members, ", "), invited)
+			}
+		case "group":
+			var err error
+			// the name can be given with or without the @ used to share with it
+			switch {
+			case len(args) == 2 && args[0] == "create":
+				err = c.CreateGroup(strings.TrimPrefix(args[1], "@"))
+			case len(args) == 2 && args[0] == "delete":
+				err = c.DeleteGroup(strings.TrimPrefix(args[1], "@"))
+			case len(args) == 3 && args[0] == "add":
+				err = c.AddToGroup(strings.TrimPrefix(args[1], "@"), args[2])
+			case len(args) == 3 && args[0] == "remove":
+				err = c.RemoveFromGroup(strings.TrimPrefix(args[1], "@"), args[2])
+			default:
+				fmt.Printf("Usage: %v create|delete <name>\n       %v add|remove <name> <user>\n", parts[0], parts[0])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error %v: %v\n", parts[0], err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
+		case "link":
+			err := runLink(c, parts[0], args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error %v: %v\n", parts[0], err)
+				if isFatal(err) {
+					return err
+				}
+				break
+			}
 		default:
 			fmt.Println("Unknown command; try \"help\"")
 		}
@@ -252,9 +801,218 @@ func RunCLI(c Client) error {
 	return nil
 }
 
+// Runs the link subcommand given by args. Usage errors are printed
+// rather than returned.
+func runLink(c Client, name string, args []string) error {
+	usage := func() error {
+		fmt.Printf("Usage: %v create [--expires <duration>] [--max <downloads>] [--password <password>] <path>\n       %v list\n       %v revoke <token>\n", name, name, name)
+		return nil
+	}
+	switch {
+	case len(args) >= 2 && args[0] == "create":
+		var expires time.Duration
+		var max int
+		var password, path string
+		for i := 1; i < len(args); i++ {
+			var err error
+			switch {
+			case args[i] == "--expires" && i+1 < len(args):
+				i++
+				expires, err = time.ParseDuration(args[i])
+				if err == nil && expires <= 0 {
+					return usage()
+				}
+			case args[i] == "--max" && i+1 < len(args):
+				i++
+				max, err = strconv.Atoi(args[i])
+				if err == nil && max <= 0 {
+					return usage()
+				}
+			case args[i] == "--password" && i+1 < len(args):
+				i++
+				password = args[i]
+			case path == "" && !strings.HasPrefix(args[i], "-"):
+				path = args[i]
+			default:
+				return usage()
+			}
+			if err != nil {
+				return usage()
+			}
+		}
+		if path == "" {
+			return usage()
+		}
+		token, err := c.CreateLink(path, expires, max, password)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+	case len(args) == 1 && args[0] == "list":
+		links, err := c.Links()
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			fmt.Println("You have no links")
+		}
+		for _, l := range links {
+			fmt.Println(linkString(l))
+		}
+	case len(args) == 2 && args[0] == "revoke":
+		return c.RevokeLink(args[1])
+	default:
+		return usage()
+	}
+	return nil
+}
+
+// Returns a one-line description of l in the format used by
+// "link list".
+func linkString(l Link) string {
+	path := l.Path
+	if l.IsDir {
+		path += "/"
+	}
+	s := fmt.Sprintf("%v  %v  made %v", l.Token, path, l.Created.Format("2006-01-02 15:04"))
+	switch {
+	case l.Expires.IsZero():
+	case l.Expires.After(time.Now()):
+		s += ", expires " + l.Expires.Format("2006-01-02 15:04")
+	default:
+		s += ", expired " + l.Expires.Format("2006-01-02 15:04")
+	}
+	if l.MaxDownloads > 0 {
+		s += fmt.Sprintf(", %v of %v downloads", l.Downloads, l.MaxDownloads)
+	} else {
+		s += fmt.Sprintf(", %v downloads", l.Downloads)
+	}
+	if l.Password {
+		s += ", password"
+	}
+	return s
+}
+
 func isFatal(err error) bool {
 	if f, ok := err.(FatalError); ok {
 		return f.IsFatal()
 	}
 	return false
 }
+
+// How much of a file is asked for at a time by the commands that only
+// read part of one.
+const rangePiece = 1 << 20
+
+// Parses the arguments of head and tail: an optional "-n <lines>" or
+// "-c <bytes>" followed by a path. Without either it is 10 lines.
+func parseCount(args []string) (lines bool, n int64, path string, ok bool) {
+	lines, n = true, 10
+	if len(args) == 3 && (args[0] == "-n" || args[0] == "-c") {
+		var err error
+		n, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 0 {
+			return false, 0, "", false
+		}
+		lines = args[0] == "-n"
+		args = args[2:]
+	}
+	if len(args) != 1 {
+		return false, 0, "", false
+	}
+	return lines, n, args[0], true
+}
+
+// Writes length bytes of the file at path starting at offset to w, or
+// everything from offset on if length is negative, a piece at a time.
+func writeRange(c Client, path string, offset int64, length int64, w io.Writer) error {
+	for length != 0 {
+		n := int64(rangePiece)
+		if length > 0 && length < n {
+			n = length
+		}
+		body, _, err := c.DownloadRange(path, offset, n)
+		if err != nil {
+			return err
+		}
+		if len(body) == 0 {
+			return nil
+		}
+		w.Write(body)
+		offset += int64(len(body))
+		if length > 0 {
+			length -= int64(len(body))
+		}
+	}
+	return nil
+}
+
+// Writes the first n lines of the file at path to w, reading only as
+// much of it as they take up.
+func headLines(c Client, path string, n int64, w io.Writer) error {
+	var offset int64
+	for n > 0 {
+		body, _, err := c.DownloadRange(path, offset, rangePiece)
+		if err != nil {
+			return err
+		}
+		if len(body) == 0 {
+			return nil
+		}
+		for i, b := range body {
+			if b == '\n' {
+				n--
+				if n == 0 {
+					body = body[:i+1]
+					break
+				}
+			}
+		}
+		w.Write(body)
+		offset += int64(len(body))
+	}
+	return nil
+}
+
+// Writes the last n lines of the file at path to w, reading it backwards
+// from the end only until they have all been found.
+func tailLines(c Client, path string, n int64, w io.Writer) error {
+	if n == 0 {
+		return nil
+	}
+	_, size, err := c.DownloadRange(path, 0, 0)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	start := size
+	for start > 0 {
+		from := start - rangePiece
+		if from < 0 {
+			from = 0
+		}
+		body, _, err := c.DownloadRange(path, from, start-from)
+		if err != nil {
+			return err
+		}
+		buf = append(body, buf...)
+		start = from
+		// a newline ending the file doesn't start another line
+		if int64(bytes.Count(bytes.TrimSuffix(buf, []byte("\n")), []byte("\n"))) >= n {
+			break
+		}
+	}
+	// find where the last n lines start
+	trimmed := bytes.TrimSuffix(buf, []byte("\n"))
+	end, cut := len(trimmed), 0
+	for ; n > 0; n-- {
+		i := bytes.LastIndexByte(trimmed[:end], '\n')
+		if i < 0 {
+			cut = 0
+			break
+		}
+		end, cut = i, i+1
+	}
+	w.Write(buf[cut:])
+	return nil
+}
@@ -4,7 +4,15 @@
 // that tests basic correctness properties about the client implementation.
 package client
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// StreamThreshold is the size above which the command-line interface
+// uploads files with UploadStream instead of reading them into memory.
+const StreamThreshold = 4 << 20
 
 // Client represents an authenticated client. All methods should be carried out
 // as whatever user the current client is authenticated as. This package is
@@ -19,14 +27,51 @@ type Client interface {
 	// Download retrieves the contents of the file given by path.
 	Download(path string) (body []byte, err error)
 
+	// UploadStream does what Upload does for size bytes read from r,
+	// sending them in pieces so the file is never held in memory whole.
+	// If the connection to the server is lost it is retried, and an
+	// upload of the same size to the same path that was interrupted
+	// earlier is resumed rather than started over.
+	UploadStream(path string, r io.ReadSeeker, size int64) (err error)
+
+	// DownloadStream writes the contents of the file given by path to w,
+	// receiving them in pieces so the file is never held in memory whole.
+	DownloadStream(path string, w io.Writer) (err error)
+
+	// DownloadRange retrieves up to length bytes of the file given by
+	// path, starting at offset, along with the size of the whole file.
+	// Fewer bytes are returned only if the file ends first.
+	DownloadRange(path string, offset int64, length int64) (body []byte, size int64, err error)
+
 	// Remove removes the file or directory identified by path, unless
 	// that path identifies a directory which is not empty, in which
 	// case an error is returned.
 	Remove(path string) (err error)
 
+	// RemoveAll removes the file or directory identified by path along
+	// with everything under it, revoking every share of the files in it.
+	// Either all of it is removed or, if an error is returned, none of it.
+	RemoveAll(path string) (summary RemoveSummary, err error)
+
+	// Move moves the file or directory at from to to, or into to if
+	// that is a directory. Shares of the moved files are kept.
+	Move(from string, to string) (err error)
+
+	// Copy copies the file at from to to, or into to if that is a
+	// directory, without transferring its contents. Directories are
+	// only copied, along with everything in them, if recursive is true.
+	Copy(from string, to string, recursive bool) (err error)
+
 	// List returns a list of the entries in the given directory.
 	List(path string) (entries []DirEnt, err error)
 
+	// ListLong returns the entries in the given directory along with
+	// their metadata.
+	ListLong(path string) (entries []FileInfo, err error)
+
+	// Stat returns the metadata of the file or directory given by path.
+	Stat(path string) (info FileInfo, err error)
+
 	// Creates a directory at the given path.
 	Mkdir(path string) (err error)
 
@@ -36,11 +81,113 @@ type Client interface {
 	// CD changes the current working directory.
 	CD(path string) (err error)
 
+	// Share shares the file or directory at path with sharee, or with
+	// every member of a group if sharee is "@" followed by its name.
+	// Unshare and Chperm take groups the same way. perm is "r", "rw"
+	// or "rws", which also lets the sharee share it onward; what is
+	// shared with the user with rws can be shared, unshared and have its
+	// permissions changed from Shared_with_me.
 	Share(path string, sharee string, perm string) (err error)
 
+	// ShareUntil is like Share, but the share expires after the given
+	// time.
+	ShareUntil(path string, sharee string, perm string, expires time.Duration) (err error)
+
 	Unshare(path string, sharee string) (err error)
 
 	Chperm(path string, sharee string, perm string) (err error)
+
+	// Quota returns how many bytes the user is using and their quota,
+	// which is negative if they have none.
+	Quota() (used int64, limit int64, err error)
+
+	// History returns the saved versions of the file given by path,
+	// oldest first.
+	History(path string) (versions []Version, err error)
+
+	// Restore makes the given version of the file at path its current
+	// content. The content it replaces is saved as a new version.
+	Restore(path string, version int) (err error)
+
+	// Trash returns what is in the user's trash, oldest first.
+	Trash() (entries []TrashEntry, err error)
+
+	// RestoreTrash moves the trash entry with the given ID back to path,
+	// or to where it was removed from if path is empty.
+	RestoreTrash(id int64, path string) (err error)
+
+	// EmptyTrash deletes everything in the user's trash for good.
+	EmptyTrash() (err error)
+
+	// Shares returns what the user shares with others and what others
+	// share with them. If path isn't empty only shares of what is at or
+	// under it are returned, and if who isn't empty only shares with or
+	// from that user, or that group if it is "@" and a group's name.
+	Shares(path string, who string) (out []OutgoingShare, in []IncomingShare, err error)
+
+	// Invites returns the invitations to share things the user hasn't
+	// accepted or declined yet, oldest first.
+	Invites() (invites []Invite, err error)
+
+	// Accept accepts the invitation with the given ID, putting what it
+	// is for in the user's Shared_with_me under name, or under the name
+	// the sharer gives it if name is empty. A file offered to the user
+	// by Transfer goes in their own directory instead.
+	Accept(id int64, name string) (err error)
+
+	// Decline declines the invitation with the given ID.
+	Decline(id int64) (err error)
+
+	// AutoAccepts returns the users whose shares the user accepts
+	// without being asked.
+	AutoAccepts() (users []string, err error)
+
+	// SetAutoAccept sets whether the user accepts shares from sharer
+	// without being asked. Accepting from someone also accepts every
+	// invitation already waiting from them.
+	SetAutoAccept(sharer string, accept bool) (err error)
+
+	// Transfer offers the file at path to recipient, who becomes its
+	// owner, along with its shares, once they accept the offer.
+	Transfer(path string, recipient string) (err error)
+
+	// CancelTransfer takes back an offer made by Transfer that hasn't
+	// been accepted yet.
+	CancelTransfer(path string, recipient string) (err error)
+
+	// Groups returns the groups the user owns or is a member of.
+	Groups() (groups []Group, err error)
+
+	// CreateGroup makes a new group owned by the user, who is its
+	// first member.
+	CreateGroup(name string) (err error)
+
+	// DeleteGroup deletes a group the user owns, revoking everything
+	// shared with it.
+	DeleteGroup(name string) (err error)
+
+	// AddToGroup invites member to join a group the user owns. Once
+	// they accept, straight away if they accept everything from the
+	// user, they get everything shared with it.
+	AddToGroup(name string, member string) (err error)
+
+	// RemoveFromGroup removes member from a group the user owns, or the
+	// user from any group they are in, revoking what it gave them. If
+	// member was only invited, the invitation is taken back.
+	RemoveFromGroup(name string, member string) (err error)
+
+	// CreateLink makes a public link to the file or directory at path,
+	// through which it can be downloaded without an account, and returns
+	// its token. The link expires after the given time, or never if it is
+	// 0, allows at most maxDownloads downloads, or any number if it is 0,
+	// and needs the given password, unless it is empty.
+	CreateLink(path string, expires time.Duration, maxDownloads int, password string) (token string, err error)
+
+	// Links returns the public links the user has made, oldest first.
+	Links() (links []Link, err error)
+
+	// RevokeLink deletes the user's public link with the given token.
+	RevokeLink(token string) (err error)
 	
 
 }
@@ -52,6 +199,141 @@ type DirEnt interface {
 	IsDir() bool
 }
 
+// FileInfo describes a file or directory in detail.
+type FileInfo struct {
+	Name     string
+	IsDir    bool
+	Size     int64     // Size of the file in bytes; 0 for directories
+	ModTime  time.Time // When it was last modified
+	Hash     string    // Hash of the file's contents; empty for directories
+	Shares   []Share   // Who the user shares it with
+	SharedBy string    // Who shared it with the user, if anyone
+	Perm     string    // The user's permissions on it if it was shared with them
+	Expires  time.Time // When the share with the user expires; the zero time if it doesn't
+}
+
+// Share describes one user something is shared with.
+type Share struct {
+	User    string
+	Perm    string    // "r", "rw" or "rws"
+	Expires time.Time // The zero time if it doesn't expire
+}
+
+// FileInfoString returns a one-line description of f in the format
+// used by "ls -l".
+func FileInfoString(f FileInfo) string {
+	kind := "-"
+	if f.IsDir {
+		kind = "d"
+	}
+	s := fmt.Sprintf("%v %12d %v  %v", kind, f.Size, f.ModTime.Format("2006-01-02 15:04"), f.Name)
+	if len(f.Shares) > 0 {
+		s += "  [shared with " + sharesString(f.Shares) + "]"
+	}
+	if f.SharedBy != "" {
+		s += fmt.Sprintf("  [shared by %v (%v%v)]", f.SharedBy, f.Perm, UntilString(f.Expires))
+	}
+	return s
+}
+
+func sharesString(shares []Share) string {
+	var s string
+	for i, sh := range shares {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%v (%v%v)", sh.User, sh.Perm, UntilString(sh.Expires))
+	}
+	return s
+}
+
+// UntilString returns ", until" followed by when a share expires, or
+// an empty string if it doesn't.
+func UntilString(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return ", until " + expires.Format("2006-01-02 15:04")
+}
+
+// RemoveSummary describes what RemoveAll removed.
+type RemoveSummary struct {
+	Files  int // Files removed
+	Dirs   int // Directories removed
+	Shares int // Shares that were revoked
+}
+
+// Version describes a saved version of a file.
+type Version struct {
+	Number int       // Version number, counting up from 1
+	Size   int64     // Size of the file in bytes
+	Saved  time.Time // When the version was replaced
+}
+
+// OutgoingShare describes something the user shares with someone.
+type OutgoingShare struct {
+	Path    string
+	Sharee  string    // A user, or "@" and the name of a group
+	Perm    string    // "r", "rw" or "rws"
+	Expires time.Time // The zero time if it doesn't expire
+	Pending bool      // True if the sharee hasn't accepted it yet
+	Via     string    // Who shared it onward, if it wasn't the user
+}
+
+// Invite describes an invitation to share something or to join a
+// group, or an offer to take over a file.
+type Invite struct {
+	ID       int64 // Identifies it to Accept and Decline
+	Sharer   string
+	Owner    string // Whose it is, if the sharer is sharing it onward
+	Name     string // What the sharer calls it
+	IsDir    bool
+	Perm     string    // "r", "rw" or "rws"
+	Expires  time.Time // When the share expires; the zero time if it doesn't
+	Sent     time.Time
+	Transfer bool   // True if it is an offer to take over the file
+	Group    string // The group it is an invitation to join, if it is one; Name is empty then
+}
+
+// IncomingShare describes something someone shares with the user.
+type IncomingShare struct {
+	Name     string // Where it is in the user's tree
+	Sharer   string
+	Origname string // What the sharer calls it
+	Perm     string // "r", "rw" or "rws"
+	Group    string    // The group it was shared through, if any
+	Expires  time.Time // The zero time if it doesn't expire
+	Via      string    // Who shared it onward with the user, if the sharer didn't
+}
+
+// Group describes a group of users things can be shared with.
+type Group struct {
+	Name    string
+	Owner   string // The only user who can add members
+	Members []string
+	Invited []string // Who was invited to join and hasn't accepted or declined yet
+}
+
+// Link describes a public link.
+type Link struct {
+	Token        string
+	Path         string
+	IsDir        bool
+	Created      time.Time
+	Expires      time.Time // The zero time if it never expires
+	MaxDownloads int       // 0 if there is no limit
+	Downloads    int
+	Password     bool // True if it needs a password
+}
+
+// TrashEntry describes something in the trash.
+type TrashEntry struct {
+	ID      int64     // Identifies the entry to RestoreTrash
+	Path    string    // Where it was removed from
+	IsDir   bool      // True if it is a directory
+	Deleted time.Time // When it was removed
+}
+
 // DirEntString returns a string representation of d. If d's
 // type implements the fmt.Stringer interface (that is, has
 // a String() string method), then its String() method is called;
@@ -2,13 +2,26 @@
 sqlite3 dropbox.db "delete from userdata"
 sqlite3 dropbox.db "delete from filedata"
 sqlite3 dropbox.db "delete from sharedata"
+sqlite3 dropbox.db "delete from chunkdata"
+sqlite3 dropbox.db "delete from filechunks"
+sqlite3 dropbox.db "delete from quotadata"
+sqlite3 dropbox.db "delete from usagedata"
+sqlite3 dropbox.db "delete from settings"
+sqlite3 dropbox.db "delete from versiondata"
+sqlite3 dropbox.db "delete from trashdata"
+sqlite3 dropbox.db "delete from trashshares"
+sqlite3 dropbox.db "delete from uploaddata"
+sqlite3 dropbox.db "delete from groupdata"
+sqlite3 dropbox.db "delete from groupmembers"
+sqlite3 dropbox.db "delete from invitedata"
+sqlite3 dropbox.db "delete from autoaccept"
+sqlite3 dropbox.db "delete from linkdata"
 
 rm -r userfs
 rm -r filestore
+rm -rf trash
+rm -rf uploads
 mkdir userfs
 mkdir filestore
 
-rm filecount.txt
-echo "1" > filecount.txt
-
 echo 
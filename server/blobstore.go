@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A BlobStore holds the contents of every uploaded file, addressed by a content key.
+// The user trees under ./userfs never contain file bodies themselves, only symlinks
+// whose targets name a key in the store, so every handler that reads or writes a
+// body has to go through here.
+type BlobStore interface {
+	// Put stores body under key, replacing anything already stored there.
+	Put(key string, body []byte) error
+
+	// Get returns the body stored under key.
+	Get(key string) ([]byte, error)
+
+	// Delete removes the body stored under key.
+	Delete(key string) error
+
+	// Stat returns the size in bytes of the body stored under key.
+	Stat(key string) (int64, error)
+
+	// List returns the key of every body in the store, in no particular order.
+	List() ([]string, error)
+}
+
+// Global blob store used by all of the handlers. Set up in main.
+var store BlobStore
+
+// Blobs are content addressed: the key of a body is the hex encoded SHA-256 of it,
+// which is also what filedata.filehash holds. Two uploads of the same content always
+// end up with the same key, so no counter is needed to name new blobs.
+func contentKey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Keys are used directly as file names by the local store, so anything that could
+// escape the store's directory is refused by every implementation.
+func checkKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// Stores each blob as a plain file on the server's disk. Keys are content hashes, so
+// blobs are sharded into subdirectories named after the first two characters of the
+// key to keep any one directory from growing too large.
+type localBlobStore struct {
+	dir string
+}
+
+// Takes in the directory the blobs live in and returns a store rooted at its absolute path,
+// creating the directory if it doesn't exist yet.
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(absdir, 0775)
+	if err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: absdir}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if len(key) <= 2 {
+		return "", fmt.Errorf("blob key %q is too short to shard", key)
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+// The body is written to a temporary file next to its final location and only renamed into
+// place once it is safely on disk, so a crash never leaves a partially written blob behind.
+func (s *localBlobStore) Put(key string, body []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0775)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-"+key+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0664)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s *localBlobStore) Stat(key string) (int64, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Walks the shard directories. Temporary files left behind by a Put that never finished aren't
+// blobs, so they are skipped.
+func (s *localBlobStore) List() ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.Mode().IsRegular() && !strings.HasPrefix(name, ".tmp-") {
+			keys = append(keys, name)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Keeps every blob in memory. Nothing survives a restart, so this is only meant for
+// tests, which put it in place of store with useMemBlobStore. The store can be used
+// from more than one goroutine at once, so every method holds mu.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memBlobStore) Put(key string, body []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), body...)
+	return nil
+}
+
+func (s *memBlobStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.blobs[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), body...), nil
+}
+
+func (s *memBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return &os.PathError{Op: "delete", Path: key, Err: os.ErrNotExist}
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memBlobStore) Stat(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.blobs[key]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	return int64(len(body)), nil
+}
+
+func (s *memBlobStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.blobs {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Takes in the path of a file in a user's tree and returns the key of the blob it points at.
+// Older links hold the absolute path of the blob inside ./filestore while newer ones hold
+// just the key, so only the last element of the target matters.
+func linkKey(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
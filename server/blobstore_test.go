@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Puts a new memBlobStore in place of store, and returns a function that puts store back.
+func useMemBlobStore() func() {
+	old := store
+	store = newMemBlobStore()
+	return func() { store = old }
+}
+
+// Returns a new localBlobStore in a temporary directory, and a function that removes it.
+func tempLocalBlobStore(t *testing.T) (*localBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "dropbox-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	s, err := newLocalBlobStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("newLocalBlobStore(%q): %v", dir, err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// test that both stores behave the same way
+func TestBlobStores(t *testing.T) {
+	local, cleanup := tempLocalBlobStore(t)
+	defer cleanup()
+	stores := []struct {
+		name string
+		s    BlobStore
+	}{
+		{"memBlobStore", newMemBlobStore()},
+		{"localBlobStore", local},
+	}
+	for _, tt := range stores {
+		s := tt.s
+		one, two := contentKey([]byte("one")), contentKey([]byte("two"))
+
+		body := []byte("one")
+		if err := s.Put(one, body); err != nil {
+			t.Fatalf("%v.Put(%q): %v", tt.name, one, err)
+		}
+		// what was put can't be changed through the slice it was put with
+		body[0] = 'x'
+		got, err := s.Get(one)
+		if err != nil || string(got) != "one" {
+			t.Fatalf("%v.Get(%q): got %q, %v; want %q", tt.name, one, got, err, "one")
+		}
+		got[0] = 'x'
+		if got, _ := s.Get(one); string(got) != "one" {
+			t.Fatalf("%v.Get(%q) after changing what it returned: got %q; want %q", tt.name, one, got, "one")
+		}
+
+		if err := s.Put(two, []byte("first")); err != nil {
+			t.Fatalf("%v.Put(%q): %v", tt.name, two, err)
+		}
+		if err := s.Put(two, []byte("second")); err != nil {
+			t.Fatalf("%v.Put(%q) again: %v", tt.name, two, err)
+		}
+		if got, err := s.Get(two); err != nil || string(got) != "second" {
+			t.Fatalf("%v.Get(%q) after replacing it: got %q, %v; want %q", tt.name, two, got, err, "second")
+		}
+		if size, err := s.Stat(two); err != nil || size != 6 {
+			t.Fatalf("%v.Stat(%q): got %v, %v; want 6", tt.name, two, size, err)
+		}
+		keys, err := s.List()
+		if err != nil {
+			t.Fatalf("%v.List: %v", tt.name, err)
+		}
+		sort.Strings(keys)
+		want := []string{one, two}
+		sort.Strings(want)
+		if len(keys) != 2 || keys[0] != want[0] || keys[1] != want[1] {
+			t.Fatalf("%v.List: got %v; want %v", tt.name, keys, want)
+		}
+
+		if err := s.Delete(one); err != nil {
+			t.Fatalf("%v.Delete(%q): %v", tt.name, one, err)
+		}
+		if _, err := s.Get(one); !os.IsNotExist(err) {
+			t.Fatalf("%v.Get(%q) after deleting it: got %v; want a not exist error", tt.name, one, err)
+		}
+		if _, err := s.Stat(one); !os.IsNotExist(err) {
+			t.Fatalf("%v.Stat(%q) after deleting it: got %v; want a not exist error", tt.name, one, err)
+		}
+		if err := s.Delete(one); !os.IsNotExist(err) {
+			t.Fatalf("%v.Delete(%q) twice: got %v; want a not exist error", tt.name, one, err)
+		}
+		if keys, _ := s.List(); len(keys) != 1 || keys[0] != two {
+			t.Fatalf("%v.List after deleting %q: got %v; want [%v]", tt.name, one, keys, two)
+		}
+
+		for _, bad := range []string{"", ".", "..", "../" + one, one + "/x", "a\\b"} {
+			if err := s.Put(bad, []byte("bad")); err == nil {
+				t.Fatalf("%v.Put(%q): got no error; want the key refused", tt.name, bad)
+			}
+			if _, err := s.Get(bad); err == nil {
+				t.Fatalf("%v.Get(%q): got no error; want the key refused", tt.name, bad)
+			}
+		}
+	}
+}
+
+// test that the local store shards blobs and never lists what an unfinished Put left behind
+func TestLocalBlobStoreLayout(t *testing.T) {
+	s, cleanup := tempLocalBlobStore(t)
+	defer cleanup()
+	key := contentKey([]byte("body"))
+	if err := s.Put(key, []byte("body")); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+	got, err := ioutil.ReadFile(s.dir + "/" + key[:2] + "/" + key)
+	if err != nil || string(got) != "body" {
+		t.Fatalf("blob %v on disk: got %q, %v; want %q", key, got, err, "body")
+	}
+	if err := s.Put("ab", []byte("short")); err == nil {
+		t.Fatalf("Put(%q): got no error; want the key refused as too short to shard", "ab")
+	}
+	err = ioutil.WriteFile(s.dir+"/"+key[:2]+"/.tmp-"+key+"-1", []byte("half"), 0664)
+	if err != nil {
+		t.Fatalf("could not leave a temporary file: %v", err)
+	}
+	if keys, err := s.List(); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Fatalf("List with a temporary file around: got %v, %v; want [%v]", keys, err, key)
+	}
+}
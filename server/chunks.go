@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Files are split into content-defined chunks before being stored, so that two files which only
+// differ in a few places share most of their chunks. Cut points are chosen with a gear rolling
+// hash over the bytes themselves rather than at fixed offsets, so inserting or deleting a byte
+// only changes the chunks around the edit instead of shifting every chunk after it.
+//
+// Each chunk is stored as its own blob, keyed by its content hash. filechunks holds the manifest
+// of every file: the hashes of its chunks, in order. A file's own hash still keys its row in
+// filedata and is what the links in userfs point at. Owners of a file hold references to its
+// chunks rather than to the file itself: every owner adds one to the refcount in chunkdata of
+// each chunk in the file's manifest, once for every time it appears there. A chunk's blob is
+// deleted once nothing refers to it, and since every owned file holds its chunks, so are the
+// rows and manifests of the files made of it.
+const (
+	chunkMin  = 4 << 10   // no cut point is looked for in the first 4 KiB of a chunk
+	chunkMax  = 64 << 10  // chunks are cut at 64 KiB no matter what
+	chunkMask = 1<<14 - 1 // gives 16 KiB chunks on average
+)
+
+// Random values for every byte, used by the rolling hash. They are generated from a fixed seed
+// so that the same content is always cut in the same places, even across restarts.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Returns the length of the first chunk at the start of data.
+func cutPoint(data []byte) int {
+	if len(data) <= chunkMin {
+		return len(data)
+	}
+	end := len(data)
+	if end > chunkMax {
+		end = chunkMax
+	}
+	var h uint64
+	for i := chunkMin; i < end; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// Splits everything read from r into chunks without ever holding more than chunkMax bytes of it.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, 0, chunkMax)}
+}
+
+// Returns the next chunk, or io.EOF once everything has been returned.
+func (c *chunker) Next() ([]byte, error) {
+	if !c.eof && len(c.buf) < chunkMax {
+		n, err := io.ReadFull(c.r, c.buf[len(c.buf):chunkMax])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	n := cutPoint(c.buf)
+	chunk := append([]byte(nil), c.buf[:n]...)
+	c.buf = append(c.buf[:0], c.buf[n:]...)
+	return chunk, nil
+}
+
+// Stores the chunk as part of o unless it is already stored. A new chunk starts out without any
+// references; it is up to the caller to add an owner to the file it is part of.
+func storeChunk(o *op, hash string, chunk []byte) error {
+	var found int
+	err := o.tx.QueryRow("SELECT count(1) FROM chunkdata WHERE chunkhash=?", hash).Scan(&found)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	if found > 0 {
+		return nil
+	}
+	data, enc, err := encodeChunk(hash, chunk)
+	if err != nil {
+		return err
+	}
+	blobkey := chunkBlobKey(hash, enc)
+	err = o.putBlob(blobkey, data)
+	if err != nil {
+		return err
+	}
+	_, err = o.tx.Exec("INSERT INTO chunkdata(chunkhash, size, refcount, codec, keyid, wrappedkey, blobkey, storedsize) values(?,?,?,?,?,?,?,?)", hash, len(chunk), 0, enc.codec, enc.keyid, enc.wrappedkey, blobkey, len(data))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	return nil
+}
+
+// Drops one reference to the chunk as part of o. When the last one goes so does its row, and
+// its blob is deleted once o commits. No file made of the chunk can have an owner left by then,
+// so their rows and manifests go too.
+func releaseChunk(o *op, hash string) {
+	var refcount int
+	var blobkey string
+	err := o.tx.QueryRow("SELECT refcount, blobkey FROM chunkdata WHERE chunkhash=?", hash).Scan(&refcount, &blobkey)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	if refcount > 1 {
+		_, err = o.tx.Exec("UPDATE chunkdata SET refcount=? WHERE chunkhash=?", refcount-1, hash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		return
+	}
+	_, err = o.tx.Exec("DELETE FROM chunkdata WHERE chunkhash=?", hash)
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM filedata WHERE filehash IN (SELECT filehash FROM filechunks WHERE chunkhash=?)", hash)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM filechunks WHERE filehash IN (SELECT filehash FROM filechunks WHERE chunkhash=?)", hash)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	o.deleteBlob(blobkey)
+}
+
+// Splits everything read from r into chunks and stores them as part of o, recording them as the
+// manifest of the file with the given hash. Returns the number of bytes read. The file has no
+// owners yet.
+func storeChunks(o *op, filehash string, r io.Reader) (int64, error) {
+	c := newChunker(r)
+	var size int64
+	for seq := 0; ; seq++ {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		chunkhash := contentKey(chunk)
+		err = storeChunk(o, chunkhash, chunk)
+		if err != nil {
+			return 0, err
+		}
+		_, err = o.tx.Exec("INSERT INTO filechunks(filehash, seq, chunkhash) values(?,?,?)", filehash, seq, chunkhash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		size += int64(len(chunk))
+	}
+	return size, nil
+}
+
+// Returns the manifest of the file with the given hash as seen from o.
+func manifest(o *op, filehash string) []string {
+	rows, err := o.tx.Query("SELECT chunkhash FROM filechunks WHERE filehash=? ORDER BY seq", filehash)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var chunks []string
+	for rows.Next() {
+		var chunkhash string
+		err = rows.Scan(&chunkhash)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		chunks = append(chunks, chunkhash)
+	}
+	rows.Close()
+	return chunks
+}
+
+// Adds an owner to the file with the given hash as part of o, adding a reference to every chunk
+// of its manifest.
+func retainChunks(o *op, filehash string) {
+	for _, chunkhash := range manifest(o, filehash) {
+		_, err := o.tx.Exec("UPDATE chunkdata SET refcount=refcount+1 WHERE chunkhash=?", chunkhash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+}
+
+// Drops an owner of the file with the given hash as part of o, releasing every chunk of its
+// manifest. Chunks nothing refers to any more are deleted, and with them the file once it has no
+// owners left.
+func releaseChunks(o *op, filehash string) {
+	for _, chunkhash := range manifest(o, filehash) {
+		releaseChunk(o, chunkhash)
+	}
+}
+
+// Where and how one chunk of a file is stored.
+type storedChunk struct {
+	hash    string
+	blobkey string
+	size    int64
+	chunkEncoding
+}
+
+// Returns the chunks making up the file with the given hash, in order.
+func fileChunks(filehash string) ([]storedChunk, error) {
+	rows, err := db.Query("SELECT c.chunkhash, c.blobkey, c.size, c.codec, c.keyid, c.wrappedkey FROM filechunks f JOIN chunkdata c ON f.chunkhash=c.chunkhash WHERE f.filehash=? ORDER BY f.seq", filehash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var chunks []storedChunk
+	for rows.Next() {
+		var c storedChunk
+		err = rows.Scan(&c.hash, &c.blobkey, &c.size, &c.codec, &c.keyid, &c.wrappedkey)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	if len(chunks) == 0 {
+		var found int
+		err = db.QueryRow("SELECT count(1) FROM filedata WHERE filehash=?", filehash).Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("no such file: %v", filehash)
+		}
+	}
+	return chunks, nil
+}
+
+// Reassembles the body of the file with the given hash from its chunks.
+func readFile(filehash string) ([]byte, error) {
+	chunks, err := fileChunks(filehash)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	for _, c := range chunks {
+		data, err := store.Get(c.blobkey)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := decodeChunk(c.hash, data, c.chunkEncoding)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(chunk)
+	}
+	return body.Bytes(), nil
+}
+
+// Returns up to length bytes of the file made of the given chunks, starting at offset. Only the
+// chunks overlapping that range are read.
+func readRange(chunks []storedChunk, offset int64, length int64) ([]byte, error) {
+	var body bytes.Buffer
+	var start int64
+	for _, c := range chunks {
+		end := start + c.size
+		if end > offset && start < offset+length {
+			data, err := store.Get(c.blobkey)
+			if err != nil {
+				return nil, err
+			}
+			chunk, err := decodeChunk(c.hash, data, c.chunkEncoding)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(chunk)) != c.size {
+				return nil, fmt.Errorf("chunk %v is %v bytes instead of %v", c.hash, len(chunk), c.size)
+			}
+			lo, hi := int64(0), c.size
+			if offset > start {
+				lo = offset - start
+			}
+			if offset+length < end {
+				hi = offset + length - start
+			}
+			body.Write(chunk[lo:hi])
+		}
+		start = end
+	}
+	return body.Bytes(), nil
+}
+
+// Files stored before chunking was introduced are a single blob keyed by the file's hash, and
+// filedata counted the owners of each of them in numowners. This splits every file into chunks,
+// writes its manifest and gives its chunks a reference for each owner it had, then drops
+// numowners, whose job the chunk refcounts have taken over. The whole-file blob is deleted
+// afterwards unless the file was small enough to be a single chunk stored as is, in which case
+// the two keys are the same. Empty files have no chunks, so they never need splitting; files
+// whose blob can't be read are skipped and left for fsck to report. It is all one op, so a crash
+// part way through leaves the old layout to start over from.
+func migrateChunks() {
+	if !hasColumn("filedata", "numowners") {
+		return
+	}
+	rows, err := db.Query("SELECT filehash, numowners FROM filedata")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	owners := make(map[string]int)
+	var hashes []string
+	for rows.Next() {
+		var filehash string
+		var numowners int
+		err = rows.Scan(&filehash, &numowners)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		owners[filehash] = numowners
+		hashes = append(hashes, filehash)
+	}
+	rows.Close()
+
+	if len(hashes) > 0 {
+		fmt.Fprintf(os.Stderr, "Splitting %v files into chunks...\n", len(hashes))
+	}
+	o := beginOp()
+	for _, filehash := range hashes {
+		if filehash == contentKey(nil) {
+			continue
+		}
+		body, err := store.Get(filehash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read blob %v: %v\n", filehash, err)
+			continue
+		}
+		size, err := storeChunks(o, filehash, bytes.NewReader(body))
+		if err != nil {
+			o.fatal("could not store chunks", err)
+		}
+		_, err = o.tx.Exec("UPDATE filedata SET size=? WHERE filehash=?", size, filehash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		for i := 0; i < owners[filehash]; i++ {
+			retainChunks(o, filehash)
+		}
+		var found int
+		err = o.tx.QueryRow("SELECT count(1) FROM chunkdata WHERE blobkey=?", filehash).Scan(&found)
+		if err != nil {
+			o.fatal("could not make query", err)
+		}
+		if found == 0 {
+			o.deleteBlob(filehash)
+		}
+	}
+	_, err = o.tx.Exec("ALTER TABLE filedata DROP COLUMN numowners")
+	if err != nil {
+		o.fatal("could not drop numowners", err)
+	}
+	if o.commit() != nil {
+		os.Exit(1)
+	}
+}
+
+// Prints how many bytes users have stored against how many are actually kept on disk, for
+// "server stats". Logical bytes count every owner of every file, whole-file bytes count each
+// distinct file once, chunk bytes count each distinct chunk once and stored bytes are what those
+// chunks take up after compression and encryption. Every owner of a file holds a reference to
+// each of its chunks, so the refcounts give the logical bytes.
+func printStats() {
+	var files, logical, wholefile, chunks, chunkbytes, stored, encrypted int64
+	err := db.QueryRow("SELECT count(1), coalesce(sum(size),0) FROM filedata").Scan(&files, &wholefile)
+	if err == nil {
+		err = db.QueryRow("SELECT count(1), coalesce(sum(size),0), coalesce(sum(storedsize),0), coalesce(sum(size*refcount),0) FROM chunkdata").Scan(&chunks, &chunkbytes, &stored, &logical)
+	}
+	if err == nil {
+		err = db.QueryRow("SELECT count(1) FROM chunkdata WHERE keyid != ''").Scan(&encrypted)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("distinct files:    %v\n", files)
+	fmt.Printf("distinct chunks:   %v\n", chunks)
+	fmt.Printf("encrypted chunks:  %v\n", encrypted)
+	fmt.Printf("logical bytes:     %v\n", logical)
+	fmt.Printf("whole-file bytes:  %v\n", wholefile)
+	fmt.Printf("chunk bytes:       %v\n", chunkbytes)
+	fmt.Printf("stored bytes:      %v\n", stored)
+	if stored > 0 {
+		fmt.Printf("dedup ratio:       %.2f\n", float64(logical)/float64(stored))
+	}
+}
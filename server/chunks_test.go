@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// Returns n bytes that look random but are the same on every run.
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// Splits data into chunks the way uploads are, reading it from r.
+func chunksOf(t *testing.T, r io.Reader) [][]byte {
+	var chunks [][]byte
+	c := newChunker(r)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("chunker.Next: %v", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// test that chunks put back together give the data back, and that only the last chunk is ever
+// shorter than chunkMin or any chunk longer than chunkMax
+func TestChunkBoundaries(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte("x")},
+		{"chunkMin bytes", randomBytes(1, chunkMin)},
+		{"chunkMin+1 bytes", randomBytes(2, chunkMin+1)},
+		{"chunkMax bytes", randomBytes(3, chunkMax)},
+		{"chunkMax+1 bytes", randomBytes(4, chunkMax+1)},
+		{"zeros", make([]byte, 5*chunkMax)},
+		{"1 MiB", randomBytes(5, 1<<20)},
+	}
+	for _, tt := range tests {
+		chunks := chunksOf(t, bytes.NewReader(tt.data))
+		if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, tt.data) {
+			t.Fatalf("%v: chunks join to %v bytes; want the %v bytes chunked", tt.name, len(joined), len(tt.data))
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > chunkMax || len(chunk) == 0 || len(chunk) < chunkMin && i != len(chunks)-1 {
+				t.Fatalf("%v: chunk %v of %v is %v bytes; want %v to %v", tt.name, i, len(chunks), len(chunk), chunkMin, chunkMax)
+			}
+		}
+		// where data is cut can't depend on how it arrives
+		slow := chunksOf(t, iotest.OneByteReader(bytes.NewReader(tt.data)))
+		if len(slow) != len(chunks) {
+			t.Fatalf("%v: got %v chunks reading a byte at a time; want %v", tt.name, len(slow), len(chunks))
+		}
+		for i := range chunks {
+			if !bytes.Equal(slow[i], chunks[i]) {
+				t.Fatalf("%v: chunk %v differs when read a byte at a time", tt.name, i)
+			}
+		}
+	}
+}
+
+// test that editing a file only changes the chunks around the edit, however much it shifts the
+// content after it
+func TestChunkDedupAcrossShifts(t *testing.T) {
+	base := randomBytes(6, 1<<20)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"byte inserted at the start", append([]byte{0}, base...)},
+		{"100 bytes inserted in the middle", append(append(append([]byte(nil), base[:len(base)/2]...), randomBytes(7, 100)...), base[len(base)/2:]...)},
+		{"byte removed at the start", base[1:]},
+		{"byte changed in the middle", append(append(append([]byte(nil), base[:len(base)/2]...), base[len(base)/2]+1), base[len(base)/2+1:]...)},
+		{"bytes appended", append(append([]byte(nil), base...), randomBytes(8, 1000)...)},
+	}
+	have := make(map[string]bool)
+	for _, chunk := range chunksOf(t, bytes.NewReader(base)) {
+		have[contentKey(chunk)] = true
+	}
+	for _, tt := range tests {
+		chunks := chunksOf(t, bytes.NewReader(tt.data))
+		changed := 0
+		for _, chunk := range chunks {
+			if !have[contentKey(chunk)] {
+				changed++
+			}
+		}
+		// cut points only depend on the bytes just before them, so the chunker is back in step with
+		// the original by the end of the chunk holding the edit, or the one after it
+		if changed > 2 {
+			t.Fatalf("%v: %v of %v chunks are new; want at most 2", tt.name, changed, len(chunks))
+		}
+	}
+}
+
+// Returns the refcount of every chunk.
+func refcounts(t *testing.T) map[string]int {
+	rows, err := db.Query("SELECT chunkhash, refcount FROM chunkdata")
+	if err != nil {
+		t.Fatalf("could not read chunkdata: %v", err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var chunkhash string
+		var refcount int
+		if err := rows.Scan(&chunkhash, &refcount); err != nil {
+			t.Fatalf("could not read chunkdata: %v", err)
+		}
+		counts[chunkhash] = refcount
+	}
+	return counts
+}
+
+// test that storing files shares chunks between them, that every owner of a file holds a
+// reference to each of its chunks, and that chunks and then files go once nothing holds them
+func TestStoreChunks(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	base := randomBytes(9, 300<<10)
+	shifted := append([]byte("a new first line\n"), base...)
+	files := [][]byte{base, shifted}
+	blobs := store.(*memBlobStore).blobs
+
+	// base gets two owners and shifted one
+	o := beginOp()
+	for _, body := range files {
+		size, err := storeChunks(o, contentKey(body), bytes.NewReader(body))
+		if err != nil || size != int64(len(body)) {
+			t.Fatalf("storeChunks: got %v, %v; want %v", size, err, len(body))
+		}
+		_, err = o.tx.Exec("INSERT INTO filedata(filename, filehash, size) values(?,?,?)", contentKey(body), contentKey(body), len(body))
+		if err != nil {
+			t.Fatalf("could not add file: %v", err)
+		}
+		retainChunks(o, contentKey(body))
+	}
+	retainChunks(o, contentKey(base))
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var manifest int
+	err := db.QueryRow("SELECT count(1) FROM filechunks").Scan(&manifest)
+	if err != nil {
+		t.Fatalf("could not count chunks: %v", err)
+	}
+	counts := refcounts(t)
+	if len(counts) >= manifest || len(blobs) != len(counts) {
+		t.Fatalf("%v manifest entries kept as %v chunks in %v blobs; want fewer chunks than entries, each in a blob", manifest, len(counts), len(blobs))
+	}
+	baseChunks, shiftedChunks := chunksOf(t, bytes.NewReader(base)), chunksOf(t, bytes.NewReader(shifted))
+	want := make(map[string]int)
+	for _, chunk := range baseChunks {
+		want[contentKey(chunk)] += 2
+	}
+	for _, chunk := range shiftedChunks {
+		want[contentKey(chunk)]++
+	}
+	for chunkhash, n := range want {
+		if counts[chunkhash] != n {
+			t.Fatalf("refcount of chunk %v: got %v; want %v", chunkhash, counts[chunkhash], n)
+		}
+	}
+	for _, body := range files {
+		got, err := readFile(contentKey(body))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("readFile: got %v bytes, %v; want the %v bytes stored", len(got), err, len(body))
+		}
+	}
+
+	// base keeps its chunks while it has an owner left
+	for i := 0; i < 2; i++ {
+		o = beginOp()
+		releaseFile(o, contentKey(base))
+		if err := o.commit(); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		_, err := readFile(contentKey(base))
+		if i == 0 && err != nil {
+			t.Fatalf("readFile with an owner left: %v", err)
+		}
+		if i == 1 && err == nil {
+			t.Fatalf("readFile with no owners left: got no error; want the file gone")
+		}
+		if got, err := readFile(contentKey(shifted)); err != nil || !bytes.Equal(got, shifted) {
+			t.Fatalf("readFile after releasing the other file: got %v bytes, %v; want the %v bytes stored", len(got), err, len(shifted))
+		}
+	}
+	if len(blobs) != len(shiftedChunks) {
+		t.Fatalf("blobs left with one file stored: got %v; want its %v chunks", len(blobs), len(shiftedChunks))
+	}
+	o = beginOp()
+	releaseFile(o, contentKey(shifted))
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	var rows, entries int
+	err = db.QueryRow("SELECT count(1) FROM filedata").Scan(&rows)
+	if err == nil {
+		err = db.QueryRow("SELECT count(1) FROM filechunks").Scan(&entries)
+	}
+	if err != nil {
+		t.Fatalf("could not count files: %v", err)
+	}
+	if len(blobs) != 0 || rows != 0 || entries != 0 {
+		t.Fatalf("once no file is owned got %v blobs, %v files and %v manifest entries; want none", len(blobs), rows, entries)
+	}
+}
+
+// test that files stored whole under the old layout are split into chunks holding a reference for
+// every owner the file had, and that numowners is dropped
+func TestMigrateChunks(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	oldFiledata(t)
+	big, small := randomBytes(10, 200<<10), []byte("small")
+	owners := map[string]int{contentKey(big): 3, contentKey(small): 1}
+	for _, body := range [][]byte{big, small} {
+		hash := contentKey(body)
+		err := store.Put(hash, body)
+		if err == nil {
+			_, err = db.Exec("INSERT INTO filedata(filename, filehash, numowners) values(?,?,?)", hash, hash, owners[hash])
+		}
+		if err != nil {
+			t.Fatalf("could not add file: %v", err)
+		}
+	}
+
+	migrateChunks()
+	if hasColumn("filedata", "numowners") {
+		t.Fatalf("filedata still has numowners after migrating")
+	}
+	counts := refcounts(t)
+	for _, body := range [][]byte{big, small} {
+		got, err := readFile(contentKey(body))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("readFile after migrating: got %v bytes, %v; want the %v bytes stored", len(got), err, len(body))
+		}
+		for _, chunk := range chunksOf(t, bytes.NewReader(body)) {
+			if n := counts[contentKey(chunk)]; n != owners[contentKey(body)] {
+				t.Fatalf("refcount of a chunk of a file with %v owners: got %v", owners[contentKey(body)], n)
+			}
+		}
+	}
+	// the small file is its own chunk, so its blob stays; the big one's whole-file blob goes
+	if _, err := store.Get(contentKey(small)); err != nil {
+		t.Fatalf("blob of the small file: %v; want it kept as its chunk", err)
+	}
+	if _, err := store.Get(contentKey(big)); err == nil {
+		t.Fatalf("whole-file blob of the big file: still there; want it deleted")
+	}
+	// starting again finds nothing to do
+	migrateChunks()
+	if again := refcounts(t); len(again) != len(counts) {
+		t.Fatalf("refcounts after migrating twice: got %v chunks; want %v", len(again), len(counts))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Chunks are compressed before they go into the blob store. The codec a chunk was stored with
+// is recorded in its chunkdata row along with the key of the blob holding it, so reading a chunk
+// never has to guess how it was stored:
+//
+//	raw     stored as is, without ever having been looked at (chunks stored by older servers,
+//	        or while compression was turned off)
+//	gzip    compressed with gzip, stored under the chunk's hash with ".gz" added
+//	stored  stored as is because compressing it didn't help, e.g. because the file was already
+//	        compressed
+//
+// Which codec new chunks get is up to the -compress flag:
+//
+//	auto    compress, unless the result isn't at least compressMinSaving smaller
+//	always  compress everything
+//	never   store everything raw
+//
+// Encryption (see crypt.go) is applied on top of the codec, after compressing.
+var compressPolicy = "auto"
+
+// Compressed chunks are only kept if they save at least this fraction of the chunk.
+const compressMinSaving = 0.1
+
+// Returns whether policy is one of the compression policies above.
+func validCompressPolicy(policy string) bool {
+	return policy == "auto" || policy == "always" || policy == "never"
+}
+
+// How a chunk is stored: the codec its bytes are in and, if it is encrypted, its wrapped data key
+// and the ID of the master key that wrapped it. keyid is empty for chunks stored in the clear.
+type chunkEncoding struct {
+	codec      string
+	keyid      string
+	wrappedkey []byte
+}
+
+// Returns the key of the blob holding a chunk stored with the given encoding. Compressed and
+// encrypted chunks get keys of their own, so that a chunk can be stored again differently without
+// ever overwriting the only copy.
+func chunkBlobKey(chunkhash string, enc chunkEncoding) string {
+	key := chunkhash
+	if enc.codec == "gzip" {
+		key += ".gz"
+	}
+	if enc.keyid != "" {
+		key += ".enc"
+	}
+	return key
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Takes in a chunk and its hash and returns the bytes to store for it under the current
+// compression policy, encrypted if the server has a key file, along with how they are encoded.
+func encodeChunk(chunkhash string, chunk []byte) ([]byte, chunkEncoding, error) {
+	data, codec, err := compressChunk(chunk)
+	if err != nil || !encrypting() {
+		return data, chunkEncoding{codec: codec}, err
+	}
+	ciphertext, wrapped, keyid, err := encryptChunk(chunkhash, data)
+	if err != nil {
+		return nil, chunkEncoding{}, err
+	}
+	return ciphertext, chunkEncoding{codec: codec, keyid: keyid, wrappedkey: wrapped}, nil
+}
+
+func compressChunk(chunk []byte) ([]byte, string, error) {
+	if compressPolicy == "never" {
+		return chunk, "raw", nil
+	}
+	compressed, err := gzipBytes(chunk)
+	if err != nil {
+		return nil, "", err
+	}
+	if compressPolicy == "auto" && float64(len(compressed)) > float64(len(chunk))*(1-compressMinSaving) {
+		return chunk, "stored", nil
+	}
+	return compressed, "gzip", nil
+}
+
+// Takes in the stored bytes of the chunk with the given hash and how they are encoded and returns
+// the chunk itself.
+func decodeChunk(chunkhash string, data []byte, enc chunkEncoding) ([]byte, error) {
+	if enc.keyid != "" {
+		var err error
+		data, err = decryptChunk(chunkhash, data, enc.wrappedkey, enc.keyid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch enc.codec {
+	case "", "raw", "stored":
+		return data, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unknown codec %q", enc.codec)
+}
+
+// Chunks which should be stored differently under the current policy, or which are still in the
+// clear while the server has a key file, in order of their hash and starting after the hash given.
+func reencodeQuery() string {
+	var cond string
+	switch compressPolicy {
+	case "auto":
+		cond = "codec='raw'"
+	case "always":
+		cond = "codec IN ('raw', 'stored')"
+	default:
+		cond = "codec='gzip'"
+	}
+	if encrypting() {
+		cond += " OR keyid=''"
+	}
+	return "SELECT chunkhash, blobkey, codec, keyid, wrappedkey FROM chunkdata WHERE (" + cond + ") AND chunkhash > ? ORDER BY chunkhash LIMIT ?"
+}
+
+// Stores up to n of the chunks after the hash given again under the current compression policy
+// and encryption setting. Each chunk is written under its new key and its row updated before the
+// old blob is deleted, so a crash at any point leaves the row pointing at a blob that holds it.
+// Returns the hash of the last chunk looked at, or "" if there were none left, and how many
+// chunks could not be stored again; those are left as they are for fsck.
+func reencodeBatch(after string, n int) (string, int) {
+	rows, err := db.Query(reencodeQuery(), after, n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var batch []storedChunk
+	for rows.Next() {
+		var c storedChunk
+		err = rows.Scan(&c.hash, &c.blobkey, &c.codec, &c.keyid, &c.wrappedkey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		batch = append(batch, c)
+	}
+	rows.Close()
+
+	last, failed := "", 0
+	for _, c := range batch {
+		last = c.hash
+		stored, err := store.Get(c.blobkey)
+		if err == nil {
+			var chunk []byte
+			chunk, err = decodeChunk(c.hash, stored, c.chunkEncoding)
+			if err == nil {
+				err = restoreChunk(c.hash, c.blobkey, chunk)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not store chunk %v again: %v\n", c.hash, err)
+			failed++
+		}
+	}
+	return last, failed
+}
+
+// Stores chunk again under the current policy, replacing how it was stored before.
+func restoreChunk(chunkhash string, oldkey string, chunk []byte) error {
+	data, enc, err := encodeChunk(chunkhash, chunk)
+	if err != nil {
+		return err
+	}
+	newkey := chunkBlobKey(chunkhash, enc)
+
+	o := beginOp()
+	if newkey == oldkey {
+		// Only the codec's name changed (raw to stored): the blob already holds these bytes, under
+		// the data key it was stored with
+		_, err = o.tx.Exec("UPDATE chunkdata SET codec=? WHERE chunkhash=?", enc.codec, chunkhash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		return o.commit()
+	}
+	err = o.putBlob(newkey, data)
+	if err != nil {
+		o.rollback()
+		return err
+	}
+	_, err = o.tx.Exec("UPDATE chunkdata SET codec=?, keyid=?, wrappedkey=?, blobkey=?, storedsize=? WHERE chunkhash=?", enc.codec, enc.keyid, enc.wrappedkey, newkey, len(data), chunkhash)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	o.deleteBlob(oldkey)
+	return o.commit()
+}
+
+// Brings every chunk stored before the current policy was chosen, or before the server was given
+// a key file, in line with it. Runs in the background, a small batch at a time so that requests
+// are never held up for long, until it has been through every chunk once. Chunks that can't be
+// stored again are passed over, so they don't hold up the rest.
+func reencodeLoop() {
+	after, failed := "", 0
+	for {
+		var n int
+		runLocked(func() { after, n = reencodeBatch(after, 16) })
+		if after == "" {
+			break
+		}
+		failed += n
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "could not store %v chunks again, which were left as they were\n", failed)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Sets the compression policy, and returns a function that sets it back.
+func setCompressPolicy(policy string) func() {
+	old := compressPolicy
+	compressPolicy = policy
+	return func() { compressPolicy = old }
+}
+
+// test which codec each policy picks and that every chunk decodes back to what was encoded
+func TestEncodeChunk(t *testing.T) {
+	text := bytes.Repeat([]byte("compresses well "), 1000)
+	noise := randomBytes(11, 10000)
+	tests := []struct {
+		policy string
+		chunk  []byte
+		codec  string
+	}{
+		{"auto", text, "gzip"},
+		{"auto", noise, "stored"},
+		{"always", text, "gzip"},
+		{"always", noise, "gzip"},
+		{"never", text, "raw"},
+		{"never", noise, "raw"},
+	}
+	for _, tt := range tests {
+		restore := setCompressPolicy(tt.policy)
+		hash := contentKey(tt.chunk)
+		data, enc, err := encodeChunk(hash, tt.chunk)
+		restore()
+		if err != nil || enc.codec != tt.codec || enc.keyid != "" {
+			t.Fatalf("encodeChunk under %q: got %+v, %v; want codec %q without a key", tt.policy, enc, err, tt.codec)
+		}
+		if enc.codec == "gzip" && tt.policy == "auto" && len(data) >= len(tt.chunk) {
+			t.Fatalf("encodeChunk under %q: got %v bytes from %v; want fewer", tt.policy, len(data), len(tt.chunk))
+		}
+		got, err := decodeChunk(hash, data, enc)
+		if err != nil || !bytes.Equal(got, tt.chunk) {
+			t.Fatalf("decodeChunk(%+v): got %v bytes, %v; want the %v bytes encoded", enc, len(got), err, len(tt.chunk))
+		}
+	}
+	if _, err := decodeChunk(contentKey([]byte("x")), []byte("x"), chunkEncoding{codec: "zstd"}); err == nil {
+		t.Fatalf("decodeChunk with an unknown codec: got no error; want one")
+	}
+}
+
+// test that changing the policy and adding a key file brings every chunk in line with them, in more
+// than one batch, even when some chunks can't be read
+func TestReencodeLoop(t *testing.T) {
+	defer clearKeys()()
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer setCompressPolicy("never")()
+
+	// each file is one chunk; the first 20 lose their blobs, more than a batch can hold
+	var bodies [][]byte
+	o := beginOp()
+	for i := 0; i < 60; i++ {
+		body := bytes.Repeat([]byte{byte(i)}, 1000)
+		bodies = append(bodies, body)
+		_, err := storeChunks(o, contentKey(body), bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("storeChunks: %v", err)
+		}
+	}
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	lost := make(map[string]bool)
+	rows, err := db.Query("SELECT chunkhash FROM chunkdata ORDER BY chunkhash LIMIT 20")
+	if err != nil {
+		t.Fatalf("could not read chunkdata: %v", err)
+	}
+	for rows.Next() {
+		var chunkhash string
+		rows.Scan(&chunkhash)
+		lost[chunkhash] = true
+	}
+	rows.Close()
+	for chunkhash := range lost {
+		store.Delete(chunkhash)
+	}
+
+	compressPolicy = "always"
+	masterKeys["k1"], currentKeyID = bytes.Repeat([]byte{1}, 32), "k1"
+	reencodeLoop()
+	for _, body := range bodies {
+		hash := contentKey(body)
+		var codec, keyid, blobkey string
+		err := db.QueryRow("SELECT codec, keyid, blobkey FROM chunkdata WHERE chunkhash=?", hash).Scan(&codec, &keyid, &blobkey)
+		if err != nil {
+			t.Fatalf("could not read chunk: %v", err)
+		}
+		if lost[hash] {
+			if codec != "raw" || keyid != "" {
+				t.Fatalf("chunk without a blob: got codec %q and key %q; want it left raw and in the clear", codec, keyid)
+			}
+			continue
+		}
+		if codec != "gzip" || keyid != "k1" || blobkey != hash+".gz.enc" {
+			t.Fatalf("chunk after reencoding: got codec %q and key %q under %v; want gzip and k1 under %v.gz.enc", codec, keyid, blobkey, hash)
+		}
+		if got, err := readFile(hash); err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("readFile after reencoding: got %v bytes, %v; want the %v bytes stored", len(got), err, len(body))
+		}
+		if _, err := store.Get(hash); err == nil {
+			t.Fatalf("raw blob of a reencoded chunk: still there; want it deleted")
+		}
+	}
+}
+
+// test that handlers registered through registerHandler hold serverMtx while they run
+func TestLockedHandler(t *testing.T) {
+	held := false
+	f := lockedHandler(func(a int, b string) string {
+		held = !serverMtx.TryLock()
+		return b + b
+	}).(func(int, string) string)
+	if got := f(1, "x"); got != "xx" {
+		t.Fatalf("locked handler: got %q; want %q", got, "xx")
+	}
+	if !held {
+		t.Fatalf("serverMtx while the handler ran: got it unlocked; want it held")
+	}
+	if !serverMtx.TryLock() {
+		t.Fatalf("serverMtx after the handler returned: got it held; want it unlocked")
+	}
+	serverMtx.Unlock()
+}
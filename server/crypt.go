@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Chunks are encrypted at rest when the server is started with -keyfile. Every chunk gets its
+// own random data key and is sealed with AES-GCM under it. The data key is then wrapped (sealed
+// with AES-GCM again) under a master key, and the wrapped key is stored in the chunk's chunkdata
+// row together with the ID of the master key that wrapped it. The master keys themselves only
+// ever live in the key file, one "<id> <hex key>" per line, the last line being the key used for
+// anything new.
+//
+// Rotating the master key ("server -keyfile <file> rotate-key") adds a new key to the file and
+// rewraps every data key under it. The chunks' blobs are never touched, since their data keys
+// don't change. Old master keys are left in the file; once a rotation has finished nothing uses
+// them any more and they can be deleted by hand.
+
+// The master keys by ID, and the ID of the one used for new chunks. Both are empty when the
+// server runs without a key file.
+var masterKeys = make(map[string][]byte)
+var currentKeyID string
+
+// Returns whether new chunks are encrypted.
+func encrypting() bool {
+	return currentKeyID != ""
+}
+
+// Takes in the path of a key file and loads the master keys in it. If the file doesn't exist it is
+// created with a fresh master key, unless chunks have been encrypted already: their keys were in
+// the missing file, and starting afresh would only hide that nothing can decrypt them.
+func loadKeyFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		var found int
+		err = db.QueryRow("SELECT count(1) FROM chunkdata WHERE keyid != ''").Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found > 0 {
+			return fmt.Errorf("key file %v does not exist, but %v chunks are encrypted under keys from it", path, found)
+		}
+		_, err = addMasterKey(path)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed line in key file: %q", line)
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("key %v in key file is not a 256 bit hex key", parts[0])
+		}
+		masterKeys[parts[0]] = key
+		currentKeyID = parts[0]
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if currentKeyID == "" {
+		return fmt.Errorf("no keys in key file %v", path)
+	}
+	return nil
+}
+
+// Generates a new master key, appends it to the key file (creating the file if needed) and
+// makes it the current key. Returns its ID.
+func addMasterKey(path string) (string, error) {
+	key := make([]byte, 32)
+	idbytes := make([]byte, 4)
+	_, err := rand.Read(key)
+	if err == nil {
+		_, err = rand.Read(idbytes)
+	}
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idbytes)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(f, "%v %v\n", id, hex.EncodeToString(key))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	masterKeys[id] = key
+	currentKeyID = id
+	return id, nil
+}
+
+// Seals plaintext with AES-GCM under key. The random nonce is put in front of the result.
+// additional is authenticated but not encrypted; we use the chunk's hash, so a blob can't be
+// passed off as some other chunk.
+func seal(key []byte, plaintext []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Opens something sealed by seal, failing if it was tampered with.
+func unseal(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+// Encrypts the stored bytes of the chunk with the given hash under a new data key. Returns the
+// ciphertext, the data key wrapped under the current master key, and that master key's ID.
+func encryptChunk(chunkhash string, data []byte) ([]byte, []byte, string, error) {
+	datakey := make([]byte, 32)
+	_, err := rand.Read(datakey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ciphertext, err := seal(datakey, data, []byte(chunkhash))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, err := seal(masterKeys[currentKeyID], datakey, []byte(chunkhash))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return ciphertext, wrapped, currentKeyID, nil
+}
+
+// Unwraps the data key of the chunk with the given hash, which was wrapped by the master key keyid.
+func unwrapKey(chunkhash string, wrapped []byte, keyid string) ([]byte, error) {
+	masterkey, ok := masterKeys[keyid]
+	if !ok {
+		return nil, fmt.Errorf("master key %v is not in the key file", keyid)
+	}
+	return unseal(masterkey, wrapped, []byte(chunkhash))
+}
+
+// Decrypts the stored bytes of the chunk with the given hash.
+func decryptChunk(chunkhash string, ciphertext []byte, wrapped []byte, keyid string) ([]byte, error) {
+	datakey, err := unwrapKey(chunkhash, wrapped, keyid)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(datakey, ciphertext, []byte(chunkhash))
+}
+
+// Adds a new master key to the key file and rewraps the data key of every encrypted chunk under
+// it, all in one transaction. If anything fails nothing is changed, and since the new key has
+// already been saved it can simply be run again.
+func rotateKey(path string) {
+	err := loadKeyFile(path)
+	if err == nil {
+		_, err = addMasterKey(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not add master key: %v\n", err)
+		os.Exit(1)
+	}
+
+	o := beginOp()
+	rows, err := o.tx.Query("SELECT chunkhash, wrappedkey, keyid FROM chunkdata WHERE keyid != '' AND keyid != ?", currentKeyID)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	type wrappedrow struct {
+		hash    string
+		wrapped []byte
+		keyid   string
+	}
+	var chunks []wrappedrow
+	for rows.Next() {
+		var c wrappedrow
+		err = rows.Scan(&c.hash, &c.wrapped, &c.keyid)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+
+	for _, c := range chunks {
+		datakey, err := unwrapKey(c.hash, c.wrapped, c.keyid)
+		if err != nil {
+			o.fatal("could not unwrap key of chunk "+c.hash, err)
+		}
+		wrapped, err := seal(masterKeys[currentKeyID], datakey, []byte(c.hash))
+		if err != nil {
+			o.fatal("could not wrap key of chunk "+c.hash, err)
+		}
+		_, err = o.tx.Exec("UPDATE chunkdata SET wrappedkey=?, keyid=? WHERE chunkhash=?", wrapped, currentKeyID, c.hash)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+	if o.commit() != nil {
+		os.Exit(1)
+	}
+	fmt.Printf("Rewrapped %v keys under master key %v\n", len(chunks), currentKeyID)
+}
+
+// Exits if there are encrypted chunks but no key file to decrypt them with.
+func checkKeys() {
+	var found int
+	err := db.QueryRow("SELECT count(1) FROM chunkdata WHERE keyid != ''").Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if found > 0 && !encrypting() {
+		fmt.Fprintf(os.Stderr, "%v chunks are encrypted; start the server with -keyfile\n", found)
+		os.Exit(1)
+	}
+}
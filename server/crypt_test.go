@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Clears the master keys, and returns a function that puts back the ones there were.
+func clearKeys() func() {
+	oldKeys, oldID := masterKeys, currentKeyID
+	masterKeys, currentKeyID = make(map[string][]byte), ""
+	return func() { masterKeys, currentKeyID = oldKeys, oldID }
+}
+
+// test that only the right key and additional data open what seal sealed
+func TestSeal(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+	sealed, err := seal(key, []byte("plaintext"), []byte("chunk"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if again, _ := seal(key, []byte("plaintext"), []byte("chunk")); bytes.Equal(again, sealed) {
+		t.Fatalf("seal: got the same output twice; want a new nonce every time")
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        []byte
+		sealed     []byte
+		additional string
+		ok         bool
+	}{
+		{"right key", key, sealed, "chunk", true},
+		{"wrong key", other, sealed, "chunk", false},
+		{"wrong additional data", key, sealed, "other chunk", false},
+		{"tampered", key, tampered, "chunk", false},
+		{"too short", key, sealed[:4], "chunk", false},
+		{"empty", key, nil, "chunk", false},
+		{"key of the wrong size", key[:5], sealed, "chunk", false},
+	}
+	for _, tt := range tests {
+		got, err := unseal(tt.key, tt.sealed, []byte(tt.additional))
+		if tt.ok && (err != nil || string(got) != "plaintext") {
+			t.Fatalf("unseal with the %v: got %q, %v; want %q", tt.name, got, err, "plaintext")
+		}
+		if !tt.ok && err == nil {
+			t.Fatalf("unseal with the %v: got %q; want an error", tt.name, got)
+		}
+	}
+}
+
+// test that chunks encrypted under one master key can still be read after rotating to another,
+// without the old key, and not with a key that isn't the one they were wrapped under
+func TestRotateKey(t *testing.T) {
+	defer clearKeys()()
+	defer openTestDB(t)()
+	dir, err := ioutil.TempDir("", "dropbox-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "keys")
+
+	if err := loadKeyFile(keyfile); err != nil {
+		t.Fatalf("loadKeyFile(%q) creating it: %v", keyfile, err)
+	}
+	first := currentKeyID
+	chunks := []string{"one", "two", "three"}
+	sealed := make(map[string][]byte)
+	for _, chunk := range chunks {
+		hash := contentKey([]byte(chunk))
+		ciphertext, wrapped, keyid, err := encryptChunk(hash, []byte(chunk))
+		if err != nil || keyid != first {
+			t.Fatalf("encryptChunk(%q): got key %v, %v; want key %v", chunk, keyid, err, first)
+		}
+		sealed[hash] = ciphertext
+		_, err = db.Exec("INSERT INTO chunkdata(chunkhash, size, refcount, codec, keyid, wrappedkey, blobkey, storedsize) values(?,?,?,?,?,?,?,?)", hash, len(chunk), 1, "raw", keyid, wrapped, hash, len(ciphertext))
+		if err != nil {
+			t.Fatalf("could not add chunk: %v", err)
+		}
+	}
+
+	// rotating loads the key file again itself, as "server rotate-key" does
+	masterKeys, currentKeyID = make(map[string][]byte), ""
+	rotateKey(keyfile)
+	second := currentKeyID
+	if second == first || masterKeys[first] == nil {
+		t.Fatalf("rotateKey: got keys %v and current key %v; want the old key %v and a new one", len(masterKeys), second, first)
+	}
+	contents, err := ioutil.ReadFile(keyfile)
+	if err != nil || len(strings.Split(strings.TrimSpace(string(contents)), "\n")) != 2 {
+		t.Fatalf("key file after rotating: got %q, %v; want two keys", contents, err)
+	}
+
+	// the old key isn't needed any more
+	delete(masterKeys, first)
+	for _, chunk := range chunks {
+		hash := contentKey([]byte(chunk))
+		var wrapped []byte
+		var keyid string
+		err := db.QueryRow("SELECT wrappedkey, keyid FROM chunkdata WHERE chunkhash=?", hash).Scan(&wrapped, &keyid)
+		if err != nil {
+			t.Fatalf("could not read chunk: %v", err)
+		}
+		if keyid != second {
+			t.Fatalf("key of chunk %q after rotating: got %v; want %v", chunk, keyid, second)
+		}
+		got, err := decryptChunk(hash, sealed[hash], wrapped, keyid)
+		if err != nil || string(got) != chunk {
+			t.Fatalf("decryptChunk(%q) after rotating: got %q, %v; want %q", chunk, got, err, chunk)
+		}
+		if _, err := decryptChunk(hash, sealed[hash], wrapped, first); err == nil {
+			t.Fatalf("decryptChunk(%q) with the old key gone: got no error; want one", chunk)
+		}
+		if _, err := decryptChunk(contentKey([]byte("other")), sealed[hash], wrapped, keyid); err == nil {
+			t.Fatalf("decryptChunk(%q) as another chunk: got no error; want one", chunk)
+		}
+	}
+
+	// a key file holding a different key under the same ID can't read anything
+	masterKeys[second] = bytes.Repeat([]byte{3}, 32)
+	hash := contentKey([]byte("one"))
+	var wrapped []byte
+	err = db.QueryRow("SELECT wrappedkey FROM chunkdata WHERE chunkhash=?", hash).Scan(&wrapped)
+	if err != nil {
+		t.Fatalf("could not read chunk: %v", err)
+	}
+	if got, err := decryptChunk(hash, sealed[hash], wrapped, second); err == nil {
+		t.Fatalf("decryptChunk with the wrong master key: got %q; want an error", got)
+	}
+
+	// a key file that has gone missing isn't made again while chunks are encrypted under it
+	missing := filepath.Join(dir, "gone")
+	masterKeys, currentKeyID = make(map[string][]byte), ""
+	if err := loadKeyFile(missing); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("loadKeyFile(%q) with encrypted chunks: got %v; want an error naming the file", missing, err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("key file after refusing to make it: got %v; want it not to exist", err)
+	}
+}
+
+// test that key files that can't be used are refused
+func TestLoadKeyFile(t *testing.T) {
+	defer clearKeys()()
+	dir, err := ioutil.TempDir("", "dropbox-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		contents string
+		ok       bool
+	}{
+		{"# just a comment\n", false},
+		{"a1 " + strings.Repeat("ab", 32) + "\n", true},
+		{"a1 " + strings.Repeat("ab", 16) + "\n", false},
+		{"a1 " + strings.Repeat("zz", 32) + "\n", false},
+		{"a1\n", false},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, "keys")
+		err := ioutil.WriteFile(path, []byte(tt.contents), 0600)
+		if err != nil {
+			t.Fatalf("could not write key file: %v", err)
+		}
+		masterKeys, currentKeyID = make(map[string][]byte), ""
+		err = loadKeyFile(path)
+		if tt.ok != (err == nil) {
+			t.Fatalf("loadKeyFile of key file %v (%q): got %v; want ok %v", i, tt.contents, err, tt.ok)
+		}
+	}
+}
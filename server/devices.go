@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Wrong passwords at login are throttled like link passwords, but a throttle keyed by nothing but
+// the username would let anyone lock a user out just by getting their password wrong on purpose.
+// So every successful login hands the client a device token, kept in devicedata along with the
+// user it was given to, and the client gives it back the next time it logs in as them. Logins
+// that come with a device token of the user's are throttled on their own, apart from every other
+// login as that user, so whoever is guessing from elsewhere only ever locks out logins without
+// one. A stolen token doesn't help with guessing either, since it is throttled all the same.
+//
+// Logins as users who don't exist still check the password against a hash made for the purpose,
+// so that how long a login takes doesn't give away whether the user exists.
+
+// Wrong passwords given at login, keyed by loginKey.
+var failedLogins = make(throttle)
+
+// A hash of no one's password, made with the iterations it was made for, that logins as users who
+// don't exist are checked against.
+var dummyHash string
+var dummyIterations int
+
+// Returns a new random device token.
+func newDeviceToken() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate device token: %v\n", err)
+		os.Exit(1)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Returns whether device is a device token given to username.
+func isDevice(username string, device string) bool {
+	if device == "" {
+		return false
+	}
+	var found int
+	err := db.QueryRow("SELECT count(1) FROM devicedata WHERE token=? AND username=?", device, username).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return found != 0
+}
+
+// Returns the key failedLogins keeps the wrong passwords given at login as username under: one of
+// their own for a device token of the user's, and one shared by every other login otherwise.
+func loginKey(username string, device string) string {
+	if isDevice(username, device) {
+		return username + "\x00" + device
+	}
+	return username
+}
+
+// Returns the device token to give back to a client that has just logged in as username with
+// device: the same one if it is the user's, and a new one otherwise.
+func deviceFor(username string, device string) string {
+	if isDevice(username, device) {
+		return device
+	}
+	device = newDeviceToken()
+	_, err := db.Exec("INSERT INTO devicedata(token, username, created) VALUES(?, ?, ?)", device, username, time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return device
+}
+
+// Checks password against a hash of no one's, taking as long as checking a user's password would.
+func checkDummyPassword(password string) {
+	if dummyIterations != *passwordIterationsFlag {
+		dummyHash = hashPassword(newDeviceToken())
+		dummyIterations = *passwordIterationsFlag
+	}
+	checkPassword(dummyHash, password)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// test that guessing a user's password locks out logins without a device token of theirs, but not
+// logins with one
+func TestLoginThrottle(t *testing.T) {
+	defer setIterations(1000)()
+	defer openTestDB(t)()
+	defer func() { failedLogins = make(throttle) }()
+	_, err := db.Exec("INSERT INTO userdata (username, passhash) VALUES (?, ?)", "alice", hashPassword("hunter22"))
+	if err != nil {
+		t.Fatalf("could not add user: %v", err)
+	}
+
+	ret := authenticateHandler("alice", "hunter22", "")
+	if !ret.Auth || ret.Device == "" {
+		t.Fatalf("authenticateHandler: got %+v; want Auth true and a device token", ret)
+	}
+	device := ret.Device
+	if ret := authenticateHandler("alice", "hunter22", device); ret.Device != device {
+		t.Fatalf("authenticateHandler with device token %q: got device token %q; want the same one", device, ret.Device)
+	}
+	if ret := authenticateHandler("bob", "hunter22", device); ret.Auth || ret.Device != "" {
+		t.Fatalf("authenticateHandler for a user that doesn't exist: got %+v; want Auth false and no device token", ret)
+	}
+	if ret := authenticateHandler("alice", "hunter23", ""); ret.Auth || ret.Device != "" {
+		t.Fatalf("authenticateHandler with the wrong password: got %+v; want Auth false and no device token", ret)
+	}
+
+	// someone guessing without a device token locks out only logins without one
+	for i := 0; i < maxPasswordFailures; i++ {
+		authenticateHandler("alice", "hunter23", "")
+	}
+	if ret := authenticateHandler("alice", "hunter22", ""); ret.Auth {
+		t.Fatalf("authenticateHandler without a device token after %v failures: got Auth true; want false", maxPasswordFailures+1)
+	}
+	if ret := authenticateHandler("alice", "hunter22", "not-a-device"); ret.Auth {
+		t.Fatalf("authenticateHandler with a made-up device token after %v failures: got Auth true; want false", maxPasswordFailures+1)
+	}
+	if ret := authenticateHandler("alice", "hunter22", device); !ret.Auth {
+		t.Fatalf("authenticateHandler with a device token after %v failures: got Auth false; want true", maxPasswordFailures+1)
+	}
+
+	// a device token of alice's is no use logging in as anyone else
+	_, err = db.Exec("INSERT INTO userdata (username, passhash) VALUES (?, ?)", "carol", hashPassword("hunter22"))
+	if err != nil {
+		t.Fatalf("could not add user: %v", err)
+	}
+	if ret := authenticateHandler("carol", "hunter22", device); !ret.Auth || ret.Device == device {
+		t.Fatalf("authenticateHandler as carol with alice's device token: got %+v; want Auth true and a new device token", ret)
+	}
+
+	// logins with a device token are throttled too, apart from the rest
+	for i := 0; i < maxPasswordFailures; i++ {
+		authenticateHandler("alice", "hunter23", device)
+	}
+	if ret := authenticateHandler("alice", "hunter22", device); ret.Auth {
+		t.Fatalf("authenticateHandler with a device token after %v failures with it: got Auth true; want false", maxPasswordFailures)
+	}
+	failedLogins[loginKey("alice", device)].until = time.Now()
+	if ret := authenticateHandler("alice", "hunter22", device); !ret.Auth {
+		t.Fatalf("authenticateHandler with a device token once the delay has passed: got Auth false; want true")
+	}
+}
+
+// test that logins as users who don't exist still check the password
+func TestDummyPassword(t *testing.T) {
+	defer setIterations(1000)()
+	defer openTestDB(t)()
+	defer func() { failedLogins = make(throttle) }()
+	if ret := authenticateHandler("bob", "hunter22", ""); ret.Auth {
+		t.Fatalf("authenticateHandler for a user that doesn't exist: got Auth true; want false")
+	}
+	if dummyIterations != 1000 || needsRehash(dummyHash) {
+		t.Fatalf("dummyHash after a login as a user that doesn't exist: got %q; want one made with 1000 iterations", dummyHash)
+	}
+}
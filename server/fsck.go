@@ -0,0 +1,593 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// "server fsck [--repair]" checks that ./userfs, ./trash, the blob store and the database agree with each
+// other, and prints every inconsistency it finds. With --repair it also fixes the ones that can be
+// fixed without losing data that is still there:
+//
+//   - shares whose original file or sharee link is gone are pruned, along with whichever link remains
+//   - shares with groups that no longer exist, and shares members got through a group that no
+//     longer gives it to them, are pruned
+//   - sharee links to shared directories that point anywhere but the directory are made again
+//   - re-shares the share they were made through no longer allows are pruned, along with what
+//     was re-shared through them
+//   - invitations to share something that is gone, or to join a group that is gone, are removed
+//   - links pointing at a file the database doesn't know about are removed
+//   - trash entries whose contents are gone are removed
+//   - versions of files that are gone, or that hold a file the database doesn't know about, are removed
+//   - files without any owner links or versions are removed
+//   - what each user is charged for is set to what their tree, trash and versions hold
+//   - manifests of files that no longer exist are removed
+//   - chunk refcounts are set to the references held by the owners of the files using them, and
+//     unused chunks are released
+//   - blobs no chunk is stored in are deleted
+//
+// Files or chunks whose data is missing are only reported, since there is nothing to repair them
+// from. Every repair is made as part of one op, so a failure part way through changes nothing.
+// fsck takes the same lock on ./server.lock as the server, so it refuses to start while the server
+// is running.
+type fsck struct {
+	o        *op
+	repair   bool
+	problems int
+	repaired int
+
+	// how many owners each file has, found by checkOwners
+	owners map[string]int
+}
+
+// Reports one inconsistency. fix is what --repair does about it, or nil if it can't be repaired.
+func (f *fsck) problem(fix func() error, format string, a ...interface{}) {
+	f.problems++
+	fmt.Printf(format+"\n", a...)
+	if !f.repair || fix == nil {
+		return
+	}
+	err := fix()
+	if err != nil {
+		fmt.Printf("  could not repair: %v\n", err)
+		return
+	}
+	f.repaired++
+	fmt.Printf("  repaired\n")
+}
+
+// Runs fsck with the arguments that followed "fsck" on the command line and exits with a non-zero
+// status if anything is left unrepaired.
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed instead of only reporting it")
+	flags.Parse(args)
+
+	f := &fsck{o: beginOp(), repair: *repair}
+	f.checkShares()
+	f.checkReshares()
+	f.checkInvites()
+	f.checkLinks()
+	f.checkTrash()
+	f.checkVersions()
+	f.checkOwners()
+	f.checkUsage()
+	f.checkManifests()
+	f.checkChunks()
+	f.checkBlobs()
+
+	if f.repair {
+		if f.o.commit() != nil {
+			os.Exit(1)
+		}
+		fmt.Printf("%v problems found, %v repaired\n", f.problems, f.repaired)
+	} else {
+		f.o.rollback()
+		fmt.Printf("%v problems found\n", f.problems)
+	}
+	if f.problems > f.repaired {
+		os.Exit(1)
+	}
+}
+
+// Shares whose original file or sharee link no longer exists, shares that groups no longer
+// account for, and links to shared directories that point somewhere else.
+func (f *fsck) checkShares() {
+	type share struct{ sharer, sharee, origpath, shareepath, group string }
+	rows, err := f.o.tx.Query("SELECT sharer, sharee, origpath, shareepath, grp FROM sharedata")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var s share
+		err = rows.Scan(&s.sharer, &s.sharee, &s.origpath, &s.shareepath, &s.group)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		shares = append(shares, s)
+	}
+	rows.Close()
+
+	for _, s := range shares {
+		s := s
+		fi, origErr := os.Lstat(s.origpath)
+		if strings.HasPrefix(s.sharee, "@") {
+			// shares with groups have no link of their own
+			prune := func() error {
+				_, err := f.o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", s.sharer, s.sharee, s.origpath)
+				return err
+			}
+			if origErr != nil {
+				f.problem(prune, "share of %v from %v to %v: original file is missing", s.origpath, s.sharer, s.sharee)
+			} else if groupOwner(f.o.tx, s.sharee[1:]) == "" {
+				f.problem(prune, "share of %v from %v to %v: there is no such group", s.origpath, s.sharer, s.sharee)
+			}
+			continue
+		}
+		_, shareeErr := os.Lstat(s.shareepath)
+		if s.group != "" && origErr == nil && shareeErr == nil {
+			var found int
+			err = f.o.tx.QueryRow("SELECT count(1) FROM sharedata s JOIN groupmembers m ON s.sharee='@'||m.groupname WHERE s.sharer=? AND s.origpath=? AND m.groupname=? AND m.member=?", s.sharer, s.origpath, s.group, s.sharee).Scan(&found)
+			if err != nil {
+				f.o.fatal("could not make query", err)
+			}
+			if found == 0 {
+				f.problem(func() error {
+					err := f.o.removeLink(s.shareepath)
+					if err == nil {
+						_, err = f.o.tx.Exec("DELETE FROM sharedata WHERE shareepath=?", s.shareepath)
+					}
+					return err
+				}, "share of %v from %v to %v: @%v no longer gives it to them", s.origpath, s.sharer, s.sharee, s.group)
+				continue
+			}
+		}
+		if origErr == nil && shareeErr == nil {
+			if target, _ := os.Readlink(s.shareepath); fi.IsDir() && target != s.origpath {
+				f.problem(func() error {
+					err := f.o.removeLink(s.shareepath)
+					if err != nil {
+						return err
+					}
+					return f.o.symlink(s.origpath, s.shareepath)
+				}, "share of %v from %v to %v: %v doesn't link to it", s.origpath, s.sharer, s.sharee, s.shareepath)
+			}
+			continue
+		}
+		prune := func() error {
+			if shareeErr == nil {
+				err := f.o.removeLink(s.shareepath)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := f.o.tx.Exec("DELETE FROM sharedata WHERE shareepath=?", s.shareepath)
+			return err
+		}
+		if origErr != nil {
+			f.problem(prune, "share of %v from %v to %v: original file is missing", s.origpath, s.sharer, s.sharee)
+		} else {
+			f.problem(prune, "share of %v from %v to %v: %v is missing", s.origpath, s.sharer, s.sharee, s.shareepath)
+		}
+	}
+}
+
+// Re-shares the share they were made through no longer allows.
+func (f *fsck) checkReshares() {
+	type share struct{ sharer, sharee, origpath, parent string }
+	rows, err := f.o.tx.Query("SELECT c.sharer, c.sharee, c.origpath, c.parent FROM sharedata c WHERE c.parent!='' AND NOT (" + reshareAllowed + ")")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var s share
+		err = rows.Scan(&s.sharer, &s.sharee, &s.origpath, &s.parent)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		shares = append(shares, s)
+	}
+	rows.Close()
+
+	for _, s := range shares {
+		s := s
+		f.problem(func() error {
+			ret := pruneReshares(f.o, s.sharer)
+			if ret != "" {
+				return fmt.Errorf("%v", ret)
+			}
+			return nil
+		}, "share of %v from %v to %v: %v can't share it onward", s.origpath, s.sharer, s.sharee, s.parent)
+	}
+}
+
+// Invitations to share something that no longer exists, or to join a group that no longer does.
+func (f *fsck) checkInvites() {
+	type invite struct {
+		id                            int64
+		sharer, sharee, origpath, grp string
+	}
+	rows, err := f.o.tx.Query("SELECT id, sharer, sharee, origpath, grp FROM invitedata")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	var invites []invite
+	for rows.Next() {
+		var i invite
+		err = rows.Scan(&i.id, &i.sharer, &i.sharee, &i.origpath, &i.grp)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		invites = append(invites, i)
+	}
+	rows.Close()
+
+	for _, i := range invites {
+		i := i
+		if i.grp != "" {
+			if groupOwner(f.o.tx, i.grp) == "" {
+				f.problem(func() error {
+					_, err := f.o.tx.Exec("DELETE FROM invitedata WHERE id=?", i.id)
+					return err
+				}, "invitation %v from %v to %v: group %v is gone", i.id, i.sharer, i.sharee, i.grp)
+			}
+			continue
+		}
+		if _, err := os.Lstat(i.origpath); err != nil {
+			f.problem(func() error {
+				_, err := f.o.tx.Exec("DELETE FROM invitedata WHERE id=?", i.id)
+				return err
+			}, "invitation %v from %v to %v: %v is missing", i.id, i.sharer, i.sharee, i.origpath)
+		}
+	}
+}
+
+// Every link to a file in ./userfs and ./trash, by absolute path, along with the key it points at
+// and whether it is an owner's link rather than a sharee's link under Shared_with_me. Links in the
+// trash still own their files.
+type userLink struct {
+	path  string
+	key   string
+	owner bool
+}
+
+func (f *fsck) userLinks() []userLink {
+	var links []userLink
+	for _, dir := range []string{"./userfs", "./trash"} {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			f.o.fatal("could not find "+dir, err)
+		}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink == 0 || isDirLink(path) {
+				return nil
+			}
+			key, err := linkKey(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			parts := strings.Split(rel, string(filepath.Separator))
+			owner := dir == "./trash" || !(len(parts) > 2 && parts[1] == "Shared_with_me")
+			links = append(links, userLink{path, key, owner})
+			return nil
+		})
+		if err != nil {
+			f.o.fatal("could not walk "+dir, err)
+		}
+	}
+	return links
+}
+
+// Trash entries whose contents are gone.
+func (f *fsck) checkTrash() {
+	entries, err := trashEntries(f.o.tx, "1")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	for _, e := range entries {
+		if _, err := os.Lstat(e.trashpath); err == nil {
+			continue
+		}
+		e := e
+		f.problem(func() error {
+			_, err := f.o.tx.Exec("DELETE FROM trashshares WHERE trashid=?", e.id)
+			if err == nil {
+				_, err = f.o.tx.Exec("DELETE FROM trashdata WHERE id=?", e.id)
+			}
+			return err
+		}, "trash entry %v of %v: %v is missing", e.id, e.owner, e.trashpath)
+	}
+}
+
+// Links pointing at a file filedata has no row for.
+func (f *fsck) checkLinks() {
+	for _, l := range f.userLinks() {
+		var found int
+		err := f.o.tx.QueryRow("SELECT count(1) FROM filedata WHERE filehash=?", l.key).Scan(&found)
+		if err != nil {
+			f.o.fatal("could not make query", err)
+		}
+		if found > 0 {
+			continue
+		}
+		l := l
+		f.problem(func() error {
+			err := f.o.removeLink(l.path)
+			if err == nil && !l.owner {
+				_, err = f.o.tx.Exec("DELETE FROM sharedata WHERE shareepath=?", l.path)
+			}
+			return err
+		}, "%v: points at unknown file %v", l.path, l.key)
+	}
+}
+
+// Versions of files that no longer exist, or holding a file filedata has no row for.
+func (f *fsck) checkVersions() {
+	type version struct {
+		owner, path, hash string
+		number            int
+	}
+	rows, err := f.o.tx.Query("SELECT owner, path, version, filehash FROM versiondata")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	var versions []version
+	for rows.Next() {
+		var v version
+		err = rows.Scan(&v.owner, &v.path, &v.number, &v.hash)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+
+	for _, v := range versions {
+		v := v
+		var found int
+		err = f.o.tx.QueryRow("SELECT count(1) FROM filedata WHERE filehash=?", v.hash).Scan(&found)
+		if err != nil {
+			f.o.fatal("could not make query", err)
+		}
+		drop := func() error {
+			_, err := f.o.tx.Exec("DELETE FROM versiondata WHERE owner=? AND path=? AND version=?", v.owner, v.path, v.number)
+			return err
+		}
+		if found == 0 {
+			f.problem(drop, "version %v of %v: holds unknown file %v", v.number, v.path, v.hash)
+		} else if fi, err := os.Lstat(v.path); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			f.problem(drop, "version %v of %v: file is gone", v.number, v.path)
+		}
+	}
+}
+
+// Files no owner link or version holds any more. Their chunks hold no references for them, so
+// only the row and the manifest are left to remove. Also records the owners of every file for
+// checkChunks.
+func (f *fsck) checkOwners() {
+	f.owners = make(map[string]int)
+	for _, l := range f.userLinks() {
+		if l.owner {
+			f.owners[l.key]++
+		}
+	}
+	for _, hash := range f.hashes("SELECT filehash FROM versiondata") {
+		f.owners[hash]++
+	}
+	for _, hash := range f.hashes("SELECT filehash FROM filedata") {
+		if f.owners[hash] > 0 {
+			continue
+		}
+		hash := hash
+		f.problem(func() error {
+			_, err := f.o.tx.Exec("DELETE FROM filedata WHERE filehash=?", hash)
+			if err == nil {
+				_, err = f.o.tx.Exec("DELETE FROM filechunks WHERE filehash=?", hash)
+			}
+			return err
+		}, "file %v: no links or versions left", hash)
+	}
+}
+
+// Users whose usage total doesn't match what their tree, trash and versions hold. Users without
+// a total yet are passed over, since the server works theirs out when it next starts.
+func (f *fsck) checkUsage() {
+	rows, err := f.o.tx.Query("SELECT u.username, coalesce(d.used, -1) FROM userdata u LEFT JOIN usagedata d ON d.username=u.username ORDER BY u.username")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	recorded := make(map[string]int64)
+	var users []string
+	for rows.Next() {
+		var user string
+		var used int64
+		err = rows.Scan(&user, &used)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		recorded[user] = used
+		users = append(users, user)
+	}
+	rows.Close()
+
+	for _, user := range users {
+		user := user
+		actual, err := walkUsage(f.o.tx, user)
+		if err != nil && !os.IsNotExist(err) {
+			f.o.fatal("could not walk the tree of "+user, err)
+		}
+		if recorded[user] < 0 || actual == recorded[user] {
+			continue
+		}
+		f.problem(func() error {
+			_, err := f.o.tx.Exec("INSERT OR REPLACE INTO usagedata(username, used) values(?,?)", user, actual)
+			return err
+		}, "user %v: %v bytes in their tree, trash and versions but charged for %v", user, actual, recorded[user])
+	}
+}
+
+// Manifests of files that no longer exist, and files that have lost theirs.
+func (f *fsck) checkManifests() {
+	orphans := f.hashes("SELECT DISTINCT filehash FROM filechunks WHERE filehash NOT IN (SELECT filehash FROM filedata)")
+	for _, hash := range orphans {
+		hash := hash
+		f.problem(func() error {
+			_, err := f.o.tx.Exec("DELETE FROM filechunks WHERE filehash=?", hash)
+			return err
+		}, "manifest of %v: file doesn't exist", hash)
+	}
+
+	lost := f.hashes("SELECT filehash FROM filedata WHERE filehash != '" + contentKey(nil) + "' AND filehash NOT IN (SELECT filehash FROM filechunks)")
+	for _, hash := range lost {
+		f.problem(nil, "file %v: has no chunks", hash)
+	}
+
+	missing := f.hashes("SELECT DISTINCT chunkhash FROM filechunks WHERE chunkhash NOT IN (SELECT chunkhash FROM chunkdata)")
+	for _, hash := range missing {
+		f.problem(nil, "chunk %v: used by a manifest but not stored", hash)
+	}
+}
+
+// Chunks whose refcount doesn't match the references their files' owners hold: one for every
+// owner of a file for every time the chunk appears in its manifest.
+func (f *fsck) checkChunks() {
+	rows, err := f.o.tx.Query("SELECT filehash, chunkhash FROM filechunks")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	uses := make(map[string]int)
+	for rows.Next() {
+		var filehash, chunkhash string
+		err = rows.Scan(&filehash, &chunkhash)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		uses[chunkhash] += f.owners[filehash]
+	}
+	rows.Close()
+
+	type chunkrow struct {
+		hash     string
+		refcount int
+		blobkey  string
+	}
+	rows, err = f.o.tx.Query("SELECT chunkhash, refcount, blobkey FROM chunkdata")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	var chunks []chunkrow
+	for rows.Next() {
+		var c chunkrow
+		err = rows.Scan(&c.hash, &c.refcount, &c.blobkey)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+
+	for _, c := range chunks {
+		c, actual := c, uses[c.hash]
+		if actual == c.refcount {
+			continue
+		}
+		if actual == 0 {
+			f.problem(func() error {
+				_, err := f.o.tx.Exec("DELETE FROM chunkdata WHERE chunkhash=?", c.hash)
+				if err == nil {
+					f.o.deleteBlob(c.blobkey)
+				}
+				return err
+			}, "chunk %v: unused but refcount is %v", c.hash, c.refcount)
+			continue
+		}
+		f.problem(func() error {
+			_, err := f.o.tx.Exec("UPDATE chunkdata SET refcount=? WHERE chunkhash=?", actual, c.hash)
+			return err
+		}, "chunk %v: %v references held but refcount is %v", c.hash, actual, c.refcount)
+	}
+}
+
+// Chunks whose blob is missing, and blobs that hold no chunk. Chunks deleted by an earlier repair
+// are already gone from chunkdata, and their blobs are deleted when the op commits.
+func (f *fsck) checkBlobs() {
+	rows, err := f.o.tx.Query("SELECT chunkhash, blobkey FROM chunkdata")
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	used := make(map[string]bool)
+	var missing []string
+	for rows.Next() {
+		var hash, blobkey string
+		err = rows.Scan(&hash, &blobkey)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		used[blobkey] = true
+		if _, err := store.Stat(blobkey); err != nil {
+			missing = append(missing, hash)
+		}
+	}
+	rows.Close()
+	for _, hash := range missing {
+		f.problem(nil, "chunk %v: blob is missing", hash)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		f.o.fatal("could not list blobs", err)
+	}
+	for _, key := range keys {
+		if used[key] || f.o.doomed[key] {
+			continue
+		}
+		key := key
+		f.problem(func() error {
+			f.o.deleteBlob(key)
+			return nil
+		}, "blob %v: holds no chunk", key)
+	}
+}
+
+// Runs a query returning one column of hashes.
+func (f *fsck) hashes(query string) []string {
+	rows, err := f.o.tx.Query(query)
+	if err != nil {
+		f.o.fatal("could not access database", err)
+	}
+	defer rows.Close()
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			f.o.fatal("could not access database", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
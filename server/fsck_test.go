@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs every check of fsck once, committing the repairs if repair is set, and returns how many
+// problems it found.
+func runChecks(t *testing.T, repair bool) int {
+	f := &fsck{o: beginOp(), repair: repair}
+	f.checkShares()
+	f.checkLinks()
+	f.checkOwners()
+	f.checkManifests()
+	f.checkChunks()
+	f.checkBlobs()
+	if !repair {
+		f.o.rollback()
+	} else if err := f.o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	return f.problems
+}
+
+// test that fsck finds one of each kind of inconsistency without changing anything, that
+// --repair fixes all of them but a lost blob, and that nothing else is found afterwards
+func TestFsck(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	root, err := filepath.Abs("userfs")
+	if err != nil {
+		t.Fatalf("could not find userfs: %v", err)
+	}
+	big := randomBytes(4, 200<<10)
+	o := beginOp()
+	for path, body := range map[string][]byte{"ann/one": big, "ann/two": big, "bob/b": []byte("bob's"), "bob/lost": []byte("lost")} {
+		if ret := storeFile(o, filepath.Join(root, path), filepath.Dir(path), body); ret != "" {
+			o.rollback()
+			t.Fatalf("storeFile %v: %v", path, ret)
+		}
+	}
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// a share whose sharee link is gone, a link to a file nobody stored, a file nobody links to
+	// any more, a refcount too high, a blob holding no chunk and a chunk whose blob is lost
+	_, err = db.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm) values(?,?,?,?,?)", "ann", "bob", filepath.Join(root, "ann/one"), filepath.Join(root, "bob/Shared_with_me/one"), 1)
+	if err == nil {
+		err = os.Symlink(contentKey([]byte("nothing")), "userfs/bob/dangling")
+	}
+	if err == nil {
+		err = os.Remove("userfs/bob/b")
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE chunkdata SET refcount=refcount+5 WHERE chunkhash=(SELECT chunkhash FROM filechunks WHERE filehash=? AND seq=0)", contentKey(big))
+	}
+	if err == nil {
+		err = store.Put(contentKey([]byte("stray")), []byte("stray"))
+	}
+	if err == nil {
+		err = store.Delete(contentKey([]byte("lost")))
+	}
+	if err != nil {
+		t.Fatalf("could not break things: %v", err)
+	}
+
+	before := snapshot(t)
+	if got := runChecks(t, false); got != 7 {
+		t.Fatalf("checking: got %v problems; want 7", got)
+	}
+	if after := snapshot(t); after != before {
+		t.Fatalf("checking changed\n%v\nto\n%v", before, after)
+	}
+
+	if got := runChecks(t, true); got != 7 {
+		t.Fatalf("repairing: got %v problems; want 7", got)
+	}
+	if got := runChecks(t, false); got != 1 {
+		t.Fatalf("after repairing: got %v problems; want only the lost blob", got)
+	}
+	if _, err := os.Lstat("userfs/bob/dangling"); !os.IsNotExist(err) {
+		t.Fatalf("dangling link: got %v; want it removed", err)
+	}
+	for _, key := range []string{contentKey([]byte("bob's")), contentKey([]byte("stray"))} {
+		if _, err := store.Stat(key); err == nil {
+			t.Fatalf("blob %v: still there; want it deleted", key)
+		}
+	}
+	if body, err := readFile(contentKey(big)); err != nil || len(body) != len(big) {
+		t.Fatalf("readFile: got %v bytes, %v; want the %v bytes stored", len(body), err, len(big))
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"../internal"
+)
+
+// Users can put other users into named groups and share with a whole group at once by giving
+// "@name" instead of a username to share, unshare and chperm. Groups are kept in groupdata along
+// with the user who made them, who is the only one who can change who is in them, and their
+// members in groupmembers. Whoever makes a group is its first member, only members can share
+// with a group, and members can leave it whenever they like. Since what members get through a
+// group is the group's to give, they can't remove it from their Shared_with_me but by leaving.
+//
+// A share with a group is kept in sharedata like any other share, with "@name" as its sharee and
+// no sharee link. Each member then gets a share of their own, made by syncGroupShares, which
+// records the group it came from in grp. Whenever a group's shares or members change, the shares
+// of its members are worked out again, so new members get everything shared with the group and
+// members who leave lose it. A member given something through more than one group gets the best
+// permissions of them, and a share made with a member directly always takes the place of what
+// they get through a group.
+//
+// Nobody is put into a group without agreeing to it, since everything shared with the group would
+// show up in their Shared_with_me. Adding someone sends them an invitation to join instead, kept
+// in invitedata with the group's name in grp, which they accept or decline like an invitation to
+// share. Users who accept everything from the group's owner join straight away.
+
+// Group names are kept simple, since they are typed after an @.
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Returns the owner of the group with the given name, or "" if there is no such group.
+func groupOwner(q querier, name string) string {
+	var owner string
+	err := q.QueryRow("SELECT owner FROM groupdata WHERE name=?", name).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return ""
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return owner
+}
+
+// Returns the members of the group with the given name, sorted by name.
+func groupMembers(q querier, name string) []string {
+	rows, err := q.Query("SELECT member FROM groupmembers WHERE groupname=? ORDER BY member", name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var member string
+		err = rows.Scan(&member)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// Returns whether username is in the group with the given name.
+func inGroup(q querier, name string, username string) bool {
+	var found int
+	err := q.QueryRow("SELECT count(1) FROM groupmembers WHERE groupname=? AND member=?", name, username).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return found > 0
+}
+
+// Works out again what member gets through the groups they are in, as part of o: shares of
+// groups they have joined are given to them, shares of groups they have left, or that are gone,
+// are taken away, and the permissions of the rest are brought up to date. Shares made with them
+// directly are left alone.
+func syncGroupShares(o *op, member string) string {
+	type grant struct {
+		sharer, origpath, group string
+		perm                    int
+		expires                 int64
+	}
+	// shares that never expire come before the ones that do, and later expiry times before earlier
+	rows, err := o.tx.Query("SELECT s.sharer, s.origpath, s.perm, s.expires, m.groupname FROM sharedata s JOIN groupmembers m ON s.sharee='@'||m.groupname WHERE m.member=? AND s.sharer!=? AND (s.expires=0 OR s.expires>?) ORDER BY s.perm DESC, s.expires=0 DESC, s.expires DESC, m.groupname", member, member, time.Now().Unix())
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	want := make(map[string]grant)
+	var order []string
+	for rows.Next() {
+		var g grant
+		err = rows.Scan(&g.sharer, &g.origpath, &g.perm, &g.expires, &g.group)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		// the best permissions come first
+		key := g.sharer + "\x00" + g.origpath
+		if _, ok := want[key]; !ok {
+			want[key] = g
+			order = append(order, key)
+		}
+	}
+	rows.Close()
+
+	type share struct {
+		sharer, origpath, shareepath, group string
+		perm                                int
+		expires                             int64
+	}
+	rows, err = o.tx.Query("SELECT sharer, origpath, shareepath, perm, grp, expires FROM sharedata WHERE sharee=?", member)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var sh share
+		err = rows.Scan(&sh.sharer, &sh.origpath, &sh.shareepath, &sh.perm, &sh.group, &sh.expires)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		shares = append(shares, sh)
+	}
+	rows.Close()
+
+	for _, sh := range shares {
+		key := sh.sharer + "\x00" + sh.origpath
+		g, ok := want[key]
+		delete(want, key)
+		if sh.group == "" {
+			continue
+		}
+		if !ok {
+			err = o.removeLink(sh.shareepath)
+			if err != nil && !os.IsNotExist(err) {
+				return "Could not unshare with someone"
+			}
+			_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharee=? AND shareepath=?", member, sh.shareepath)
+		} else if g.perm != sh.perm || g.group != sh.group || g.expires != sh.expires {
+			_, err = o.tx.Exec("UPDATE sharedata SET perm=?, grp=?, expires=? WHERE sharee=? AND shareepath=?", g.perm, g.group, g.expires, member, sh.shareepath)
+		}
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+
+	shared, err := filepath.Abs("./userfs/" + member + "/Shared_with_me")
+	if err != nil {
+		return "Error finding path..."
+	}
+	for _, key := range order {
+		g, ok := want[key]
+		if !ok {
+			continue
+		}
+		fi, err := os.Lstat(g.origpath)
+		if err != nil {
+			continue
+		}
+		// shared directories are linked to directly, files by what the sharer's link points at
+		target := g.origpath
+		if !fi.IsDir() {
+			target, err = os.Readlink(g.origpath)
+			if err != nil {
+				continue
+			}
+		}
+		shareepath := filepath.Join(shared, freeShareeName(shared, filepath.Base(g.origpath)))
+		err = o.symlink(target, shareepath)
+		if err != nil {
+			return "Could not share with someone"
+		}
+		_, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, grp, expires) values(?,?,?,?,?,?,?)", g.sharer, member, g.origpath, shareepath, g.perm, g.group, g.expires)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+	return ""
+}
+
+// Works out again what every one of the given users gets through their groups, as part of o.
+func syncMembers(o *op, members []string) string {
+	for _, member := range members {
+		ret := syncGroupShares(o, member)
+		if ret != "" {
+			return ret
+		}
+	}
+	return ""
+}
+
+// Takes in the name of a new group, a username and a cookie and makes the group, with the user as
+// its owner and only member. Returns a string with an error if need be.
+func groupCreateHandler(name string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if !groupName.MatchString(name) {
+		return "Group names can only have letters, digits, - and _ in them"
+	}
+	if groupOwner(db, name) != "" {
+		return "That group already exists!"
+	}
+	o := beginOp()
+	_, err := o.tx.Exec("INSERT INTO groupdata(name, owner) values(?,?)", name, username)
+	if err == nil {
+		_, err = o.tx.Exec("INSERT INTO groupmembers(groupname, member) values(?,?)", name, username)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	if o.commit() != nil {
+		return "Couldn't make the group :("
+	}
+	return ""
+}
+
+// Takes in the name of a group the user owns, a username and a cookie and deletes the group,
+// taking away everything that was shared with it from its members.
+func groupDeleteHandler(name string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if groupOwner(db, name) != username {
+		return "You don't have a group called that!"
+	}
+	o := beginOp()
+	members := groupMembers(o.tx, name)
+	_, err := o.tx.Exec("DELETE FROM sharedata WHERE sharee=?", "@"+name)
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM trashshares WHERE sharee=?", "@"+name)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM invitedata WHERE grp=?", name)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM groupmembers WHERE groupname=?", name)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM groupdata WHERE name=?", name)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	ret := syncMembers(o, members)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't delete the group :("
+	}
+	return ""
+}
+
+// Takes in the name of a group the user owns, the user to add to it, a username and a cookie and
+// invites them to join it. Users who accept everything from the user are added straight away,
+// getting everything shared with the group.
+func groupAddHandler(name string, member string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if groupOwner(db, name) != username {
+		return "You don't have a group called that!"
+	}
+	if !checkUser(member) {
+		return "The user you're trying to add doesn't exist!\n"
+	}
+	if inGroup(db, name, member) {
+		return "They are already in that group!"
+	}
+	var found int
+	err := db.QueryRow("SELECT count(1) FROM invitedata WHERE grp=? AND sharee=?", name, member).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if found > 0 {
+		return "They were already invited to that group!"
+	}
+	if !autoAccepts(member, username) {
+		_, err = db.Exec("INSERT INTO invitedata(sharer, sharee, origpath, perm, expires, sent, grp) values(?,?,'',0,0,?,?)", username, member, time.Now().Unix(), name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+			os.Exit(1)
+		}
+		return ""
+	}
+	o := beginOp()
+	ret := joinGroup(o, name, member)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't add them :("
+	}
+	return ""
+}
+
+// Makes member a member of the group name, as part of o, giving them everything shared with it.
+func joinGroup(o *op, name string, member string) string {
+	_, err := o.tx.Exec("INSERT INTO groupmembers(groupname, member) values(?,?)", name, member)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	return syncGroupShares(o, member)
+}
+
+// Takes in the name of a group, the member to remove from it, a username and a cookie and
+// removes them, taking away what they only had through the group. Owners can remove anyone from
+// their groups, and members can remove themselves. Removing someone who was only invited takes
+// the invitation back.
+func groupRemoveHandler(name string, member string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if groupOwner(db, name) != username && member != username {
+		return "You don't have a group called that!"
+	}
+	if !inGroup(db, name, member) {
+		res, err := db.Exec("DELETE FROM invitedata WHERE grp=? AND sharee=?", name, member)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+			os.Exit(1)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return "They aren't in that group!"
+		}
+		return ""
+	}
+	o := beginOp()
+	_, err := o.tx.Exec("DELETE FROM groupmembers WHERE groupname=? AND member=?", name, member)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	ret := syncGroupShares(o, member)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't remove them :("
+	}
+	return ""
+}
+
+// Takes in a username and a cookie and returns every group the user owns or is in.
+func groupsHandler(username string, cookie string) internal.GroupsReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.GroupsReturn{Err: "reauth"}
+	}
+	rows, err := db.Query("SELECT name, owner FROM groupdata WHERE owner=? OR name IN (SELECT groupname FROM groupmembers WHERE member=?) ORDER BY name", username, username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var ret internal.GroupsReturn
+	for rows.Next() {
+		var g internal.GroupEnt
+		err = rows.Scan(&g.Name, &g.Owner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		ret.Groups = append(ret.Groups, g)
+	}
+	rows.Close()
+	for i := range ret.Groups {
+		ret.Groups[i].Members = groupMembers(db, ret.Groups[i].Name)
+		ret.Groups[i].Invited = groupInvited(db, ret.Groups[i].Name)
+	}
+	return ret
+}
+
+// Returns who has been invited to join the group with the given name but hasn't accepted or
+// declined yet, sorted by name.
+func groupInvited(q querier, name string) []string {
+	rows, err := q.Query("SELECT sharee FROM invitedata WHERE grp=? ORDER BY sharee", name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	var invited []string
+	for rows.Next() {
+		var sharee string
+		err = rows.Scan(&sharee)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		invited = append(invited, sharee)
+	}
+	return invited
+}
+
+// Does the work of shareHandler for a share of the file or directory at path, relative to the
+// server, with the group name, which expires at expires unless that is 0. The user has to be in
+// the group.
+func shareWithGroup(path string, name string, perm int, expires int64, username string) string {
+	if !inGroup(db, name, username) {
+		return "You aren't in a group called that!"
+	}
+	fullpath, err := filepath.Abs(path)
+	if err != nil {
+		return "Oops, abs failed!"
+	}
+	fi, err := os.Lstat(fullpath)
+	if err != nil {
+		return "That resource doesn't exist!\n"
+	}
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return "Oops, abs failed!"
+	}
+	shared := filepath.Join(root, "Shared_with_me")
+	if fullpath == shared || strings.HasPrefix(fullpath, shared+"/") {
+		return "Dude, you don't own this!"
+	}
+	if fullpath == root {
+		return "You can't share your whole directory!\n"
+	}
+	if !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+		return "There seems to have been an issue"
+	}
+
+	o := beginOp()
+	var found int
+	err = o.tx.QueryRow("SELECT count(1) FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", username, "@"+name, fullpath).Scan(&found)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	if found > 0 {
+		o.rollback()
+		return "You already shared this with this group! If you want to change permissions, use chperm.\n"
+	}
+	_, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires) values(?,?,?,?,?,?)", username, "@"+name, fullpath, "", perm, expires)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	ret := syncMembers(o, groupMembers(o.tx, name))
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Could not share!"
+	}
+	return ""
+}
+
+// Does the work of unshareHandler and chpermHandler for a share with the group name of the file
+// or directory at path, relative to the server: with perm below zero the share is taken away,
+// and otherwise its permissions are changed to perm.
+func updateGroupShare(path string, name string, perm int, username string) string {
+	fullpath, err := filepath.Abs(path)
+	if err != nil {
+		return "Oops, abs failed!"
+	}
+	o := beginOp()
+	var res sql.Result
+	if perm < 0 {
+		res, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", username, "@"+name, fullpath)
+	} else {
+		res, err = o.tx.Exec("UPDATE sharedata SET perm=? WHERE sharer=? AND sharee=? AND origpath=?", perm, username, "@"+name, fullpath)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		o.rollback()
+		return "You have not shared this file with that group.\n"
+	}
+	ret := syncMembers(o, groupMembers(o.tx, name))
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Could not update the share!"
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// test that users only join a group once they accept an invitation to, unless they accept
+// everything from its owner, that members get what is shared with it, including members added
+// later, that members who leave lose it, that a share made with a member directly outlives the
+// group, and that only the owner can change who is in it
+func TestGroups(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me")()
+	ann, bob, cat := addTestUser(t, "ann"), addTestUser(t, "bob"), addTestUser(t, "cat")
+	has := func(when, path string, want bool) {
+		_, err := os.Lstat(path)
+		if (err == nil) != want {
+			t.Fatalf("%v: %v is there: %v; want %v", when, path, err == nil, want)
+		}
+	}
+	if ret := uploadHandler("userfs/ann/a", "ann", []byte("hello"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+
+	if ret := groupCreateHandler("no spaces", "ann", ann); ret == "" {
+		t.Fatalf("making a group with a space in its name: got no error")
+	}
+	if ret := groupCreateHandler("team", "ann", ann); ret != "" {
+		t.Fatalf("groupCreateHandler: %v", ret)
+	}
+	if ret := groupCreateHandler("team", "bob", bob); ret == "" {
+		t.Fatalf("making a group that exists already: got no error")
+	}
+	if ret := groupAddHandler("team", "bob", "ann", ann); ret != "" {
+		t.Fatalf("adding bob: %v", ret)
+	}
+	if ret := groupAddHandler("team", "bob", "ann", ann); ret == "" {
+		t.Fatalf("inviting bob twice: got no error")
+	}
+	groups := groupsHandler("ann", ann)
+	if groups.Err != "" || len(groups.Groups) != 1 || len(groups.Groups[0].Members) != 1 || len(groups.Groups[0].Invited) != 1 {
+		t.Fatalf("groupsHandler before bob accepted: got %+v; want bob invited and not a member", groups)
+	}
+	invites := invitesHandler("bob", bob)
+	if invites.Err != "" || len(invites.Invites) != 1 || invites.Invites[0].Group != "team" {
+		t.Fatalf("invitesHandler: got %+v; want an invitation to join team", invites)
+	}
+	if ret := acceptHandler(invites.Invites[0].ID, "", "bob", bob); ret != "" {
+		t.Fatalf("bob accepting: %v", ret)
+	}
+	if ret := groupAddHandler("team", "cat", "bob", bob); ret == "" {
+		t.Fatalf("bob adding to ann's group: got no error")
+	}
+	if ret := shareHandler("userfs/ann/a", "@team", "r", "ann", ann); ret != "" {
+		t.Fatalf("sharing with @team: %v", ret)
+	}
+	has("after sharing with the group", "userfs/bob/Shared_with_me/a", true)
+	if ret := shareHandler("userfs/ann/a", "@nobody", "r", "ann", ann); ret == "" {
+		t.Fatalf("sharing with a group that doesn't exist: got no error")
+	}
+
+	if ret := groupAddHandler("team", "cat", "ann", ann); ret != "" {
+		t.Fatalf("inviting cat: %v", ret)
+	}
+	if ret := groupRemoveHandler("team", "cat", "ann", ann); ret != "" {
+		t.Fatalf("taking back the invitation to cat: %v", ret)
+	}
+	if invites := invitesHandler("cat", cat); len(invites.Invites) != 0 {
+		t.Fatalf("invitesHandler after the invitation was taken back: got %+v; want none", invites)
+	}
+	// cat accepts everything from ann, so joins straight away
+	autoAcceptFrom(t, "ann", "cat")
+	if ret := groupAddHandler("team", "cat", "ann", ann); ret != "" {
+		t.Fatalf("adding cat: %v", ret)
+	}
+	if got := downloadHandler("userfs/cat/Shared_with_me/a", "cat", cat); got.Err != "" || string(got.Body) != "hello" {
+		t.Fatalf("cat downloading after joining: got %q, %v; want %q", got.Body, got.Err, "hello")
+	}
+	groups = groupsHandler("cat", cat)
+	if groups.Err != "" || len(groups.Groups) != 1 || groups.Groups[0].Owner != "ann" || len(groups.Groups[0].Members) != 3 {
+		t.Fatalf("groupsHandler: got %+v; want team with its three members", groups)
+	}
+	if ret := groupRemoveHandler("team", "cat", "cat", cat); ret != "" {
+		t.Fatalf("cat leaving: %v", ret)
+	}
+	has("after cat left", "userfs/cat/Shared_with_me/a", false)
+
+	// bob keeps what is shared with them directly, with the permissions given then, without having
+	// to accept it again
+	if ret := shareHandler("userfs/ann/a", "bob", "rw", "ann", ann); ret != "" {
+		t.Fatalf("sharing with bob directly: %v", ret)
+	}
+	if ret := groupDeleteHandler("team", "bob", bob); ret == "" {
+		t.Fatalf("bob deleting ann's group: got no error")
+	}
+	if ret := groupDeleteHandler("team", "ann", ann); ret != "" {
+		t.Fatalf("groupDeleteHandler: %v", ret)
+	}
+	if ret := uploadHandler("userfs/bob/Shared_with_me/a", "bob", []byte("bye"), bob); ret != "" {
+		t.Fatalf("bob writing after the group is gone: %v", ret)
+	}
+	var shares int
+	err := db.QueryRow("SELECT count(1) FROM sharedata WHERE grp!='' OR sharee LIKE '@%'").Scan(&shares)
+	if err != nil || shares != 0 {
+		t.Fatalf("after deleting the group: %v group shares left, %v; want none", shares, err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Owners can hand a file of theirs over to another user, making it theirs instead. Nothing
+// changes hands until the other user accepts, so offering a file sends them an invitation, kept in
+// invitedata with transfer set, which they accept or decline like an invitation to share, except
+// that it is never accepted for them without asking. Accepting it moves the file into their own
+// directory, charged to their quota, along with everything that refers to it: its versions, its
+// public links, its shares and invitations to share it, so everyone it was shared with keeps it.
+// Shares with groups the new owner isn't in are dropped, and the new owner's own share of the file
+// goes, since they don't need it any more; whatever they had shared onward of it becomes shared
+// by them directly.
+//
+// The old owner is left with nothing of it, and what had it only through a directory the file was
+// in, re-shares made through a share of that directory included, loses it.
+
+// Takes in a path relative to the server, the user to hand it over to, a username and a cookie
+// and offers the file at path to that user.
+func transferHandler(path string, recipient string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	fullpath, ret := transferPath(path, recipient, username)
+	if ret != "" {
+		return ret
+	}
+	fi, err := os.Lstat(fullpath)
+	if err != nil {
+		return "That resource doesn't exist!\n"
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "Only files can be transferred"
+	}
+
+	var found int
+	err = db.QueryRow("SELECT count(1) FROM invitedata WHERE sharer=? AND sharee=? AND origpath=? AND transfer=1", username, recipient, fullpath).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if found > 0 {
+		return "You already offered this to them!"
+	}
+	_, err = db.Exec("INSERT INTO invitedata(sharer, sharee, origpath, perm, expires, sent, transfer) values(?,?,?,0,0,?,1)", username, recipient, fullpath, time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return ""
+}
+
+// Takes in a path relative to the server, the user it was offered to, a username and a cookie and
+// takes back the offer of the file at path, if they haven't accepted it yet.
+func transferCancelHandler(path string, recipient string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	fullpath, ret := transferPath(path, recipient, username)
+	if ret != "" {
+		return ret
+	}
+	res, err := db.Exec("DELETE FROM invitedata WHERE sharer=? AND sharee=? AND origpath=? AND transfer=1", username, recipient, fullpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "You haven't offered this to them!"
+	}
+	return ""
+}
+
+// Checks the path, relative to the server, and the recipient given to transferHandler or
+// transferCancelHandler, and returns the absolute path, or a message saying what is wrong.
+func transferPath(path string, recipient string, username string) (string, string) {
+	if !checkpath(path, username) {
+		return "", "You can't go outside of your directory!\n"
+	}
+	if recipient == username {
+		return "", "It's yours already, silly!"
+	}
+	if !checkUser(recipient) {
+		return "", "That user doesn't exist!\n"
+	}
+	fullpath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err.Error()
+	}
+	shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	if err != nil {
+		return "", "Error finding path..."
+	}
+	if fullpath == shared || strings.HasPrefix(fullpath, shared+"/") {
+		return "", "Dude, you don't own this!"
+	}
+	return fullpath, ""
+}
+
+// Hands owner's file at the absolute path origpath over to recipient as part of o, putting it in
+// their directory under name, or under its own name if that is "".
+func handover(o *op, owner string, recipient string, origpath string, name string) string {
+	fi, err := os.Lstat(origpath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return "What you were offered is gone"
+	}
+	root, err := filepath.Abs("./userfs/" + recipient)
+	if err != nil {
+		return "Error finding path..."
+	}
+	if name == "" {
+		name = freeShareeName(root, filepath.Base(origpath))
+	} else if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+		return "Something in your directory is already called that!"
+	}
+	dest := filepath.Join(root, name)
+	versions := versionsSize(o.tx, owner, origpath)
+	ret := checkQuota(o.tx, recipient, dest, linkSize(o.tx, origpath)+versions)
+	if ret != "" {
+		return ret
+	}
+	err = o.rename(origpath, dest)
+	if err != nil {
+		return "Couldn't take it over :("
+	}
+
+	// the new owner's own share of it, through a group or not, goes
+	var shareepaths []string
+	rows, err := o.tx.Query("SELECT shareepath FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", owner, recipient, origpath)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	for rows.Next() {
+		var shareepath string
+		err = rows.Scan(&shareepath)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		shareepaths = append(shareepaths, shareepath)
+	}
+	rows.Close()
+	for _, shareepath := range shareepaths {
+		err = o.removeLink(shareepath)
+		if err != nil && !os.IsNotExist(err) {
+			return "Could not remove your share of it"
+		}
+	}
+
+	_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", owner, recipient, origpath)
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM invitedata WHERE sharer=? AND origpath=? AND (sharee=? OR transfer=1)", owner, origpath, recipient)
+	}
+	// what the new owner shared onward is now shared by them directly
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE sharedata SET parent='', parentpath='' WHERE sharer=? AND origpath=? AND parent=?", owner, origpath, recipient)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE invitedata SET parent='', parentpath='' WHERE sharer=? AND origpath=? AND parent=?", owner, origpath, recipient)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE sharedata SET sharer=?, origpath=? WHERE sharer=? AND origpath=?", recipient, dest, owner, origpath)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE sharedata SET parentpath=? WHERE sharer=? AND parentpath=? AND parent!=''", dest, recipient, origpath)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE invitedata SET sharer=?, origpath=? WHERE sharer=? AND origpath=?", recipient, dest, owner, origpath)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE invitedata SET parentpath=? WHERE sharer=? AND parentpath=? AND parent!=''", dest, recipient, origpath)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE versiondata SET owner=?, path=? WHERE owner=? AND path=?", recipient, dest, owner, origpath)
+	}
+	if err == nil {
+		charge(o, owner, -versions)
+		charge(o, recipient, versions)
+	}
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE linkdata SET owner=?, path=? WHERE owner=? AND path=?", recipient, dest, owner, origpath)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+
+	// only members can share with a group, so shares with groups the new owner isn't in go
+	var groups []string
+	rows, err = o.tx.Query("SELECT sharee FROM sharedata WHERE sharer=? AND origpath=? AND sharee GLOB '@*'", recipient, dest)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	for rows.Next() {
+		var sharee string
+		err = rows.Scan(&sharee)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		groups = append(groups, sharee[1:])
+	}
+	rows.Close()
+	for _, name := range groups {
+		if !inGroup(o.tx, name, recipient) {
+			_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", recipient, "@"+name, dest)
+			if err != nil {
+				o.fatal("could not update database", err)
+			}
+		}
+		ret = syncMembers(o, groupMembers(o.tx, name))
+		if ret != "" {
+			return ret
+		}
+	}
+
+	ret = pruneReshares(o, owner)
+	if ret == "" {
+		ret = pruneReshares(o, recipient)
+	}
+	return ret
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+)
+
+// test that a file handed over moves to the new owner only once they accept, charged to them along
+// with its versions, and that its shares, links and versions go with it
+func TestHandover(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me")()
+	defer setVersions(3)()
+	ann, bob, cat := addTestUser(t, "ann"), addTestUser(t, "bob"), addTestUser(t, "cat")
+	autoAcceptFrom(t, "ann", "bob", "cat")
+	for _, body := range []string{"hello", "hello world"} {
+		if ret := uploadHandler("userfs/ann/a", "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploadHandler: %v", ret)
+		}
+	}
+	for _, sharee := range []string{"bob", "cat"} {
+		if ret := shareHandler("userfs/ann/a", sharee, "r", "ann", ann); ret != "" {
+			t.Fatalf("sharing with %v: %v", sharee, ret)
+		}
+	}
+	link := linkHandler("userfs/ann/a", 0, 0, "", "ann", ann)
+	if link.Err != "" {
+		t.Fatalf("linkHandler: %v", link.Err)
+	}
+
+	if ret := transferHandler("userfs/ann/a", "ann", "ann", ann); ret == "" {
+		t.Fatalf("handing a file over to its owner: got no error")
+	}
+	if ret := transferHandler("userfs/bob/Shared_with_me/a", "cat", "bob", bob); ret == "" {
+		t.Fatalf("bob handing over what is only shared with them: got no error")
+	}
+	if ret := transferHandler("userfs/ann/a", "bob", "ann", ann); ret != "" {
+		t.Fatalf("transferHandler: %v", ret)
+	}
+	// accepting everything from ann doesn't take files over for bob
+	invites := invitesHandler("bob", bob)
+	if invites.Err != "" || len(invites.Invites) != 1 || !invites.Invites[0].Transfer {
+		t.Fatalf("invitesHandler: got %+v; want the offer of a", invites)
+	}
+	_, err := db.Exec("INSERT INTO quotadata(username, quota) values(?,?)", "bob", 10)
+	if err != nil {
+		t.Fatalf("could not set quota: %v", err)
+	}
+	if ret := acceptHandler(invites.Invites[0].ID, "", "bob", bob); ret == "" {
+		t.Fatalf("taking over more than bob's quota allows: got no error")
+	}
+	_, err = db.Exec("UPDATE quotadata SET quota=? WHERE username=?", 100, "bob")
+	if err != nil {
+		t.Fatalf("could not set quota: %v", err)
+	}
+	if ret := acceptHandler(invites.Invites[0].ID, "mine", "bob", bob); ret != "" {
+		t.Fatalf("acceptHandler: %v", ret)
+	}
+
+	hasPath(t, "after handing it over", "userfs/ann/a", false)
+	hasPath(t, "after handing it over", "userfs/bob/Shared_with_me/a", false)
+	if got := downloadHandler("userfs/bob/mine", "bob", bob); got.Err != "" || string(got.Body) != "hello world" {
+		t.Fatalf("bob downloading what they took over: got %q, %v; want %q", got.Body, got.Err, "hello world")
+	}
+	for user, want := range map[string]int64{"ann": 0, "bob": 11 + 5} {
+		if u, err := quotaUsage(db, user); err != nil || u != want {
+			t.Fatalf("%v uses %v, %v; want %v", user, u, err, want)
+		}
+	}
+	if history := historyHandler("userfs/bob/mine", "bob", bob); history.Err != "" || len(history.Versions) != 1 {
+		t.Fatalf("historyHandler: got %+v; want the version ann made", history)
+	}
+	got := statHandler("userfs/cat/Shared_with_me/a", "cat", cat)
+	if got.Err != "" || got.Entry.SharedBy != "bob" || string(downloadHandler("userfs/cat/Shared_with_me/a", "cat", cat).Body) != "hello world" {
+		t.Fatalf("statHandler as cat: got %+v; want it shared by bob now", got)
+	}
+	if links := linksHandler("bob", bob); len(links.Links) != 1 || links.Links[0].Path != "/mine" {
+		t.Fatalf("linksHandler for bob: got %+v; want the link to mine", links)
+	}
+	if links := linksHandler("ann", ann); len(links.Links) != 0 {
+		t.Fatalf("linksHandler for ann: got %+v; want none", links)
+	}
+	if got := linkDownloadHandler(link.Token, "", ""); got.Err != "" || string(got.Body) != "hello world" {
+		t.Fatalf("downloading through the link: got %q, %v; want %q", got.Body, got.Err, "hello world")
+	}
+
+	if ret := uploadHandler("userfs/bob/b", "bob", []byte("b"), bob); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if ret := transferHandler("userfs/bob/b", "ann", "bob", bob); ret != "" {
+		t.Fatalf("transferHandler: %v", ret)
+	}
+	if ret := transferCancelHandler("userfs/bob/b", "ann", "bob", bob); ret != "" {
+		t.Fatalf("transferCancelHandler: %v", ret)
+	}
+	if invites := invitesHandler("ann", ann); len(invites.Invites) != 0 {
+		t.Fatalf("invitesHandler after the offer was taken back: got %+v; want none", invites)
+	}
+}
+
+// test that sharees given rws can share onward, and that what they shared onward, and what was
+// shared onward from that in turn, is taken away once their share no longer allows it
+func TestReshare(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me", "userfs/dan/Shared_with_me")()
+	ann, bob, cat, dan := addTestUser(t, "ann"), addTestUser(t, "bob"), addTestUser(t, "cat"), addTestUser(t, "dan")
+	autoAcceptFrom(t, "ann", "bob")
+	autoAcceptFrom(t, "bob", "cat")
+	autoAcceptFrom(t, "cat", "dan")
+	if ret := uploadHandler("userfs/ann/d/f", "ann", []byte("f"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/d", "bob", "rws", "ann", ann); ret != "" {
+		t.Fatalf("sharing with bob: %v", ret)
+	}
+	if ret := shareHandler("userfs/bob/Shared_with_me/d", "ann", "r", "bob", bob); ret == "" {
+		t.Fatalf("bob sharing onward with the owner: got no error")
+	}
+	if ret := shareHandler("userfs/bob/Shared_with_me/d/f", "cat", "rws", "bob", bob); ret != "" {
+		t.Fatalf("bob sharing onward with cat: %v", ret)
+	}
+	if ret := shareHandler("userfs/cat/Shared_with_me/f", "dan", "r", "cat", cat); ret != "" {
+		t.Fatalf("cat sharing onward with dan: %v", ret)
+	}
+	if ret := shareHandler("userfs/dan/Shared_with_me/f", "bob", "r", "dan", dan); ret == "" {
+		t.Fatalf("dan sharing onward without rws: got no error")
+	}
+	if got := downloadHandler("userfs/dan/Shared_with_me/f", "dan", dan); got.Err != "" || string(got.Body) != "f" {
+		t.Fatalf("dan downloading: got %q, %v; want %q", got.Body, got.Err, "f")
+	}
+	shares := sharesHandler("", "cat", "ann", ann)
+	if shares.Err != "" || len(shares.Out) != 1 || shares.Out[0].Via != "bob" || shares.Out[0].Path != "/d/f" {
+		t.Fatalf("sharesHandler for ann: got %+v; want d/f shared with cat through bob", shares)
+	}
+	shares = sharesHandler("", "", "bob", bob)
+	if shares.Err != "" || len(shares.Out) != 1 || shares.Out[0].Path != "/Shared_with_me/d/f" {
+		t.Fatalf("sharesHandler for bob: got %+v; want what bob shared onward in Shared_with_me", shares)
+	}
+
+	// bob keeps d, but can't share it onward any more
+	if ret := chpermHandler("userfs/ann/d", "bob", "rw", "ann", ann); ret != "Permissions updated" {
+		t.Fatalf("chpermHandler: %v", ret)
+	}
+	hasPath(t, "after bob lost rws", "userfs/cat/Shared_with_me/f", false)
+	hasPath(t, "after bob lost rws", "userfs/dan/Shared_with_me/f", false)
+	if got := downloadHandler("userfs/bob/Shared_with_me/d/f", "bob", bob); got.Err != "" {
+		t.Fatalf("bob downloading after losing rws: %v", got.Err)
+	}
+	var left int
+	err := db.QueryRow("SELECT count(1) FROM sharedata WHERE parent!=''").Scan(&left)
+	if err != nil || left != 0 {
+		t.Fatalf("re-shares left after bob lost rws: %v, %v; want none", left, err)
+	}
+}
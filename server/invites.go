@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// Sharing something with a user doesn't put it in their Shared_with_me straight away, but sends
+// them an invitation, kept in invitedata, which they can accept, under a name of their choosing
+// if they like, or decline. Only once it is accepted is there a share in sharedata. Users can
+// choose to accept everything from some users without being asked, in which case shares from
+// them are made straight away as before; autoaccept holds who each user accepts from. Shares
+// with groups don't need accepting, since members are given whatever the group is given and
+// had to accept joining it.
+//
+// Invitations follow what they are for when the sharer moves it, are dropped when it goes to the
+// trash, and run out when the share they are for would have expired. Invitations to re-shares come
+// from whoever is sharing onward, so it is them who have to be accepted from, and they record the
+// share they are made through like the re-share itself does. Offers to take over a file, made
+// with transfer, are invitations too, but are never accepted without asking. So are invitations
+// to join a group, which have the group's name in grp and no origpath.
+
+// Returns whether username accepts shares from sharer without being asked.
+func autoAccepts(username string, sharer string) bool {
+	var found int
+	err := db.QueryRow("SELECT count(1) FROM autoaccept WHERE username=? AND sharer=?", username, sharer).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return found > 0
+}
+
+// Does the work of shareHandler when sharee has to accept the share first: invites them to share
+// sharer's file or directory at the absolute path fullpath with perm, until expires unless that is
+// 0. If parent isn't "" it is a re-share by parent, through their share of what is at parentpath.
+func inviteUser(fullpath string, sharee string, perm int, expires int64, sharer string, parent string, parentpath string) string {
+	fi, err := os.Lstat(fullpath)
+	if err != nil {
+		return "This is not a file or we could not locate it!\n"
+	}
+	root, err := filepath.Abs("./userfs/" + sharer)
+	if err != nil {
+		return "Oops, abs failed!"
+	}
+	if fullpath == root {
+		return "You can't share your whole directory!\n"
+	}
+	if !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+		return "There seems to have been an issue"
+	}
+
+	var found int
+	err = db.QueryRow("SELECT count(1) FROM invitedata WHERE sharer=? AND sharee=? AND origpath=? AND transfer=0", sharer, sharee, fullpath).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if found > 0 {
+		return "This user was already invited to share this! If you want to change permissions, use chperm.\n"
+	}
+	_, err = db.Exec("INSERT INTO invitedata(sharer, sharee, origpath, perm, expires, sent, parent, parentpath) values(?,?,?,?,?,?,?,?)", sharer, sharee, fullpath, perm, expires, time.Now().Unix(), parent, parentpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return ""
+}
+
+// Makes the invitations username has sent for anything at or under from be for where it is now
+// that it has been moved to to, as part of o.
+func moveInvites(o *op, username string, from string, to string) {
+	_, err := o.tx.Exec("UPDATE invitedata SET origpath=? || substr(origpath, ?) WHERE sharer=? AND (origpath=? OR origpath GLOB ?)", to, utf8.RuneCountInString(from)+1, username, from, underPath(from))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Deletes the invitations username has sent for anything at or under path, as part of o.
+func dropInvites(o *op, username string, path string) {
+	_, err := o.tx.Exec("DELETE FROM invitedata WHERE sharer=? AND (origpath=? OR origpath GLOB ?)", username, path, underPath(path))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Takes in a username and a cookie and returns the invitations the user hasn't accepted or
+// declined yet, offers to take over files and invitations to join groups included.
+func invitesHandler(username string, cookie string) internal.InvitesReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.InvitesReturn{Err: "reauth"}
+	}
+	rows, err := db.Query("SELECT id, sharer, origpath, perm, expires, sent, parent, transfer, grp FROM invitedata WHERE sharee=? AND (expires=0 OR expires>?) ORDER BY id", username, time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	var ret internal.InvitesReturn
+	for rows.Next() {
+		var e internal.InviteEnt
+		var origpath, parent string
+		var perm int
+		err = rows.Scan(&e.ID, &e.Sharer, &origpath, &perm, &e.Expires, &e.Sent, &parent, &e.Transfer, &e.Group)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		if parent != "" {
+			e.Owner, e.Sharer = e.Sharer, parent
+		}
+		if e.Group != "" {
+			ret.Invites = append(ret.Invites, e)
+			continue
+		}
+		e.Name = filepath.Base(origpath)
+		e.IsDir = isDir(origpath)
+		e.Perm = permString(perm)
+		ret.Invites = append(ret.Invites, e)
+	}
+	return ret
+}
+
+// Takes in the ID of an invitation, the name to give what it is for in the user's Shared_with_me,
+// or "" for the name the sharer gives it, a username and a cookie and accepts the invitation,
+// making the share it is for. Accepting an offer to take over a file puts the file in the user's
+// own directory under name instead, and accepting an invitation to join a group makes the user a
+// member of it.
+func acceptHandler(id int64, name string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	var sharer, origpath, parent, parentpath, grp string
+	var perm int
+	var expires int64
+	var transfer bool
+	err := db.QueryRow("SELECT sharer, origpath, perm, expires, parent, parentpath, transfer, grp FROM invitedata WHERE id=? AND sharee=?", id, username).Scan(&sharer, &origpath, &perm, &expires, &parent, &parentpath, &transfer, &grp)
+	if err == sql.ErrNoRows {
+		return "You have no such invitation!"
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if expires != 0 && expires <= time.Now().Unix() {
+		return "That invitation has expired"
+	}
+	if name != "" && (name == "." || name == ".." || strings.Contains(name, "/")) {
+		return "That isn't a valid name!"
+	}
+	if grp != "" && name != "" {
+		return "Groups can't be given a name of your own!"
+	}
+
+	o := beginOp()
+	_, err = o.tx.Exec("DELETE FROM invitedata WHERE id=?", id)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	var ret string
+	if grp != "" {
+		ret = joinGroup(o, grp, username)
+	} else if transfer {
+		ret = handover(o, sharer, username, origpath, name)
+	} else {
+		ret = linkShare(o, sharer, username, origpath, name, perm, expires, parent, parentpath)
+	}
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't accept it :("
+	}
+	return ""
+}
+
+// Makes the share of the file or directory at the absolute path origpath by sharer with sharee, as
+// part of o: puts a link to it in sharee's Shared_with_me, called name or, if that is "", what
+// sharer calls it, and records the share in sharedata, as a re-share by parent through their
+// share of parentpath unless parent is "". A share sharee already had through a group becomes one
+// of their own instead.
+func linkShare(o *op, sharer string, sharee string, origpath string, name string, perm int, expires int64, parent string, parentpath string) string {
+	res, err := o.tx.Exec("UPDATE sharedata SET perm=?, grp='', expires=?, parent=?, parentpath=? WHERE sharer=? AND sharee=? AND origpath=? AND grp!=''", perm, expires, parent, parentpath, sharer, sharee, origpath)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return ""
+	}
+
+	fi, err := os.Lstat(origpath)
+	if err != nil {
+		return "What you were invited to share is gone"
+	}
+	// shared directories are linked to directly, files by what the sharer's link points at
+	target := origpath
+	if !fi.IsDir() {
+		target, err = os.Readlink(origpath)
+		if err != nil {
+			return "Something went wrong and we couldn't access the file\n"
+		}
+	}
+	shared, err := filepath.Abs("./userfs/" + sharee + "/Shared_with_me")
+	if err != nil {
+		return "Error finding path..."
+	}
+	if name == "" {
+		name = freeShareeName(shared, filepath.Base(origpath))
+	} else if _, err := os.Lstat(filepath.Join(shared, name)); err == nil {
+		return "Something in your Shared_with_me is already called that!"
+	}
+	shareepath := filepath.Join(shared, name)
+	err = o.symlink(target, shareepath)
+	if err != nil {
+		return "Could not share!"
+	}
+	_, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires, parent, parentpath) values(?,?,?,?,?,?,?,?)", sharer, sharee, origpath, shareepath, perm, expires, parent, parentpath)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	return ""
+}
+
+// Takes in the ID of an invitation, a username and a cookie and declines the invitation.
+func declineHandler(id int64, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	res, err := db.Exec("DELETE FROM invitedata WHERE id=? AND sharee=?", id, username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "You have no such invitation!"
+	}
+	return ""
+}
+
+// Takes in a username and a cookie and returns who the user accepts shares from without being
+// asked, sorted by name.
+func autoAcceptsHandler(username string, cookie string) internal.AutoAcceptReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.AutoAcceptReturn{Err: "reauth"}
+	}
+	rows, err := db.Query("SELECT sharer FROM autoaccept WHERE username=? ORDER BY sharer", username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	var ret internal.AutoAcceptReturn
+	for rows.Next() {
+		var sharer string
+		err = rows.Scan(&sharer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		ret.Users = append(ret.Users, sharer)
+	}
+	return ret
+}
+
+// Takes in another user, whether to accept shares from them without being asked, a username and a
+// cookie and records the user's choice. Accepting from someone also accepts every invitation
+// already waiting from them, to join their groups included, but offers to take over files are
+// always left to the user.
+func autoAcceptSetHandler(sharer string, accept bool, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if !accept {
+		res, err := db.Exec("DELETE FROM autoaccept WHERE username=? AND sharer=?", username, sharer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+			os.Exit(1)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return "You don't accept everything from them anyway"
+		}
+		return ""
+	}
+	if sharer == username {
+		return "You can't share with yourself, silly!"
+	}
+	if !checkUser(sharer) {
+		return "That user doesn't exist!\n"
+	}
+	if autoAccepts(username, sharer) {
+		return "You already accept everything from them"
+	}
+
+	o := beginOp()
+	_, err := o.tx.Exec("INSERT INTO autoaccept(username, sharer) values(?,?)", username, sharer)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	type invite struct {
+		owner, origpath, parentpath, grp string
+		perm                             int
+		expires                          int64
+	}
+	// invitations to re-shares come from whoever is sharing onward
+	from := "sharee=? AND transfer=0 AND (parent=? OR (parent='' AND sharer=?))"
+	rows, err := o.tx.Query("SELECT sharer, origpath, parentpath, grp, perm, expires FROM invitedata WHERE "+from+" AND (expires=0 OR expires>?) ORDER BY id", username, sharer, sharer, time.Now().Unix())
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var invites []invite
+	for rows.Next() {
+		var i invite
+		err = rows.Scan(&i.owner, &i.origpath, &i.parentpath, &i.grp, &i.perm, &i.expires)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		invites = append(invites, i)
+	}
+	rows.Close()
+	for _, i := range invites {
+		if i.grp != "" {
+			ret := joinGroup(o, i.grp, username)
+			if ret != "" {
+				o.rollback()
+				return ret
+			}
+			continue
+		}
+		// what is gone by now can't be shared any more
+		if _, err := os.Lstat(i.origpath); err != nil {
+			continue
+		}
+		parent := ""
+		if i.owner != sharer {
+			parent = sharer
+		}
+		ret := linkShare(o, i.owner, username, i.origpath, "", i.perm, i.expires, parent, i.parentpath)
+		if ret != "" {
+			o.rollback()
+			return ret
+		}
+	}
+	_, err = o.tx.Exec("DELETE FROM invitedata WHERE "+from, username, sharer, sharer)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	if o.commit() != nil {
+		return "Couldn't accept them :("
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Makes each of users accept everything sharer shares with them without being asked.
+func autoAcceptFrom(t *testing.T, sharer string, users ...string) {
+	for _, u := range users {
+		if ret := autoAcceptSetHandler(sharer, true, u, "cookie-"+u); ret != "" {
+			t.Fatalf("%v accepting everything from %v: %v", u, sharer, ret)
+		}
+	}
+}
+
+// test that sharing with a user only invites them until they accept, under a name of their own if
+// they like, that declined and expired invitations give nothing, that invitations follow what they
+// are for when it is moved and are dropped when it goes to the trash, and that accepting
+// everything from someone accepts what is already waiting from them
+func TestInvites(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if ret := uploadHandler("userfs/ann/"+name, "ann", []byte(name), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", name, ret)
+		}
+	}
+	for _, name := range []string{"a", "b", "c", "e"} {
+		if ret := shareHandler("userfs/ann/"+name, "bob", "r", "ann", ann); ret != "" {
+			t.Fatalf("sharing %v: %v", name, ret)
+		}
+	}
+	if ret := shareUntilHandler("userfs/ann/d", "bob", "rw", 3600, "ann", ann); ret != "" {
+		t.Fatalf("sharing d: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/a", "bob", "r", "ann", ann); ret == "" {
+		t.Fatalf("inviting bob to the same file twice: got no error")
+	}
+	hasPath(t, "before accepting", "userfs/bob/Shared_with_me/a", false)
+	if shares := sharesHandler("userfs/ann/a", "", "ann", ann); len(shares.Out) != 1 || !shares.Out[0].Pending {
+		t.Fatalf("sharesHandler: got %+v; want a share of a not accepted yet", shares)
+	}
+	invites := invitesHandler("bob", bob)
+	if invites.Err != "" || len(invites.Invites) != 5 || invites.Invites[0].Name != "a" || invites.Invites[0].Sharer != "ann" {
+		t.Fatalf("invitesHandler: got %+v; want 5 invitations from ann, a first", invites)
+	}
+	id := make(map[string]int64)
+	for _, i := range invites.Invites {
+		id[i.Name] = i.ID
+	}
+
+	if ret := acceptHandler(id["a"], "../x", "bob", bob); ret == "" {
+		t.Fatalf("accepting under a name with a slash: got no error")
+	}
+	if ret := acceptHandler(id["a"], "mine", "bob", bob); ret != "" {
+		t.Fatalf("acceptHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/mine", "bob", bob); got.Err != "" || string(got.Body) != "a" {
+		t.Fatalf("downloading what bob accepted: got %q, %v; want %q", got.Body, got.Err, "a")
+	}
+	if ret := acceptHandler(id["a"], "", "bob", bob); ret == "" {
+		t.Fatalf("accepting the same invitation twice: got no error")
+	}
+	if ret := declineHandler(id["b"], "bob", bob); ret != "" {
+		t.Fatalf("declineHandler: %v", ret)
+	}
+	if ret := acceptHandler(id["b"], "", "bob", bob); ret == "" {
+		t.Fatalf("accepting a declined invitation: got no error")
+	}
+	hasPath(t, "after declining", "userfs/bob/Shared_with_me/b", false)
+
+	_, err := db.Exec("UPDATE invitedata SET expires=? WHERE id=?", time.Now().Unix()-1, id["d"])
+	if err != nil {
+		t.Fatalf("could not make the invitation expire: %v", err)
+	}
+	if ret := acceptHandler(id["d"], "", "bob", bob); ret != "That invitation has expired" {
+		t.Fatalf("accepting an expired invitation: got %q; want it refused", ret)
+	}
+	hasPath(t, "after accepting an expired invitation", "userfs/bob/Shared_with_me/d", false)
+
+	if ret := moveHandler("userfs/ann/c", "userfs/ann/moved", "ann", ann); ret != "" {
+		t.Fatalf("moveHandler: %v", ret)
+	}
+	if ret := removeHandler("userfs/ann/e", "ann", ann); ret != "" {
+		t.Fatalf("removeHandler: %v", ret)
+	}
+	invites = invitesHandler("bob", bob)
+	if len(invites.Invites) != 1 || invites.Invites[0].Name != "moved" {
+		t.Fatalf("invitesHandler after moving c and removing e: got %+v; want moved alone", invites)
+	}
+}
+
+// test that accepting everything from a user accepts what they already sent, that it can only be
+// done for other users who exist, and that taking it back makes their shares invitations again
+func TestAutoAccept(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	for _, name := range []string{"a", "b"} {
+		if ret := uploadHandler("userfs/ann/"+name, "ann", []byte(name), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", name, ret)
+		}
+	}
+	if ret := shareHandler("userfs/ann/a", "bob", "rw", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+
+	for _, sharer := range []string{"bob", "nobody"} {
+		if ret := autoAcceptSetHandler(sharer, true, "bob", bob); ret == "" {
+			t.Fatalf("accepting everything from %v: got no error", sharer)
+		}
+	}
+	if ret := autoAcceptSetHandler("ann", false, "bob", bob); ret == "" {
+		t.Fatalf("no longer accepting from someone never accepted from: got no error")
+	}
+	if ret := autoAcceptSetHandler("ann", true, "bob", bob); ret != "" {
+		t.Fatalf("autoAcceptSetHandler: %v", ret)
+	}
+	if ret := autoAcceptSetHandler("ann", true, "bob", bob); ret == "" {
+		t.Fatalf("accepting everything from ann twice: got no error")
+	}
+	if got := autoAcceptsHandler("bob", bob); got.Err != "" || len(got.Users) != 1 || got.Users[0] != "ann" {
+		t.Fatalf("autoAcceptsHandler: got %+v; want ann", got)
+	}
+	if invites := invitesHandler("bob", bob); len(invites.Invites) != 0 {
+		t.Fatalf("invitesHandler: got %+v; want what was waiting accepted", invites)
+	}
+	if got := statHandler("userfs/bob/Shared_with_me/a", "bob", bob); got.Err != "" || got.Entry.Perm != "rw" {
+		t.Fatalf("statHandler of what was waiting: got %+v; want it shared with rw", got)
+	}
+	if ret := shareHandler("userfs/ann/b", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+	hasPath(t, "after sharing with bob, who accepts everything from ann", "userfs/bob/Shared_with_me/b", true)
+
+	if ret := autoAcceptSetHandler("ann", false, "bob", bob); ret != "" {
+		t.Fatalf("autoAcceptSetHandler: %v", ret)
+	}
+	if ret := unshareHandler("userfs/ann/b", "bob", "ann", ann); ret != "" {
+		t.Fatalf("unshareHandler: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/b", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+	hasPath(t, "after bob stopped accepting everything from ann", "userfs/bob/Shared_with_me/b", false)
+	if invites := invitesHandler("bob", bob); len(invites.Invites) != 1 {
+		t.Fatalf("invitesHandler: got %+v; want b waiting", invites)
+	}
+}
+
+// Fails the test if whether there is something at path isn't want.
+func hasPath(t *testing.T, when string, path string, want bool) {
+	_, err := os.Lstat(path)
+	if (err == nil) != want {
+		t.Fatalf("%v: %v is there: %v; want %v", when, path, err == nil, want)
+	}
+}
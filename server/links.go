@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// Users can make public links to their own files and directories, so that people without an
+// account can download them. A link is a random token, kept in linkdata along with its owner and
+// the absolute path of what it is a link to, and can be given a time it expires, a most number
+// of downloads and a password. Downloading through a link needs only the token, and the password
+// if it has one. A link to a directory gives access to everything under it, as it is at the
+// time, and downloads of any file in it count towards its limit; listing it doesn't.
+//
+// Links follow what they link to when it is moved, into and back out of the trash too, and are
+// deleted when it is removed from the trash for good. Nothing can be downloaded through a link
+// while what it links to is in the trash.
+//
+// Link passwords are hashed by hashPassword, and getting one wrong too often makes the link wait
+// before it takes another guess.
+
+// Returns a new random link token.
+func newLinkToken() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate link token: %v\n", err)
+		os.Exit(1)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Wrong passwords given for each link, so that guessing them is slowed down.
+var failedLinks = make(throttle)
+
+// Makes the links username has to anything at or under from link to where it is now that it has
+// been moved to to, as part of o.
+func moveLinks(o *op, username string, from string, to string) {
+	_, err := o.tx.Exec("UPDATE linkdata SET path=? || substr(path, ?) WHERE owner=? AND (path=? OR path GLOB ?)", to, utf8.RuneCountInString(from)+1, username, from, underPath(from))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Deletes the links username has to anything at or under path, as part of o.
+func dropLinks(o *op, username string, path string) {
+	_, err := o.tx.Exec("DELETE FROM linkdata WHERE owner=? AND (path=? OR path GLOB ?)", username, path, underPath(path))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Takes in a path relative to the server, how many seconds the link should last for, or 0 for
+// ever, how many downloads it allows, or 0 for any number, a password, or "" for none, a username
+// and a cookie and makes a public link to the file or directory at path. Returns its token.
+func linkHandler(path string, ttl int64, maxdownloads int, password string, username string, cookie string) internal.LinkReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.LinkReturn{Err: "reauth"}
+	}
+	if ttl < 0 || maxdownloads < 0 {
+		return internal.LinkReturn{Err: "The expiry time and number of downloads can't be negative"}
+	}
+	if !checkpath(path, username) {
+		return internal.LinkReturn{Err: "You can't go outside of your directory!\n"}
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return internal.LinkReturn{Err: err.Error()}
+	}
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return internal.LinkReturn{Err: "Error finding path..."}
+	}
+	if abspath == root {
+		return internal.LinkReturn{Err: "You can't make a link to your whole directory"}
+	}
+	shared := root + "/Shared_with_me"
+	if abspath == shared || strings.HasPrefix(abspath, shared+"/") {
+		return internal.LinkReturn{Err: "You can only make links to your own files"}
+	}
+	if _, err := os.Lstat(abspath); err != nil {
+		return internal.LinkReturn{Err: "That resource doesn't exist!\n"}
+	}
+
+	var expires int64
+	now := time.Now().Unix()
+	if ttl > 0 {
+		expires = now + ttl
+	}
+	passhash := ""
+	if password != "" {
+		passhash = hashPassword(password)
+	}
+	token := newLinkToken()
+	_, err = db.Exec("INSERT INTO linkdata(token, owner, path, created, expires, maxdownloads, downloads, passhash) VALUES (?,?,?,?,?,?,0,?)", token, username, abspath, now, expires, maxdownloads, passhash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return internal.LinkReturn{Token: token}
+}
+
+// Takes in a username and a cookie and returns the public links the user has made.
+func linksHandler(username string, cookie string) internal.LinksReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.LinksReturn{Err: "reauth"}
+	}
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return internal.LinksReturn{Err: "Error finding path..."}
+	}
+	rows, err := db.Query("SELECT token, path, created, expires, maxdownloads, downloads, passhash FROM linkdata WHERE owner=? ORDER BY created, rowid", username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var ret internal.LinksReturn
+	var paths []string
+	for rows.Next() {
+		var l internal.LinkEnt
+		var path, passhash string
+		err = rows.Scan(&l.Token, &path, &l.Created, &l.Expires, &l.MaxDownloads, &l.Downloads, &passhash)
+		if err != nil {
+			rows.Close()
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		l.Password = passhash != ""
+		ret.Links = append(ret.Links, l)
+		paths = append(paths, path)
+	}
+	rows.Close()
+
+	for i, path := range paths {
+		// links to what is in the trash are listed where it was before it was removed
+		if strings.HasPrefix(path, root+"/") {
+			ret.Links[i].Path = strings.TrimPrefix(path, root)
+		} else {
+			ret.Links[i].Path = trashOrigin(username, path)
+		}
+		ret.Links[i].IsDir = isDir(path)
+	}
+	return ret
+}
+
+// Returns where something in username's trash at path was removed from, relative to their root,
+// or path itself if it isn't in the trash.
+func trashOrigin(username string, path string) string {
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return path
+	}
+	entries, err := trashEntries(db, "owner=? AND (trashpath=? OR ? GLOB trashpath || '/*')", username, path, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		return path
+	}
+	e := entries[0]
+	return strings.TrimPrefix(e.origpath+strings.TrimPrefix(path, e.trashpath), root) + " (in the trash)"
+}
+
+// Returns whether there is a directory at path.
+func isDir(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Takes in the token of one of the user's links, a username and a cookie and deletes the link.
+func linkRevokeHandler(token string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	result, err := db.Exec("DELETE FROM linkdata WHERE token=? AND owner=?", token, username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	if n == 0 {
+		return "You have no such link!"
+	}
+	return ""
+}
+
+// Takes in the token of a public link, its password, or "" if it has none, and the path of
+// something inside the directory it links to, or "" for what it links to itself, and returns the
+// contents of the file there, or what is in the directory there. No session is needed. Every file
+// downloaded counts towards the link's limit, and nothing can be downloaded through it once it
+// has expired or reached the limit.
+func linkDownloadHandler(token string, password string, path string) internal.LinkDownloadReturn {
+	var owner, target, passhash string
+	var expires int64
+	var maxdownloads, downloads int
+	err := db.QueryRow("SELECT owner, path, expires, maxdownloads, downloads, passhash FROM linkdata WHERE token=?", token).Scan(&owner, &target, &expires, &maxdownloads, &downloads, &passhash)
+	if err == sql.ErrNoRows {
+		return internal.LinkDownloadReturn{Err: "There is no such link!"}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if passhash != "" {
+		if !failedLinks.allowed(token) {
+			return internal.LinkDownloadReturn{Err: "That link's password was got wrong too often; try again later"}
+		}
+		if !checkPassword(passhash, password) {
+			failedLinks.failed(token)
+			return internal.LinkDownloadReturn{Err: "That link needs a password, and that isn't it"}
+		}
+		failedLinks.succeeded(token)
+	}
+	if expires != 0 && time.Now().Unix() >= expires {
+		return internal.LinkDownloadReturn{Err: "That link has expired"}
+	}
+	if maxdownloads != 0 && downloads >= maxdownloads {
+		return internal.LinkDownloadReturn{Err: "That link has been used up"}
+	}
+	root, err := filepath.Abs("./userfs/" + owner)
+	if err != nil {
+		return internal.LinkDownloadReturn{Err: "Error finding path..."}
+	}
+	if !strings.HasPrefix(target, root+"/") {
+		return internal.LinkDownloadReturn{Err: "What that link is to has been removed"}
+	}
+
+	// cleaning it as an absolute path keeps it from going above what the link is to
+	abspath := target
+	if path != "" {
+		if !isDir(target) {
+			return internal.LinkDownloadReturn{Err: "That link is to a file"}
+		}
+		abspath = filepath.Join(target, filepath.Clean("/"+path))
+	}
+	fi, err := os.Lstat(abspath)
+	if err != nil {
+		if abspath == target {
+			return internal.LinkDownloadReturn{Err: "What that link is to has been removed"}
+		}
+		return internal.LinkDownloadReturn{Err: "That resource doesn't exist!\n"}
+	}
+
+	if fi.IsDir() {
+		entries, err := ioutil.ReadDir(abspath)
+		if err != nil {
+			return internal.LinkDownloadReturn{Err: err.Error()}
+		}
+		ret := internal.LinkDownloadReturn{IsDir: true}
+		for _, e := range entries {
+			d := internal.DirEnt{IsDir_: e.IsDir(), Name_: e.Name(), ModTime: e.ModTime().Unix()}
+			if e.Mode()&os.ModeSymlink != 0 {
+				d.Size = linkSize(db, filepath.Join(abspath, e.Name()))
+			}
+			ret.Entries = append(ret.Entries, d)
+		}
+		return ret
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return internal.LinkDownloadReturn{Err: "Invalid file :(\n"}
+	}
+	key, err := linkKey(abspath)
+	if err != nil {
+		return internal.LinkDownloadReturn{Err: err.Error()}
+	}
+	body, err := readFile(key)
+	if err != nil {
+		return internal.LinkDownloadReturn{Err: err.Error()}
+	}
+
+	// counted only once the file has been read, and only if the limit still allows it
+	result, err := db.Exec("UPDATE linkdata SET downloads=downloads+1 WHERE token=? AND (maxdownloads=0 OR downloads<maxdownloads)", token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	if n == 0 {
+		return internal.LinkDownloadReturn{Err: "That link has been used up"}
+	}
+	return internal.LinkDownloadReturn{Body: body}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+// test that a link serves what it is to without a session, checks its password and download limit,
+// follows what it is to when it is moved and can't be used while that is in the trash, and that
+// a link to a directory serves what is under it and nothing above it
+func TestLinks(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d/sub")()
+	defer func() { failedLinks = make(throttle) }()
+	ann := addTestUser(t, "ann")
+	for path, body := range map[string]string{"userfs/ann/a": "hello", "userfs/ann/d/sub/b": "inside", "userfs/ann/secret": "secret"} {
+		if ret := uploadHandler(path, "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", path, ret)
+		}
+	}
+
+	link := linkHandler("userfs/ann/a", 0, 2, "sesame", "ann", ann)
+	if link.Err != "" {
+		t.Fatalf("linkHandler: %v", link.Err)
+	}
+	if got := linkDownloadHandler(link.Token, "wrong", ""); got.Err == "" {
+		t.Fatalf("downloading with the wrong password: got no error")
+	}
+	if got := linkDownloadHandler(link.Token, "sesame", ""); got.Err != "" || string(got.Body) != "hello" {
+		t.Fatalf("linkDownloadHandler: got %q, %v; want %q", got.Body, got.Err, "hello")
+	}
+	if ret := moveHandler("userfs/ann/a", "userfs/ann/moved", "ann", ann); ret != "" {
+		t.Fatalf("moveHandler: %v", ret)
+	}
+	if got := linkDownloadHandler(link.Token, "sesame", ""); got.Err != "" || string(got.Body) != "hello" {
+		t.Fatalf("downloading after moving: got %q, %v; want %q", got.Body, got.Err, "hello")
+	}
+	if got := linkDownloadHandler(link.Token, "sesame", ""); got.Err == "" {
+		t.Fatalf("downloading a third time through a link good for 2: got no error")
+	}
+	links := linksHandler("ann", ann)
+	if links.Err != "" || len(links.Links) != 1 || links.Links[0].Path != "/moved" || links.Links[0].Downloads != 2 || !links.Links[0].Password {
+		t.Fatalf("linksHandler: got %+v; want /moved downloaded twice", links)
+	}
+	if stored := storedLinkHash(t, link.Token); !checkPassword(stored, "sesame") || stored == "sesame" {
+		t.Fatalf("passhash of the link: got %q; want a hash of its password", stored)
+	}
+
+	dir := linkHandler("userfs/ann/d", 0, 0, "", "ann", ann)
+	if dir.Err != "" {
+		t.Fatalf("linkHandler: %v", dir.Err)
+	}
+	if got := linkDownloadHandler(dir.Token, "", ""); got.Err != "" || !got.IsDir || len(got.Entries) != 1 || got.Entries[0].Name_ != "sub" {
+		t.Fatalf("listing the linked directory: got %+v; want sub alone", got)
+	}
+	if got := linkDownloadHandler(dir.Token, "", "sub/b"); got.Err != "" || string(got.Body) != "inside" {
+		t.Fatalf("downloading from the linked directory: got %q, %v; want %q", got.Body, got.Err, "inside")
+	}
+	if got := linkDownloadHandler(dir.Token, "", "../secret"); got.Err == "" {
+		t.Fatalf("downloading from above the linked directory: got %q; want an error", got.Body)
+	}
+
+	if ret := removeHandler("userfs/ann/d/sub/b", "ann", ann); ret != "" {
+		t.Fatalf("removeHandler: %v", ret)
+	}
+	inside := linkHandler("userfs/ann/moved", 0, 0, "", "ann", ann)
+	if ret := removeHandler("userfs/ann/moved", "ann", ann); ret != "" {
+		t.Fatalf("removeHandler: %v", ret)
+	}
+	if got := linkDownloadHandler(inside.Token, "", ""); got.Err == "" {
+		t.Fatalf("downloading what is in the trash: got no error")
+	}
+	if ret := emptyTrashHandler("ann", ann); ret != "" {
+		t.Fatalf("emptyTrashHandler: %v", ret)
+	}
+	if got := linkDownloadHandler(inside.Token, "", ""); got.Err != "There is no such link!" {
+		t.Fatalf("downloading after emptying the trash: got %q; want the link gone", got.Err)
+	}
+	if ret := linkRevokeHandler(dir.Token, "ann", ann); ret != "" {
+		t.Fatalf("linkRevokeHandler: %v", ret)
+	}
+	if got := linkDownloadHandler(dir.Token, "", ""); got.Err != "There is no such link!" {
+		t.Fatalf("downloading after revoking: got %q; want the link gone", got.Err)
+	}
+}
+
+// test that a link stops checking passwords for a while once it has been given too many wrong ones
+func TestLinkThrottle(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me")()
+	defer func() { failedLinks = make(throttle) }()
+	ann := addTestUser(t, "ann")
+	if ret := uploadHandler("userfs/ann/a", "ann", []byte("hello"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	link := linkHandler("userfs/ann/a", 0, 0, "sesame", "ann", ann)
+	other := linkHandler("userfs/ann/a", 0, 0, "sesame", "ann", ann)
+	for i := 0; i < maxPasswordFailures; i++ {
+		linkDownloadHandler(link.Token, "wrong", "")
+	}
+	if got := linkDownloadHandler(link.Token, "sesame", ""); got.Err == "" {
+		t.Fatalf("downloading after %v wrong passwords: got no error", maxPasswordFailures)
+	}
+	if got := linkDownloadHandler(other.Token, "sesame", ""); got.Err != "" {
+		t.Fatalf("downloading through another link: %v", got.Err)
+	}
+}
+
+// Returns what linkdata holds for the password of the link with the given token.
+func storedLinkHash(t *testing.T, token string) string {
+	var stored string
+	err := db.QueryRow("SELECT passhash FROM linkdata WHERE token=?", token).Scan(&stored)
+	if err != nil {
+		t.Fatalf("could not read passhash of %v: %v", token, err)
+	}
+	return stored
+}
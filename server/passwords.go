@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Passwords are stored as PBKDF2-HMAC-SHA256 hashes with a random salt of their own. Everything
+// needed to check a password again is kept with its hash, as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>", so the number of iterations new hashes are made
+// with (-password-iterations) can be changed without breaking any password already stored.
+//
+// Older servers stored the unsalted SHA-1 of each user's password instead. Those hashes are still
+// accepted at login, and are replaced with a new one the next time their user logs in, as are
+// hashes made with fewer iterations than the server is set to use.
+//
+// Wrong passwords are throttled: after maxPasswordFailures in a row, every attempt is refused
+// without checking the password until a delay has passed, one second at first and doubling with
+// every further failure up to maxPasswordDelay. Getting the password right clears it. Failures
+// are only counted in memory, so restarting the server forgets them.
+
+const passwordScheme = "pbkdf2-sha256"
+
+const maxPasswordFailures = 5
+const maxPasswordDelay = 15 * time.Minute
+
+// Failed attempts at a password since it was last got right.
+type passwordFailures struct {
+	count int
+	until time.Time // when the next attempt may be made
+}
+
+// Failed attempts at passwords, keyed by what each password is for.
+type throttle map[string]*passwordFailures
+
+// Returns what is stored for password, hashed with a new salt and the number of iterations the
+// server is set to use.
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate salt: %v\n", err)
+		os.Exit(1)
+	}
+	iterations := *passwordIterationsFlag
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not hash password: %v\n", err)
+		os.Exit(1)
+	}
+	return passwordScheme + "$" + strconv.Itoa(iterations) + "$" + base64.RawURLEncoding.EncodeToString(salt) + "$" + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// Returns whether password matches what hashPassword stored for it.
+func checkPassword(stored string, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// Returns whether password matches the unsalted SHA-1 hash an older server stored in userdata.
+func checkOldPassword(stored string, password string) bool {
+	h := sha1.New()
+	h.Write([]byte(password))
+	hash := base64.URLEncoding.EncodeToString(h.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1
+}
+
+// Returns whether a hash stored in userdata should be made again the next time its password is
+// known: it is an old SHA-1 one, or was made with fewer iterations than the server is set to use.
+func needsRehash(stored string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return true
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	return err != nil || iterations < *passwordIterationsFlag
+}
+
+// Returns whether the password for key may be tried now, rather than having to wait after it was
+// got wrong too often.
+func (t throttle) allowed(key string) bool {
+	f := t[key]
+	return f == nil || !time.Now().Before(f.until)
+}
+
+// Records a wrong password for key, making the next attempt wait once it has been got wrong too
+// often in a row.
+func (t throttle) failed(key string) {
+	f := t[key]
+	if f == nil {
+		f = &passwordFailures{}
+		t[key] = f
+	}
+	f.count++
+	if f.count < maxPasswordFailures {
+		return
+	}
+	delay := maxPasswordDelay
+	if shift := f.count - maxPasswordFailures; shift < 10 {
+		delay = time.Second << uint(shift)
+	}
+	if delay > maxPasswordDelay {
+		delay = maxPasswordDelay
+	}
+	f.until = time.Now().Add(delay)
+}
+
+// Forgets the failed attempts at the password for key once it has been got right.
+func (t throttle) succeeded(key string) {
+	delete(t, key)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the unsalted SHA-1 older servers stored for "hunter22"
+const legacyHash = "YLOvi_43NWI8fUpe90m7asGkQTo="
+
+// Sets the iterations new hashes are made with, and returns a function that sets them back.
+func setIterations(n int) func() {
+	old := *passwordIterationsFlag
+	*passwordIterationsFlag = n
+	return func() { *passwordIterationsFlag = old }
+}
+
+// test hashes made by hashPassword
+func TestHashPassword(t *testing.T) {
+	defer setIterations(1000)()
+	stored := hashPassword("hunter22")
+	if !strings.HasPrefix(stored, "pbkdf2-sha256$1000$") {
+		t.Fatalf("hashPassword: got %q; want it to start with %q", stored, "pbkdf2-sha256$1000$")
+	}
+	if !checkPassword(stored, "hunter22") {
+		t.Fatalf("checkPassword(%q, %q): got false; want true", stored, "hunter22")
+	}
+	if checkPassword(stored, "hunter23") {
+		t.Fatalf("checkPassword(%q, %q): got true; want false", stored, "hunter23")
+	}
+	if other := hashPassword("hunter22"); other == stored {
+		t.Fatalf("hashPassword: got %q twice; want a new salt every time", stored)
+	}
+	if needsRehash(stored) {
+		t.Fatalf("needsRehash(%q): got true; want false", stored)
+	}
+
+	// hashes made with more iterations are kept as they are
+	restore := setIterations(500)
+	if needsRehash(stored) {
+		t.Fatalf("needsRehash(%q) after lowering the iterations: got true; want false", stored)
+	}
+	restore()
+
+	// hashes made with fewer iterations still work, but are made again
+	defer setIterations(2000)()
+	if !checkPassword(stored, "hunter22") {
+		t.Fatalf("checkPassword(%q, %q) after raising the iterations: got false; want true", stored, "hunter22")
+	}
+	if !needsRehash(stored) {
+		t.Fatalf("needsRehash(%q) after raising the iterations: got false; want true", stored)
+	}
+
+	// the PBKDF2-HMAC-SHA256 test vector of RFC 7914 for "passwd" and "salt"
+	vector := "pbkdf2-sha256$1$c2FsdA$VawEblbjCJ_sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd-8xfHG4RbHjC9UJESBB06GXgw"
+	if !checkPassword(vector, "passwd") {
+		t.Fatalf("checkPassword(%q, %q): got false; want true", vector, "passwd")
+	}
+
+	for _, bad := range []string{"", "pbkdf2-sha256$", "pbkdf2-sha256$0$c2FsdA$c2FsdA", "pbkdf2-sha256$x$c2FsdA$c2FsdA", "pbkdf2-sha256$1000$!$c2FsdA", "pbkdf2-sha256$1000$c2FsdA$", "c2FsdA:c2FsdA", legacyHash} {
+		if checkPassword(bad, "hunter22") {
+			t.Fatalf("checkPassword(%q, %q): got true; want false", bad, "hunter22")
+		}
+	}
+}
+
+// test SHA-1 hashes stored by older servers
+func TestOldPassword(t *testing.T) {
+	if !checkOldPassword(legacyHash, "hunter22") {
+		t.Fatalf("checkOldPassword(%q, %q): got false; want true", legacyHash, "hunter22")
+	}
+	if checkOldPassword(legacyHash, "hunter23") {
+		t.Fatalf("checkOldPassword(%q, %q): got true; want false", legacyHash, "hunter23")
+	}
+	if !needsRehash(legacyHash) {
+		t.Fatalf("needsRehash(%q): got false; want true", legacyHash)
+	}
+}
+
+// test how long a password has to wait after being got wrong a number of times in a row
+func TestThrottle(t *testing.T) {
+	failures := make(throttle)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{maxPasswordFailures - 1, 0},
+		{maxPasswordFailures, time.Second},
+		{maxPasswordFailures + 3, 8 * time.Second},
+		{maxPasswordFailures + 10, maxPasswordDelay},
+		{maxPasswordFailures + 100, maxPasswordDelay},
+	}
+	for _, tt := range tests {
+		failures.succeeded("a")
+		for i := 0; i < tt.failures; i++ {
+			failures.failed("a")
+		}
+		if tt.want == 0 {
+			if !failures.allowed("a") {
+				t.Fatalf("after %v failures: not allowed; want it allowed", tt.failures)
+			}
+			continue
+		}
+		if got := time.Until(failures["a"].until).Round(time.Second); got != tt.want || failures.allowed("a") {
+			t.Fatalf("delay after %v failures: got %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+	failures.succeeded("a")
+	if !failures.allowed("a") || !failures.allowed("b") {
+		t.Fatalf("after getting it right: not allowed; want it allowed")
+	}
+}
+
+// Returns what userdata holds for username's password.
+func storedHash(t *testing.T, username string) string {
+	var stored string
+	err := db.QueryRow("SELECT passhash FROM userdata WHERE username=?", username).Scan(&stored)
+	if err != nil {
+		t.Fatalf("could not read passhash of %v: %v", username, err)
+	}
+	return stored
+}
+
+// test that logging in upgrades old hashes, and only when the password is right
+func TestLoginUpgradesHash(t *testing.T) {
+	defer setIterations(1000)()
+	defer openTestDB(t)()
+	defer func() { failedLogins = make(throttle) }()
+	_, err := db.Exec("INSERT INTO userdata (username, passhash) VALUES (?, ?)", "alice", legacyHash)
+	if err != nil {
+		t.Fatalf("could not add user: %v", err)
+	}
+
+	if ret := authenticateHandler("alice", "hunter23", ""); ret.Auth {
+		t.Fatalf("authenticateHandler with the wrong password: got Auth true; want false")
+	}
+	if stored := storedHash(t, "alice"); stored != legacyHash {
+		t.Fatalf("passhash after a failed login: got %q; want %q", stored, legacyHash)
+	}
+
+	if ret := authenticateHandler("alice", "hunter22", ""); !ret.Auth {
+		t.Fatalf("authenticateHandler with a SHA-1 hash: got Auth false; want true")
+	}
+	upgraded := storedHash(t, "alice")
+	if !strings.HasPrefix(upgraded, "pbkdf2-sha256$1000$") {
+		t.Fatalf("passhash after logging in: got %q; want a PBKDF2 hash", upgraded)
+	}
+	if ret := authenticateHandler("alice", "hunter22", ""); !ret.Auth {
+		t.Fatalf("authenticateHandler with the upgraded hash: got Auth false; want true")
+	}
+	if stored := storedHash(t, "alice"); stored != upgraded {
+		t.Fatalf("passhash after logging in again: got %q; want it unchanged", stored)
+	}
+
+	// lowering the iterations leaves hashes made with more alone
+	restore := setIterations(500)
+	if ret := authenticateHandler("alice", "hunter22", ""); !ret.Auth {
+		t.Fatalf("authenticateHandler after lowering the iterations: got Auth false; want true")
+	}
+	if stored := storedHash(t, "alice"); stored != upgraded {
+		t.Fatalf("passhash after lowering the iterations: got %q; want it unchanged", stored)
+	}
+	restore()
+
+	// raising the iterations upgrades hashes made with fewer on the next login
+	defer setIterations(2000)()
+	if ret := authenticateHandler("alice", "hunter22", ""); !ret.Auth {
+		t.Fatalf("authenticateHandler after raising the iterations: got Auth false; want true")
+	}
+	if stored := storedHash(t, "alice"); !strings.HasPrefix(stored, "pbkdf2-sha256$2000$") {
+		t.Fatalf("passhash after raising the iterations: got %q; want one made with 2000", stored)
+	}
+}
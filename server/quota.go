@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"../internal"
+)
+
+// Every user is limited in how much they can store. The limit is the one set for them in
+// quotadata if there is one, and otherwise the default kept under "defaultquota" in settings.
+// A limit below zero means there is none, and so does not having any default, which is how a
+// server starts out.
+//
+// A user is charged for the logical size of every file in their tree: a file stored twice is
+// charged twice even though deduplication only keeps it once, since the user can't see that.
+// Files in Shared_with_me are charged to their sharer only, and so are uploads made to them by
+// sharees with write access. Old versions are charged to whoever they are kept under, for their
+// full size. Files in a user's trash are charged to them too until the trash is emptied, or
+// removing files would make room that is never given back.
+//
+// What each user is charged for is kept in usagedata rather than worked out whenever it is
+// needed, which would mean walking their whole tree on every upload. The op makes every link
+// in a user's tree, so it keeps the totals up to date as links are made, removed and moved
+// from one owner to another, in the same transaction. Totals are worked out from the tree itself
+// only for users who don't have one yet, when the server starts, and by fsck.
+
+// Returns the quota of username in bytes, or -1 if they have none.
+func quotaLimit(q querier, username string) int64 {
+	var limit int64
+	err := q.QueryRow("SELECT quota FROM quotadata WHERE username=?", username).Scan(&limit)
+	if err == sql.ErrNoRows {
+		err = q.QueryRow("SELECT value FROM settings WHERE name='defaultquota'").Scan(&limit)
+		if err == sql.ErrNoRows {
+			return -1
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return limit
+}
+
+// Returns the size of the file the link at path points at, or 0 if it isn't one we know of.
+func linkSize(q querier, path string) int64 {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return 0
+	}
+	return targetSize(q, target)
+}
+
+// Returns the size of the file a link with the given target points at, or 0 if it is a link to a
+// directory or to a file we don't know of.
+func targetSize(q querier, target string) int64 {
+	userfs, err := filepath.Abs("./userfs")
+	if err != nil || strings.HasPrefix(target, userfs+"/") {
+		return 0
+	}
+	var size int64
+	err = q.QueryRow("SELECT size FROM filedata WHERE filehash=?", filepath.Base(target)).Scan(&size)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return size
+}
+
+// Returns who is charged for a link at path, or "" if nobody is: links in a user's tree or their
+// trash are charged to them, except for those in their Shared_with_me.
+func chargedTo(path string) string {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	trash, err := filepath.Abs("./trash")
+	if err != nil {
+		return ""
+	}
+	if strings.HasPrefix(abspath, trash+"/") {
+		return strings.SplitN(strings.TrimPrefix(abspath, trash+"/"), "/", 2)[0]
+	}
+	userfs, err := filepath.Abs("./userfs")
+	if err != nil || !strings.HasPrefix(abspath, userfs+"/") {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(abspath, userfs+"/"), "/", 3)
+	if len(parts) > 1 && parts[1] == "Shared_with_me" {
+		return ""
+	}
+	return parts[0]
+}
+
+// Returns the total size of the files linked to at or under path, not counting links to
+// directories.
+func treeSize(q querier, path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			size += linkSize(q, p)
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Adds delta bytes to what username is charged for, as part of o. Nobody is charged if username
+// is "".
+func charge(o *op, username string, delta int64) {
+	if username == "" || delta == 0 {
+		return
+	}
+	res, err := o.tx.Exec("UPDATE usagedata SET used=used+? WHERE username=?", delta, username)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			_, err = o.tx.Exec("INSERT INTO usagedata(username, used) values(?,?)", username, delta)
+		}
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Returns how many bytes username is being charged for.
+func quotaUsage(q querier, username string) (int64, error) {
+	var used int64
+	err := q.QueryRow("SELECT used FROM usagedata WHERE username=?", username).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+// Works out how many bytes username should be charged for from their tree, trash and versions.
+func walkUsage(q querier, username string) (int64, error) {
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return 0, err
+	}
+	shared := filepath.Join(root, "Shared_with_me")
+	var used int64
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == shared {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			used += linkSize(q, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return used, err
+	}
+	trashed, err := treeSize(q, "./trash/"+username)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return used, err
+	}
+	var versions int64
+	err = q.QueryRow("SELECT coalesce(sum(size),0) FROM versiondata WHERE owner=?", username).Scan(&versions)
+	return used + trashed + versions, err
+}
+
+// Works out the usage of every user who doesn't have a total in usagedata yet, such as every
+// user of a server that didn't keep totals.
+func initUsage() {
+	rows, err := db.Query("SELECT username FROM userdata WHERE username NOT IN (SELECT username FROM usagedata)")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var users []string
+	for rows.Next() {
+		var user string
+		err = rows.Scan(&user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	for _, user := range users {
+		used, err := walkUsage(db, user)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "could not work out usage of %v: %v\n", user, err)
+			os.Exit(1)
+		}
+		_, err = db.Exec("INSERT INTO usagedata(username, used) values(?,?)", user, used)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Checks whether username can store a file of the given size at storepath, replacing whatever
+// is there. Returns a message saying why not, or "" if they can.
+func checkQuota(q querier, username string, storepath string, size int64) string {
+	limit := quotaLimit(q, username)
+	if limit < 0 {
+		return ""
+	}
+	used, err := quotaUsage(q, username)
+	if err != nil {
+		return "Couldn't work out how much space is left :("
+	}
+	var replaced int64
+	if _, err := os.Lstat(storepath); err == nil {
+		replaced = replacedSize(q, username, storepath)
+	}
+	if used-replaced+size > limit {
+		ret := fmt.Sprintf("This would exceed the storage quota of %v: %v of %v bytes are in use and the file is %v bytes", username, used, limit, size)
+		var trashed int
+		err = q.QueryRow("SELECT count(1) FROM trashdata WHERE owner=?", username).Scan(&trashed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+			os.Exit(1)
+		}
+		if trashed > 0 {
+			ret += "; what is in the trash counts too until it is emptied"
+		}
+		return ret
+	}
+	return ""
+}
+
+// Takes in a username and a cookie and returns how many bytes the user is using and their quota.
+func quotaHandler(username string, cookie string) internal.QuotaReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.QuotaReturn{Err: "reauth"}
+	}
+	used, err := quotaUsage(db, username)
+	if err != nil {
+		return internal.QuotaReturn{Err: "Couldn't work out your usage :("}
+	}
+	return internal.QuotaReturn{Used: used, Limit: quotaLimit(db, username)}
+}
+
+// Takes in a size such as "500", "20M" or "1G" and returns it in bytes. "none" means no limit.
+func parseSize(s string) (int64, error) {
+	if s == "none" {
+		return -1, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("no size given")
+	}
+	size, mult := s, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return n * mult, nil
+}
+
+func formatLimit(limit int64) string {
+	if limit < 0 {
+		return "none"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// "server quota" shows and sets quotas:
+//
+//	server quota                          lists the default and every user's usage and quota
+//	server quota -default <size>          sets the default quota
+//	server quota <user> <size|default>    sets a user's own quota, or makes them use the default
+func runQuota(args []string) {
+	flags := flag.NewFlagSet("quota", flag.ExitOnError)
+	dflt := flags.String("default", "", "set the default quota, e.g. 500M, 2G or none")
+	flags.Parse(args)
+
+	var err error
+	if *dflt != "" {
+		var limit int64
+		limit, err = parseSize(*dflt)
+		if err == nil {
+			_, err = db.Exec("INSERT OR REPLACE INTO settings(name, value) values('defaultquota', ?)", limit)
+		}
+	}
+	if err == nil && flags.NArg() == 2 {
+		user := flags.Arg(0)
+		if !checkUser(user) {
+			fmt.Fprintf(os.Stderr, "no such user: %v\n", user)
+			os.Exit(1)
+		}
+		if flags.Arg(1) == "default" {
+			_, err = db.Exec("DELETE FROM quotadata WHERE username=?", user)
+		} else {
+			var limit int64
+			limit, err = parseSize(flags.Arg(1))
+			if err == nil {
+				_, err = db.Exec("INSERT OR REPLACE INTO quotadata(username, quota) values(?,?)", user, limit)
+			}
+		}
+	} else if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %v quota [-default <size>] [<user> <size|default>]\n", os.Args[0])
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not set quota: %v\n", err)
+		os.Exit(1)
+	}
+
+	var limit int64 = -1
+	err = db.QueryRow("SELECT value FROM settings WHERE name='defaultquota'").Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("default quota: %v\n", formatLimit(limit))
+
+	rows, err := db.Query("SELECT username FROM userdata ORDER BY username")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var users []string
+	for rows.Next() {
+		var user string
+		err = rows.Scan(&user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	for _, user := range users {
+		used, err := quotaUsage(db, user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not work out usage of %v: %v\n", user, err)
+			continue
+		}
+		fmt.Printf("%-16v %12v used of %v\n", user, used, formatLimit(quotaLimit(db, user)))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// test that sizes are read with their suffix and that ones too large to hold are refused
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"500", 500, true},
+		{"20M", 20 << 20, true},
+		{"1g", 1 << 30, true},
+		{"8T", 8 << 40, true},
+		{"none", -1, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"8589934592G", 0, false},
+		{"", 0, false},
+		{"M", 0, false},
+		{"-1", 0, false},
+		{"12X", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Fatalf("parseSize(%q): got %v, %v; want %v", tt.s, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Fatalf("parseSize(%q): got %v; want an error", tt.s, got)
+		}
+	}
+}
+
+// test that uploads are charged to their owner and refused past the quota, that links in
+// Shared_with_me are charged to nobody, and that the running totals match what initUsage works
+// out from the trees themselves
+func TestQuota(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	// without versions, overwriting a file gives back the room it took up straight away
+	defer setVersions(0)()
+	root, err := filepath.Abs("userfs")
+	if err != nil {
+		t.Fatalf("could not find userfs: %v", err)
+	}
+	for _, user := range []string{"ann", "bob"} {
+		_, err = db.Exec("INSERT INTO userdata(username, passhash) values(?,?)", user, "")
+		if err != nil {
+			t.Fatalf("could not add %v: %v", user, err)
+		}
+	}
+	_, err = db.Exec("INSERT INTO quotadata(username, quota) values(?,?)", "ann", 10)
+	if err != nil {
+		t.Fatalf("could not set quota: %v", err)
+	}
+	usage := func(user string) int64 {
+		used, err := quotaUsage(db, user)
+		if err != nil {
+			t.Fatalf("quotaUsage(%v): %v", user, err)
+		}
+		return used
+	}
+
+	// each upload is committed if it went through and rolled back if it was refused
+	uploads := []struct {
+		path, body string
+		ok         bool
+		used       int64
+	}{
+		{"a", "12345", true, 5},
+		{"b", "123456", false, 5},
+		{"b", "1234", true, 9},
+		{"a", "123456", true, 10},
+		{"c", "1", false, 10},
+	}
+	for _, u := range uploads {
+		o := beginOp()
+		ret := storeFile(o, filepath.Join(root, "ann", u.path), "ann", []byte(u.body))
+		if (ret == "") != u.ok {
+			o.rollback()
+			t.Fatalf("upload of %v bytes to %v: got %q; want it to go through: %v", len(u.body), u.path, ret, u.ok)
+		}
+		if !u.ok {
+			o.rollback()
+		} else if err := o.commit(); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if got := usage("ann"); got != u.used {
+			t.Fatalf("after uploading %v bytes to %v: ann uses %v; want %v", len(u.body), u.path, got, u.used)
+		}
+	}
+
+	o := beginOp()
+	if err := o.symlink(contentKey([]byte("123456")), filepath.Join(root, "bob/Shared_with_me/a")); err != nil {
+		o.rollback()
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got := usage("bob"); got != 0 {
+		t.Fatalf("bob uses %v for a file shared with them; want 0", got)
+	}
+
+	_, err = db.Exec("DELETE FROM usagedata")
+	if err != nil {
+		t.Fatalf("could not clear usage: %v", err)
+	}
+	initUsage()
+	if ann, bob := usage("ann"), usage("bob"); ann != 10 || bob != 0 {
+		t.Fatalf("after initUsage: ann uses %v and bob %v; want 10 and 0", ann, bob)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Creates any of the server's tables that don't exist yet, so that a server can be started
+// from an empty dropbox.db. Existing tables are left untouched.
+func initDB() {
+	tables := []string{
+		"CREATE TABLE IF NOT EXISTS userdata(username TEXT, passhash TEXT)",
+		"CREATE TABLE IF NOT EXISTS filedata(filename TEXT, filehash CHAR[64])",
+		"CREATE TABLE IF NOT EXISTS sharedata(sharer TEXT, sharee TEXT, origpath TEXT, shareepath TEXT, perm INT)",
+		"CREATE TABLE IF NOT EXISTS chunkdata(chunkhash TEXT PRIMARY KEY, size INT, refcount INT)",
+		"CREATE TABLE IF NOT EXISTS filechunks(filehash TEXT, seq INT, chunkhash TEXT)",
+		"CREATE INDEX IF NOT EXISTS filechunks_filehash ON filechunks(filehash, seq)",
+		"CREATE INDEX IF NOT EXISTS filechunks_chunkhash ON filechunks(chunkhash)",
+		"CREATE TABLE IF NOT EXISTS quotadata(username TEXT PRIMARY KEY, quota INT)",
+		"CREATE TABLE IF NOT EXISTS usagedata(username TEXT PRIMARY KEY, used INT)",
+		"CREATE TABLE IF NOT EXISTS settings(name TEXT PRIMARY KEY, value INT)",
+		"CREATE TABLE IF NOT EXISTS versiondata(owner TEXT, path TEXT, version INT, filehash TEXT, size INT, saved INT)",
+		"CREATE INDEX IF NOT EXISTS versiondata_path ON versiondata(owner, path, version)",
+		"CREATE TABLE IF NOT EXISTS trashdata(id INTEGER PRIMARY KEY AUTOINCREMENT, owner TEXT, origpath TEXT, trashpath TEXT, deleted INT)",
+		"CREATE TABLE IF NOT EXISTS trashshares(trashid INT, sharee TEXT, origpath TEXT, shareepath TEXT, perm INT)",
+		"CREATE TABLE IF NOT EXISTS groupdata(name TEXT PRIMARY KEY, owner TEXT)",
+		"CREATE TABLE IF NOT EXISTS groupmembers(groupname TEXT, member TEXT)",
+		"CREATE TABLE IF NOT EXISTS invitedata(id INTEGER PRIMARY KEY AUTOINCREMENT, sharer TEXT, sharee TEXT, origpath TEXT, perm INT, expires INT, sent INT, grp TEXT DEFAULT '')",
+		"CREATE TABLE IF NOT EXISTS autoaccept(username TEXT, sharer TEXT)",
+		"CREATE TABLE IF NOT EXISTS linkdata(token TEXT PRIMARY KEY, owner TEXT, path TEXT, created INT, expires INT, maxdownloads INT, downloads INT, passhash TEXT)",
+		"CREATE TABLE IF NOT EXISTS devicedata(token TEXT PRIMARY KEY, username TEXT, created INT)",
+		"CREATE TABLE IF NOT EXISTS uploaddata(id TEXT PRIMARY KEY, owner TEXT, path TEXT, size INT, received INT, seq INT, touched INT, done INT DEFAULT 0, chargedto TEXT DEFAULT '')",
+	}
+	for _, t := range tables {
+		_, err := db.Exec(t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create table: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	addColumn("filedata", "size", "INT DEFAULT 0")
+	addColumn("sharedata", "grp", "TEXT DEFAULT ''")
+	addColumn("sharedata", "expires", "INT DEFAULT 0")
+	addColumn("trashshares", "expires", "INT DEFAULT 0")
+	addColumn("sharedata", "parent", "TEXT DEFAULT ''")
+	addColumn("sharedata", "parentpath", "TEXT DEFAULT ''")
+	addColumn("trashshares", "parent", "TEXT DEFAULT ''")
+	addColumn("trashshares", "parentpath", "TEXT DEFAULT ''")
+	addColumn("invitedata", "parent", "TEXT DEFAULT ''")
+	addColumn("invitedata", "parentpath", "TEXT DEFAULT ''")
+	addColumn("invitedata", "transfer", "INT DEFAULT 0")
+	addColumn("chunkdata", "codec", "TEXT DEFAULT 'raw'")
+	addColumn("chunkdata", "blobkey", "TEXT")
+	addColumn("chunkdata", "storedsize", "INT")
+	addColumn("chunkdata", "keyid", "TEXT DEFAULT ''")
+	addColumn("chunkdata", "wrappedkey", "BLOB")
+	_, err := db.Exec("UPDATE chunkdata SET blobkey=chunkhash, storedsize=size WHERE blobkey IS NULL")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Returns whether the table has the column, which tables created by older versions of the server
+// may lack or still have.
+func hasColumn(table string, column string) bool {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a column to a table created by an older version of the server, unless it is already there.
+func addColumn(table string, column string, decl string) {
+	if hasColumn(table, column) {
+		return
+	}
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not add column %v to %v: %v\n", column, table, err)
+		os.Exit(1)
+	}
+}
+
+// Blobs used to be named file1, file2, ... after a counter kept in ./filecount.txt. This moves
+// every such blob under its content hash, merges rows which turn out to hold the same content
+// and repoints every symlink under ./userfs at the new key. Rows already keyed by their hash are
+// left alone, so this only does any work the first time a server with old data is started.
+// Each blob is relinked before its row is rewritten and its old file removed, so a crash
+// part way through is picked up again on the next start.
+func migrateFilestore(dir string) {
+	owners := make(map[string]int)
+	var oldnames []string
+	// Blobs named after the counter all date from before files were split into chunks, which
+	// drops numowners, so once it is gone there is nothing left to move
+	if hasColumn("filedata", "numowners") {
+		rows, err := db.Query("SELECT filename, numowners FROM filedata WHERE filename != filehash")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		for rows.Next() {
+			var filename string
+			var numowners int
+			err = rows.Scan(&filename, &numowners)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+				os.Exit(1)
+			}
+			owners[filename] = numowners
+			oldnames = append(oldnames, filename)
+		}
+		rows.Close()
+	}
+
+	if len(oldnames) > 0 {
+		fmt.Fprintf(os.Stderr, "Migrating %v blobs to content addressed names...\n", len(oldnames))
+
+		// Find every link pointing at each of the old blobs
+		links := make(map[string][]string)
+		err := filepath.Walk("./userfs", func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			key, err := linkKey(path)
+			if err != nil {
+				return err
+			}
+			if _, ok := owners[key]; ok {
+				links[key] = append(links[key], path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not walk userfs: %v\n", err)
+			os.Exit(1)
+		}
+
+		for _, oldname := range oldnames {
+			oldpath := filepath.Join(dir, oldname)
+			body, err := ioutil.ReadFile(oldpath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not read blob %v: %v\n", oldname, err)
+				os.Exit(1)
+			}
+			hash := contentKey(body)
+			err = store.Put(hash, body)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not store blob %v: %v\n", hash, err)
+				os.Exit(1)
+			}
+
+			for _, link := range links[oldname] {
+				err = os.Remove(link)
+				if err == nil {
+					err = os.Symlink(hash, link)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "could not relink %v: %v\n", link, err)
+					os.Exit(1)
+				}
+			}
+
+			var found int
+			err = db.QueryRow("SELECT count(1) FROM filedata WHERE filehash=? AND filename=filehash", hash).Scan(&found)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+				os.Exit(1)
+			}
+			if found > 0 {
+				_, err = db.Exec("UPDATE filedata SET numowners=numowners+? WHERE filehash=? AND filename=filehash", owners[oldname], hash)
+				if err == nil {
+					_, err = db.Exec("DELETE FROM filedata WHERE filename=?", oldname)
+				}
+			} else {
+				_, err = db.Exec("UPDATE filedata SET filename=?, filehash=? WHERE filename=?", hash, hash, oldname)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+				os.Exit(1)
+			}
+
+			err = os.Remove(oldpath)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "could not remove old blob %v: %v\n", oldname, err)
+			}
+		}
+	}
+
+	// The counter is no longer needed now that blobs are named after their content
+	err := os.Remove("./filecount.txt")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "could not remove filecount.txt: %v\n", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Puts a new database holding every table in place of db, and returns a function that closes it
+// and puts db back.
+func openTestDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dropbox-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	old := db
+	db, err = sql.Open("sqlite3", filepath.Join(dir, "dropbox.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	initDB()
+	return func() {
+		db.Close()
+		db = old
+		os.RemoveAll(dir)
+	}
+}
+
+// Replaces filedata with the table older versions of the server made, which counted owners of
+// files in numowners.
+func oldFiledata(t *testing.T) {
+	_, err := db.Exec("DROP TABLE filedata")
+	if err == nil {
+		_, err = db.Exec("CREATE TABLE filedata(filename TEXT, filehash CHAR[40], numowners INT, size INT DEFAULT 0)")
+	}
+	if err != nil {
+		t.Fatalf("could not make the old filedata: %v", err)
+	}
+}
+
+// Moves into a new temporary directory holding the directories named, and returns a function
+// that moves back out and removes it.
+func useTempDir(t *testing.T, dirs ...string) func() {
+	dir, err := ioutil.TempDir("", "dropbox-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("could not move into %v: %v", dir, err)
+	}
+	cleanup := func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+	for _, d := range dirs {
+		err = os.MkdirAll(d, 0775)
+		if err != nil {
+			cleanup()
+			t.Fatalf("could not make %v: %v", d, err)
+		}
+	}
+	return cleanup
+}
+
+// test that blobs named after the old counter end up under their content hash, with the links to
+// them repointed and rows holding the same content merged
+func TestMigrateFilestore(t *testing.T) {
+	defer openTestDB(t)()
+	defer useTempDir(t, "userfs/ann/d", "userfs/bob", "filestore")()
+	oldFiledata(t)
+	s, err := newLocalBlobStore("./filestore")
+	if err != nil {
+		t.Fatalf("newLocalBlobStore: %v", err)
+	}
+	old := store
+	store = s
+	defer func() { store = old }()
+
+	// file2 holds the same as a blob already stored under its hash, so the two rows become one
+	same := contentKey([]byte("same"))
+	err = store.Put(same, []byte("same"))
+	for name, body := range map[string]string{"file1": "one", "file2": "same"} {
+		if err == nil {
+			err = ioutil.WriteFile("filestore/"+name, []byte(body), 0664)
+		}
+	}
+	for _, row := range [][]interface{}{{"file1", "oldhash1", 2}, {"file2", "oldhash2", 1}, {same, same, 1}} {
+		if err == nil {
+			_, err = db.Exec("INSERT INTO filedata(filename, filehash, numowners) values(?,?,?)", row...)
+		}
+	}
+	links := map[string]string{"userfs/ann/one": "file1", "userfs/ann/d/one": "file1", "userfs/bob/same": "file2", "userfs/bob/kept": same}
+	for path, target := range links {
+		if err == nil {
+			err = os.Symlink(target, path)
+		}
+	}
+	if err == nil {
+		err = ioutil.WriteFile("filecount.txt", []byte("3\n"), 0664)
+	}
+	if err != nil {
+		t.Fatalf("could not set up old data: %v", err)
+	}
+
+	// running it a second time finds nothing left to do
+	for i := 0; i < 2; i++ {
+		migrateFilestore("./filestore")
+		want := map[string]string{"userfs/ann/one": contentKey([]byte("one")), "userfs/ann/d/one": contentKey([]byte("one")), "userfs/bob/same": same, "userfs/bob/kept": same}
+		for path, key := range want {
+			got, err := linkKey(path)
+			if err != nil || got != key {
+				t.Fatalf("run %v: link %v: got %v, %v; want %v", i, path, got, err, key)
+			}
+		}
+		rows := make(map[string]int)
+		r, err := db.Query("SELECT filename, filehash, numowners FROM filedata")
+		if err != nil {
+			t.Fatalf("could not read filedata: %v", err)
+		}
+		for r.Next() {
+			var filename, filehash string
+			var numowners int
+			if err := r.Scan(&filename, &filehash, &numowners); err != nil {
+				t.Fatalf("could not read filedata: %v", err)
+			}
+			if filename != filehash {
+				t.Fatalf("run %v: row %v has hash %v; want the two to match", i, filename, filehash)
+			}
+			rows[filename] = numowners
+		}
+		r.Close()
+		if len(rows) != 2 || rows[contentKey([]byte("one"))] != 2 || rows[same] != 2 {
+			t.Fatalf("run %v: got owners %v; want 2 for each of %v and %v", i, rows, contentKey([]byte("one")), same)
+		}
+		for _, path := range []string{"filestore/file1", "filestore/file2", "filecount.txt"} {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Fatalf("run %v: %v: got %v; want it gone", i, path, err)
+			}
+		}
+		if body, err := store.Get(contentKey([]byte("one"))); err != nil || string(body) != "one" {
+			t.Fatalf("run %v: blob of file1: got %q, %v; want %q", i, body, err, "one")
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+		"bytes"
+		"flag"
 		"fmt"
+		"io"
 		"io/ioutil"
 		"encoding/base64"
 		"os"
-		"crypto/sha1"	
 		"database/sql"
 		_ "github.com/mattn/go-sqlite3"			
 		"crypto/rand"
@@ -15,6 +17,10 @@ import (
 		"../lib/support/rpc"
 		"strings"
 		"strconv"
+		"reflect"
+		"sync"
+		"syscall"
+		"unicode/utf8"
        )
 
 
@@ -27,16 +33,91 @@ type Cookie struct {
 //Global variables
 var db *sql.DB
 var Cookiemap = make(map[string]Cookie)
-var filecount int
 
+//Command line flags
+var compressFlag = flag.String("compress", "auto", "how to compress stored files: auto, always or never")
+var versionsFlag = flag.Int("versions", 10, "how many previous versions of each file to keep")
+var trashAgeFlag = flag.Duration("trash-age", 30*24*time.Hour, "how long removed files stay in the trash before being purged; 0 keeps them until the trash is emptied")
+var keyfileFlag = flag.String("keyfile", "", "file holding the master keys stored files are encrypted under (created if missing); no encryption if empty")
+var passwordIterationsFlag = flag.Int("password-iterations", 50000, "PBKDF2 iterations new password hashes are made with; hashes made with fewer are upgraded when their user logs in")
+
+
+// Held by every handler while it runs, and by anything the server does in the background, so that
+// the two never run at the same time. The rpc package already handles one request at a time, but
+// knows nothing of the background work.
+var serverMtx sync.Mutex
+
+// Takes in a handler and returns one of the same type which holds serverMtx while it runs.
+func lockedHandler(f interface{}) interface{} {
+	v := reflect.ValueOf(f)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		serverMtx.Lock()
+		defer serverMtx.Unlock()
+		return v.Call(args)
+	}).Interface()
+}
+
+// Registers f as the handler for name with the rpc package, holding serverMtx while it runs.
+func registerHandler(name string, f interface{}) {
+	rpc.RegisterHandler(name, lockedHandler(f))
+}
 
+// Calls f while holding serverMtx, so that no handler runs until it returns.
+func runLocked(f func()) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+	f()
+}
+
+// Held open for as long as the process runs, so that its lock on ./server.lock is kept.
+var lockFile *os.File
+
+// Takes the lock on ./server.lock, which the server and fsck both hold while they run so that
+// neither changes the data out from under the other. Exits if another process already holds it.
+func lockDataDir() {
+	var err error
+	lockFile, err = os.OpenFile("./server.lock", os.O_RDWR|os.O_CREATE, 0664)
+	if(err!=nil){
+		fmt.Fprintf(os.Stderr, "could not open lock file: %v\n", err)
+		os.Exit(1)
+	}
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if(err!=nil){
+		fmt.Fprintf(os.Stderr, "another server or fsck is already running here\n")
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <listen-address>\n       %v [flags] stats\n       %v [flags] fsck [--repair]\n       %v quota [-default <size>] [<user> <size|default>]\n       %v -keyfile <file> rotate-key\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %v <listen-address>\n", os.Args[0])
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 && flag.Arg(0) != "fsck" && flag.Arg(0) != "quota" {
+		usage()
+		os.Exit(1)
+	}
+	if !validCompressPolicy(*compressFlag) {
+		fmt.Fprintf(os.Stderr, "unknown compression policy: %v\n", *compressFlag)
+		os.Exit(1)
+	}
+	compressPolicy = *compressFlag
+	if *versionsFlag < 0 {
+		fmt.Fprintf(os.Stderr, "-versions can't be negative\n")
+		os.Exit(1)
+	}
+	if *passwordIterationsFlag < 1 {
+		fmt.Fprintf(os.Stderr, "-password-iterations must be at least 1\n")
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) != "stats" {
+		lockDataDir()
+	}
+
 	fmt.Fprintf(os.Stderr, "Database Initialized...\n")
 	var err error
 	db, err = sql.Open("sqlite3", "./dropbox.db")
@@ -44,32 +125,106 @@ func main() {
 		fmt.Fprintf(os.Stderr, "could not run server: %v\n", err)
 		os.Exit(1)
 	}
-	filecount_read, err := ioutil.ReadFile("./filecount.txt")	
+	initDB()
+	store, err = newLocalBlobStore("./filestore")
 	if(err!=nil){
-		fmt.Fprintf(os.Stderr, "could not read filecount: %v\n", err)
-		os.Exit(1)		
-	}
-	filecount, err = strconv.Atoi(strings.TrimSuffix(string(filecount_read), "\n"))
-	if(err!=nil){
-		fmt.Fprintf(os.Stderr, "Atoi fail: %v\n", err)
+		fmt.Fprintf(os.Stderr, "could not open filestore: %v\n", err)
 		os.Exit(1)
 	}
-    listenAddr := os.Args[1]
-
 
-    rpc.RegisterHandler("unshare", unshareHandler)
-    rpc.RegisterHandler("chperm", chpermHandler)
-    rpc.RegisterHandler("share", shareHandler)	
-    rpc.RegisterHandler("upload", uploadHandler)
-    rpc.RegisterHandler("download", downloadHandler)
-    rpc.RegisterHandler("list", listHandler)
-    rpc.RegisterHandler("mkdir", mkdirHandler)
-    rpc.RegisterHandler("remove", removeHandler)
-    rpc.RegisterHandler("pwd", pwdHandler)
-    rpc.RegisterHandler("cd", cdHandler)
+	// stats and fsck only look at the data as it is; they must not migrate it or add keys
+	if flag.Arg(0) == "stats" || flag.Arg(0) == "fsck" {
+		if hasColumn("filedata", "numowners") {
+			fmt.Fprintf(os.Stderr, "the data here is in an older layout; start the server once to bring it up to date\n")
+			os.Exit(1)
+		}
+		if flag.Arg(0) == "stats" {
+			printStats()
+		} else {
+			runFsck(flag.Args()[1:])
+		}
+		return
+	}
+	if *keyfileFlag != "" {
+		if flag.Arg(0) == "rotate-key" {
+			rotateKey(*keyfileFlag)
+			return
+		}
+		err = loadKeyFile(*keyfileFlag)
+		if(err!=nil){
+			fmt.Fprintf(os.Stderr, "could not load key file: %v\n", err)
+			os.Exit(1)
+		}
+	} else if flag.Arg(0) == "rotate-key" {
+		fmt.Fprintf(os.Stderr, "rotate-key needs -keyfile\n")
+		os.Exit(1)
+	}
+	checkKeys()
+	migrateFilestore("./filestore")
+	migrateChunks()
+	initUsage()
+
+	if flag.Arg(0) == "quota" {
+		runQuota(flag.Args()[1:])
+		return
+	}
+    listenAddr := flag.Arg(0)
+    initTransfers()
+
+
+    registerHandler("unshare", unshareHandler)
+    registerHandler("chperm", chpermHandler)
+    registerHandler("share", shareHandler)	
+    registerHandler("share-until", shareUntilHandler)
+    registerHandler("shares", sharesHandler)
+    registerHandler("invites", invitesHandler)
+    registerHandler("accept", acceptHandler)
+    registerHandler("decline", declineHandler)
+    registerHandler("autoaccepts", autoAcceptsHandler)
+    registerHandler("autoaccept", autoAcceptSetHandler)
+    registerHandler("transfer", transferHandler)
+    registerHandler("transfer-cancel", transferCancelHandler)
+    registerHandler("groups", groupsHandler)
+    registerHandler("group-create", groupCreateHandler)
+    registerHandler("group-delete", groupDeleteHandler)
+    registerHandler("group-add", groupAddHandler)
+    registerHandler("group-remove", groupRemoveHandler)
+    registerHandler("link", linkHandler)
+    registerHandler("links", linksHandler)
+    registerHandler("link-revoke", linkRevokeHandler)
+    registerHandler("link-download", linkDownloadHandler)
+    registerHandler("upload", uploadHandler)
+    registerHandler("download", downloadHandler)
+    registerHandler("upload-begin", uploadBeginHandler)
+    registerHandler("upload-status", uploadStatusHandler)
+    registerHandler("upload-put", uploadPutHandler)
+    registerHandler("upload-commit", uploadCommitHandler)
+    registerHandler("upload-abort", uploadAbortHandler)
+    registerHandler("download-open", downloadOpenHandler)
+    registerHandler("download-read", downloadReadHandler)
+    registerHandler("download-close", downloadCloseHandler)
+    registerHandler("download_range", downloadRangeHandler)
+    registerHandler("list", listHandler)
+    registerHandler("stat", statHandler)
+    registerHandler("mkdir", mkdirHandler)
+    registerHandler("remove", removeHandler)
+    registerHandler("remove-all", removeAllHandler)
+    registerHandler("move", moveHandler)
+    registerHandler("copy", copyHandler)
+    registerHandler("pwd", pwdHandler)
+    registerHandler("cd", cdHandler)
+    registerHandler("quota", quotaHandler)
+    registerHandler("history", historyHandler)
+    registerHandler("restore", restoreHandler)
+    registerHandler("trash", trashHandler)
+    registerHandler("restore-trash", restoreTrashHandler)
+    registerHandler("empty-trash", emptyTrashHandler)
     rpc.RegisterFinalizer(finalizer)
-    rpc.RegisterHandler("authenticate", authenticateHandler)
-    rpc.RegisterHandler("signup", signupHandler)	
+    registerHandler("authenticate", authenticateHandler)
+    registerHandler("signup", signupHandler)	
+    go reencodeLoop()
+    go trashLoop()
+    go shareExpiryLoop()
     err = rpc.RunServer(listenAddr)
     if err != nil {
 	    fmt.Fprintf(os.Stderr, "could not run server: %v\n", err)
@@ -116,7 +271,8 @@ func checkUser(username string) bool {
 
 
 // Takes in a path relative to the server and a username and returns true if and only
-// if this path is the user's root or a subdirectory of their root as saved on the server's filesystem.
+// if this path is the user's root or a subdirectory of their root as saved on the server's filesystem,
+// and following the symlinks on the way to it doesn't lead anywhere else than their root or what is shared with them.
 func checkpath(path string, username string) bool{
 	// Get the user's root
 
@@ -133,8 +289,8 @@ func checkpath(path string, username string) bool{
 	}	
 
 	// Check if the user is trying to access something outside of their root.
-	if(strings.HasPrefix(desiredpath, basepath)){
-		return true
+	if(desiredpath == basepath || strings.HasPrefix(desiredpath, basepath+"/")){
+		return realPathAllowed(desiredpath, basepath, username)
 	}else{
 		return false
 	}
@@ -164,79 +320,56 @@ func checkCookie(username string, session string) bool {
 // Returns a string with an error message in case of failiure due to path or sharer etc 
 // Exits with an error on serverside in case something fails. Only used as a helper to 
 // uploadHandler which takes care of uploads of both shared and non-shared files.
-func sharerUpload(sharer string, origpath string, body []byte) string {
-	stmt, err := db.Prepare("SELECT shareepath FROM sharedata where sharer=? AND origpath=?")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-		os.Exit(1)
+// Everything is done as part of o, so the sharees' links only change if the upload does.
+func sharerUpload(o *op, sharer string, origpath string, body []byte) string {
+	ret := storeFile(o, origpath, sharer, body)
+	if ret != "" {
+		return ret
 	}
-	rows, err := stmt.Query(sharer, origpath)
+	return relinkSharees(o, sharer, origpath)
+}
+
+// Points every sharee's link to the file at origpath at whatever the sharer's link now points at,
+// as part of o.
+func relinkSharees(o *op, sharer string, origpath string) string {
+	rows, err := o.tx.Query("SELECT shareepath FROM sharedata where sharer=? AND origpath=? AND shareepath!=''", sharer, origpath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
-		os.Exit(1)
+		o.fatal("could not access database", err)
 	}
 
 	var sharee_list []string
-		//removing all symlinks
-	defer rows.Close()
 	for rows.Next() {
-
 		var shareepath string
 		err = rows.Scan(&shareepath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
-				os.Exit(1)
+			rows.Close()
+			o.fatal("could not access database", err)
 		}
-		//symlink code.
 		sharee_list = append(sharee_list, shareepath)
-		err = os.Remove(shareepath)
-		if err != nil {
-			return "Error removing from sharee"
-		}
-
 	}
-
-	uploadHelper(origpath, sharer, body)
+	rows.Close()
 
 	realfile, err := os.Readlink(origpath)
 	if err != nil {
 		return "Something went wrong and we couldn't access your file\n"               
 	}
 
-	size := len(sharee_list)
-	for i:=0;i<size;i+=1 {
-		shareepath:=sharee_list[i]
-	   	err = os.Symlink(realfile, shareepath)
-	}
-    return ""
-}
-
-
-
-// Takes in a full path of a shared file in the sharee's directoty and the name of a sharee
-// returns the permissions of the user if the file is shared with them. Note that we are only calling this
-// as a helper function in places where it is already checked that the file is actually shared with the sharee
-func getPerms(path string, sharee string) int {
-	//make prepare statement to prevent sql injection
-	stmt, err := db.Prepare("SELECT perm FROM sharedata WHERE shareepath=? AND sharee=?")
+	//point all of the sharees' symlinks at the new blob
+	for _, shareepath := range sharee_list {
+		err = o.removeLink(shareepath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-				os.Exit(1)
+			return "Error removing from sharee"
+		}
+		err = o.symlink(realfile, shareepath)
+		if err != nil {
+			return "Error relinking for sharee"
 		}
-
-	//make query for the username and password in the database
-	var perm int
-	err = stmt.QueryRow(path, sharee).Scan(&perm)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
-		os.Exit(1)
 	}
-
-	return perm
-
+    return ""
 }
 
 
+
 // Helper function that takes in the full path on the server to a file and returns whether it in 
 // in our database of shared files. The sanitisation of path is done before this is called.
 func isSharedFile(path string) string {
@@ -270,6 +403,29 @@ func isSharedFile(path string) string {
 // deduplication but does not keep track of sharing.
 // Returns strings of errors where necessary.
 func uploadHelper(storepath string, username string, body []byte) string {
+	o := beginOp()
+	ret := storeFile(o, storepath, username, body)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't upload :("
+	}
+	return ""
+}
+
+// Does the work of uploadHelper as part of o, leaving it to the caller to commit or roll back.
+// The blob is written first, then its row in filedata, then the user's link, so whatever a failure
+// leaves half done is undone along with the transaction.
+func storeFile(o *op, storepath string, username string, body []byte) string {
+	//dedup, the hash is also the key the blob is stored under
+	return storeStream(o, storepath, username, contentKey(body), int64(len(body)), bytes.NewReader(body))
+}
+
+// Does the work of storeFile for content read from r, whose hash and size the caller has already
+// worked out. Only a chunk of it is held in memory at a time.
+func storeStream(o *op, storepath string, username string, hash string, size int64, r io.Reader) string {
 	prefix, err:=filepath.Abs("./userfs/"+username+"/Shared_with_me")
 	if(err!=nil){
 		return "Error finding path..."
@@ -279,150 +435,118 @@ func uploadHelper(storepath string, username string, body []byte) string {
 		return "You cannot upload a new file to Shared_with_me"
 	}   
 
-	if _, err := os.Stat(storepath); err == nil {
-		remove(storepath, username)
+	ret := checkQuota(o.tx, username, storepath, size)
+	if ret != "" {
+		return ret
 	}
 
-	//dedup
-	h := sha1.New()
-	h.Write(body)
-	hash := base64.URLEncoding.EncodeToString(h.Sum(nil))
-
-
-
-	//make prepare statement to prevent sql injection
-	stmt, err := db.Prepare("SELECT count(1) FROM filedata WHERE filehash=?")
-    if err != nil {
-	    fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-		os.Exit(1)
-    }
-
-   //make query for the file in the database
-   	var found int
-   	err = stmt.QueryRow(hash).Scan(&found)
-   	if err != nil {
-	   	fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
-		os.Exit(1)
-   	}
-
-   	// if the file is not found, upload a new copy.
-    if(found==0){
-
-		store_at := "./filestore/file" + strconv.Itoa(filecount)
+	//queries use placeholders to prevent sql injection
+	var found int
+	err = o.tx.QueryRow("SELECT count(1) FROM filedata WHERE filehash=?", hash).Scan(&found)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
 
-		abspath, err := filepath.Abs(store_at)
-		if err != nil {
+	// if the file is not found, store its chunks, otherwise it is just linked to again
+	if(found==0){
+		stored, err := storeChunks(o, hash, r)
+		if err != nil || stored != size {
 			return "Couldn't upload :("
 		}
-
-	    err = ioutil.WriteFile(abspath, body, 0664)
-
+		_, err = o.tx.Exec("INSERT INTO filedata(filename, filehash, size) values(?,?,?)", hash, hash, size)
 		if err != nil {
-			return "Couldn't upload :("
+			o.fatal("could not update database", err)
 		}
+	}
+	return linkFile(o, storepath, username, hash)
+}
 
-	  	err = os.Symlink(abspath, storepath)
-
-	  	if err != nil {
-		  	return "Couldn't upload :("
-	  	}
-
-	  	stmt, err = db.Prepare("INSERT INTO filedata(filename, filehash, numowners) values(?,?,?)")
-	  	if err != nil {
-		  	fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			os.Exit(1)
-	  	}
-  		result, err := stmt.Exec("file" + strconv.Itoa(filecount), hash, 1)
-	  	if err != nil {
-			fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-			os.Exit(1)
-	  	}
-	  	_, err = result.RowsAffected()
-
-	  	if err != nil {
-		  	fmt.Fprintf(os.Stderr, "could not access affected parts of database: %v\n", err)
-			os.Exit(1)
-	  	}
-
-	  	filecount += 1
-		return ""
-
-   	} else{
-   		// If the file is not in the database upload a new copy and add the hash to the filedata database
-	   	stmt, err = db.Prepare("SELECT filename FROM filedata WHERE filehash=?")
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			os.Exit(1)
-	   	}
-	   	var found string
-	   	err = stmt.QueryRow(hash).Scan(&found)
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
-			os.Exit(1)
-	   	}
-	   	abspath, err := filepath.Abs("./filestore/" + found)
-	   	if err != nil {
-		   	return "Couldn't upload :("
-	   	}
-	   	err = os.Symlink(abspath, storepath)
-
-	   	if err != nil {
-		   	return "Couldn't upload :("
-	   	}	
-
-	   	stmt, err = db.Prepare("SELECT numowners FROM filedata WHERE filehash=?")
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			os.Exit(1)
-	   	}
-	   	var curr_num int
-	   	err = stmt.QueryRow(hash).Scan(&curr_num)
+// Points the link at storepath at the file with the given hash as part of o, adding an owner to
+// the file. Whatever was linked there before is kept as a version of storepath, so overwriting a
+// file never loses it.
+func linkFile(o *op, storepath string, username string, hash string) string {
+	// The new owner is added first, so that pruning old versions below can't release the file
+	// when it is one of them
+	retainChunks(o, hash)
+
+	if fi, err := os.Lstat(storepath); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			ret := removeFile(o, storepath, username)
+			if ret != "" {
+				return ret
+			}
+		} else {
+			oldkey, err := linkKey(storepath)
+			if err != nil {
+				return "Couldn't upload :("
+			}
+			if oldkey == hash {
+				// nothing changes, so there is nothing to keep and the link already owns the file
+				releaseFile(o, hash)
+				return ""
+			}
+			// the link's ownership of the old file passes to the version, once the link is gone so
+			// that it is no longer charged for
+			err = o.removeLink(storepath)
+			if err != nil {
+				return "Couldn't upload :("
+			}
+			keepVersion(o, username, storepath, oldkey)
+		}
+	}
 
-	   	new_num := curr_num + 1
+	err := o.symlink(hash, storepath)
+	if err != nil {
+		return "Couldn't upload :("
+	}
+	return ""
+}
 
-	   	stmt, err = db.Prepare("UPDATE filedata SET numowners=? WHERE filehash=?")
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			os.Exit(1)
-	   	}
-   		result, err := stmt.Exec(new_num, hash)
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-			os.Exit(1)
-	   	}
-   		_, err = result.RowsAffected()
-	   	if err != nil {
-		   	fmt.Fprintf(os.Stderr, "could not access affected parts of database: %v\n", err)
-			os.Exit(1)
-	   	}
-   }
-   return "End of uploadHelper"
+// Drops one owner from the file with the given hash as part of o by releasing its chunks. Chunks
+// nothing else uses are deleted, and the file goes with them once it has no owners left.
+func releaseFile(o *op, hash string) {
+	releaseChunks(o, hash)
 }
 
 
 
 // Handler to handle authentication requests made by the client only when the user is attempting to sign in
 // takes in username and password returns true if authenticated alongwith session information. Else returns false and empty session info
-func authenticateHandler(username string, password string) internal.AuthReturn{	
-	h := sha1.New()
-	h.Write([]byte(password))
-	hash := base64.URLEncoding.EncodeToString(h.Sum(nil))
-
+// device is the device token the client was given the last time it logged in as username, if any (see server/devices.go)
+func authenticateHandler(username string, password string, device string) internal.AuthReturn{	
+	key := loginKey(username, device)
+	if !failedLogins.allowed(key) {
+		return internal.AuthReturn{Auth:false, Session: ""}
+	}
 	//make prepare statement to prevent sql injection
-	stmt, err := db.Prepare("SELECT count(1) FROM userdata WHERE username=? AND passhash=?")
+	stmt, err := db.Prepare("SELECT passhash FROM userdata WHERE username=?")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
 		os.Exit(1)
 	}
 
-   	//make query for the username and password in the database	
-   	var found int
-	err = stmt.QueryRow(username, hash).Scan(&found)
+   	//make query for the username's password hash in the database
+   	var stored string
+	err = stmt.QueryRow(username).Scan(&stored)
+	if err == sql.ErrNoRows {
+		checkDummyPassword(password)
+		failedLogins.failed(key)
+		return internal.AuthReturn{Auth:false, Session: ""}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
 		os.Exit(1)
 	}
-   	if(found == 1){
+   	if(checkPassword(stored, password) || checkOldPassword(stored, password)){
+		failedLogins.succeeded(key)
+		// old SHA-1 hashes, and ones made with fewer iterations, are replaced now that we know the password
+		if needsRehash(stored) {
+			_, err = db.Exec("UPDATE userdata SET passhash=? WHERE username=? AND passhash=?", hashPassword(password), username, stored)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	   //make new random cookie
 		rb:=make([]byte, 64)
 	   	_, err := rand.Read(rb)
@@ -434,8 +558,9 @@ func authenticateHandler(username string, password string) internal.AuthReturn{
 		exptime := time.Now().Add(time.Second*1000)
 		newcookie:=Cookie{newsession, exptime}
 	   	Cookiemap[username] = newcookie
-		return internal.AuthReturn{Auth: true, Session: newsession}	
+		return internal.AuthReturn{Auth: true, Session: newsession, Device: deviceFor(username, device)}	
    	} else{
+		failedLogins.failed(key)
 	   	return internal.AuthReturn{Auth:false, Session: ""}
    	}
 }
@@ -474,9 +599,11 @@ func signupHandler(username string, password string) bool {
 	if strings.Contains(username, "/"){
 		return false
 	}
-	h := sha1.New()
-   	h.Write([]byte(password))
-   	hash := base64.URLEncoding.EncodeToString(h.Sum(nil))
+	// @ is how groups are told apart from users
+	if strings.HasPrefix(username, "@"){
+		return false
+	}
+   	hash := hashPassword(password)
 
    	//make prepare statement to prevent sql injection
    	stmt, err = db.Prepare("INSERT INTO userdata (username, passhash) VALUES (?, ?)")
@@ -538,12 +665,33 @@ func chpermHandler(path string, sharee string, newperm string, username string,
 					return ""
 				}
 
+		       	if _, err := os.Lstat(fullpath); os.IsNotExist(err) {
+			       return "That resource doesn't exist!\n"
+		       	}
+
+				perm := parsePerm(newperm)
+				if perm < 0 {
+					return "Permissions can only be r, rw or rws"
+				}
+
 		       	if strings.HasPrefix(fullpath, owner_shared){
-			       return "Dude, you don't own this!"
+			       	// only what the user shared onward can be changed from in here
+			       	ret := updateReshare(fullpath, sharee, perm, username)
+			       	if ret != "" {
+				       	return ret
+			       	}
+			       	return "Permissions updated"
 		       	}
 
-		       	if _, err := os.Stat(fullpath); os.IsNotExist(err) {
-			       return "That resource doesn't exist!\n"
+		       	if strings.HasPrefix(sharee, "@") {
+			       	if perm > 1 {
+				       	return "Groups can only be given r or rw"
+			       	}
+			       	ret := updateGroupShare(path, sharee[1:], perm, username)
+			       	if ret != "" {
+				       	return ret
+			       	}
+			       	return "Permissions updated"
 		       	}
 
 		       	stmt, err := db.Prepare("SELECT count(1) FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?")
@@ -560,29 +708,32 @@ func chpermHandler(path string, sharee string, newperm string, username string,
 			    }
 
 		       	if found == 0 {
+			       	// they may not have accepted it yet
+			       	res, err := db.Exec("UPDATE invitedata SET perm=? WHERE sharer=? AND sharee=? AND origpath=? AND transfer=0", perm, username, sharee, fullpath)
+			       	if err != nil {
+				       	fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+				       	os.Exit(1)
+			       	}
+			       	if n, _ := res.RowsAffected(); n > 0 {
+				       	return "Permissions updated"
+			       	}
 			       	return "File not shared with this person."
 		       	}
 
-		       	stmt, err = db.Prepare("UPDATE sharedata SET perm=? WHERE sharer=? AND sharee=? AND origpath=?")
-			    if err != nil {
-				    fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-					os.Exit(1)
-			    }
-
-				perm := 0
-	      		if newperm == "rw"{
-		      		perm = 1
-	       		} else { 
-			       	if newperm != "r" {
-				       	return "Permissions can only be r or rw"
-			       	}
-	       		}
-
-
-		       	_, err = stmt.Exec(perm, username, sharee, fullpath)
+		       	// a share they had through a group becomes one of their own, and what they can no
+		       	// longer share onward goes from whoever they shared it with
+		       	o := beginOp()
+		       	_, err = o.tx.Exec("UPDATE sharedata SET perm=?, grp='' WHERE sharer=? AND sharee=? AND origpath=?", perm, username, sharee, fullpath)
 		       	if err != nil {
-			       	fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
-				    os.Exit(1)
+			       	o.fatal("could not update database", err)
+		       	}
+		       	ret := pruneReshares(o, username)
+		       	if ret != "" {
+			       	o.rollback()
+			       	return ret
+		       	}
+		       	if o.commit() != nil {
+			       	return "Could not update the share!"
 		       	}
 
 		       	return "Permissions updated"
@@ -600,26 +751,38 @@ func chpermHandler(path string, sharee string, newperm string, username string,
 // Takes in a relative path, a sharee, and desired permissions and the username of the sharer.
 // If the sharing is allowed, then this function places a symlink to the shared file in the sharee's directory and 
 // puts the following information in our sharedata database: sharer, sharee, absolute path on server to sharer's symlinke
-// absolute path on the server to the sharee's symlink and the permissions.
+// absolute path on the server to the sharee's symlink and the permissions. A directory is shared as a whole, with
+// the sharee's symlink pointing at the directory itself.
 // Returns a string that may contain any errors that occur.
 
 func shareHandler(path string, sharee string, permissions string, username string, cookie string) string {
+	return shareUntilHandler(path, sharee, permissions, 0, username, cookie)
+}
+
+// Does the work of shareHandler for a share that expires ttl seconds from now, or never if ttl is 0.
+func shareUntilHandler(path string, sharee string, permissions string, ttl int64, username string, cookie string) string {
 	if(checkCookie(username, cookie)==false){
 		return "reauth"
 	}
+	if ttl < 0 {
+		return "Shares can't expire in the past!"
+	}
+	expires := shareExpiry(ttl)
 	allow := checkpath(path, username)
 	       if(allow==true){
 		       if username == sharee {
 			       return "You can't share it with yourself, silly!"
 		       }
-			perm := 0
-	      	if permissions == "rw" {
-		  		perm = 1
-	     	} else {
-			    if permissions != "r"{
-				    return "Permissions can only be either r or rw\n"
-		      	}
-	      	}
+			perm := parsePerm(permissions)
+			if perm < 0 {
+				return "Permissions can only be r, rw or rws\n"
+			}
+		if strings.HasPrefix(sharee, "@") {
+			if perm > 1 {
+				return "Groups can only be given r or rw\n"
+			}
+			return shareWithGroup(path, sharee[1:], perm, expires, username)
+		}
 
       stmt, err := db.Prepare("SELECT count(1) FROM userdata WHERE username=?")
 	      if err != nil {
@@ -642,7 +805,7 @@ func shareHandler(path string, sharee string, permissions string, username strin
 			      return ""
 	      }
 
-      if _, err := os.Stat(fullpath); os.IsNotExist(err) {
+      if _, err := os.Lstat(fullpath); os.IsNotExist(err) {
 	      return "That resource doesn't exist!\n"
       }
       owner_shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me") 
@@ -650,7 +813,7 @@ func shareHandler(path string, sharee string, permissions string, username strin
 		      return "Oops, abs failed!"
 	      }
       if strings.HasPrefix(fullpath, owner_shared){
-	      return "Dude, you don't own this!"
+	      return reshare(fullpath, sharee, perm, expires, username)
       }
 
       stmt, err = db.Prepare("SELECT count(1) FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?")
@@ -668,9 +831,22 @@ func shareHandler(path string, sharee string, permissions string, username strin
 			      os.Exit(1)
 	      }
       if(found == 1){
+	      // a share they have through a group becomes one of their own
+	      res, err := db.Exec("UPDATE sharedata SET perm=?, grp='', expires=? WHERE sharer=? AND sharee=? AND origpath=? AND grp!=''", perm, expires, username, sharee, fullpath)
+		      if err != nil {
+			      fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+				      os.Exit(1)
+		      }
+	      if n, _ := res.RowsAffected(); n > 0 {
+		      return ""
+	      }
 	      return "You already shared this with this user! If you want to change permissions, use chperm.\n"
       }
 
+      // unless they accept everything from the user, they are only asked whether they want it
+      if !autoAccepts(sharee, username) {
+	      return inviteUser(fullpath, sharee, perm, expires, username, "", "")
+      }
 
 
       //at this point, auth, checked file, checked username 
@@ -680,28 +856,7 @@ func shareHandler(path string, sharee string, permissions string, username strin
 		      fmt.Fprintf(os.Stderr, "error abs path: %v\n", err)
 			      return "Something went wrong :(\n"
 	      }
-filename := filepath.Base(fullpath)
-		  if(err!=nil){
-			  fmt.Fprintf(os.Stderr, "error abs path: %v\n", err)
-				  return "Something went wrong :(\n"
-		  }
-i := 1
-
-	   _, err = os.Stat(path_to_sharee +"/"+ filename)
-
-
-	   tmpfile := filename
-	   loopvar := os.IsNotExist(err)
-	   for !loopvar {
-		   tmpfile=filename
-
-			   tmpfile = strconv.Itoa(i) + tmpfile
-
-			   _, err = os.Stat(path_to_sharee +"/"+ tmpfile); 	
-		   loopvar = os.IsNotExist(err)
-			   i += 1
-	   }
-   filename = tmpfile
+filename := freeShareeName(path_to_sharee, filepath.Base(fullpath))
 
 
 	   filedata, err := os.Lstat(fullpath)
@@ -715,25 +870,50 @@ i := 1
 			   return "Something went wrong and we couldn't access your file\n"               
 		   }
 
-	   err = os.Symlink(newpath, path_to_sharee + "/" + filename)    
+	   o := beginOp()
+	   err = o.symlink(newpath, path_to_sharee + "/" + filename)    
 		   if err != nil {
+			   o.rollback()
 			   fmt.Print(err.Error())
 				   return "Could not share!"
 		   }
-	   stmt, err = db.Prepare("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm) values(?,?,?,?,?)")
+	   _, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires) values(?,?,?,?,?,?)", username, sharee, fullpath, path_to_sharee + "/" + filename, perm, expires)
 		   if err != nil {
-			   fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-				   os.Exit(1)
-		   }
-	   _, err = stmt.Exec(username, sharee, fullpath, path_to_sharee + "/" + filename, perm)
-		   if err != nil {
-			   fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-				   os.Exit(1)
+			   o.fatal("could not update database", err)
 		   }    
+	   if o.commit() != nil {
+		   return "Could not share!"
+	   }
 	   return ""
 
    }	
 
+   if filedata.IsDir() {
+	   root, err := filepath.Abs("./userfs/" + username)
+		   if err != nil {
+			   return "Oops, abs failed!"
+		   }
+	   if fullpath == root {
+		   return "You can't share your whole directory!\n"
+	   }
+
+	   // the sharee's link is to the directory itself, so they see everything that is put in it
+	   o := beginOp()
+	   err = o.symlink(fullpath, path_to_sharee + "/" + filename)
+		   if err != nil {
+			   o.rollback()
+			   return "Could not share!"
+		   }
+	   _, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires) values(?,?,?,?,?,?)", username, sharee, fullpath, path_to_sharee + "/" + filename, perm, expires)
+		   if err != nil {
+			   o.fatal("could not update database", err)
+		   }
+	   if o.commit() != nil {
+		   return "Could not share!"
+	   }
+	   return ""
+   }
+
    return "There seems to have been an issue"
 	       } else {
 		       return "You don't have access to this resource"
@@ -744,6 +924,21 @@ i := 1
 }
 
 
+// Takes in the absolute path of a sharee's Shared_with_me directory and the name of a file being
+// shared with them, and returns a name for it nothing in the directory has yet. Clashing names
+// get a number put in front of them, e.g. 1notes.txt.
+func freeShareeName(path_to_sharee string, filename string) string {
+	tmpfile := filename
+	i := 1
+	_, err := os.Lstat(path_to_sharee + "/" + tmpfile)
+	for !os.IsNotExist(err) {
+		tmpfile = strconv.Itoa(i) + filename
+		_, err = os.Lstat(path_to_sharee + "/" + tmpfile)
+		i += 1
+	}
+	return tmpfile
+}
+
 // Takes in a path (relative to the server), a sharee, a username and a cookie. Then unshares the file with the
 // specified user if the request to do so is valied and returns a string with an error if need be.
 func unshareHandler(path string, sharee string, username string, cookie string) string {
@@ -755,6 +950,9 @@ func unshareHandler(path string, sharee string, username string, cookie string)
        if username == sharee {
 	       return "You can't share it with yourself, silly!"
        }
+       if strings.HasPrefix(sharee, "@") {
+	       return updateGroupShare(path, sharee[1:], -1, username)
+       }
 
        stmt, err := db.Prepare("SELECT count(1) FROM userdata WHERE username=?")
 	       if err != nil {
@@ -776,6 +974,13 @@ func unshareHandler(path string, sharee string, username string, cookie string)
 		       fmt.Fprintf(os.Stderr, "error abs path: %v\n", err)
 			       return ""
 	       }
+       owner_shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	       if err != nil {
+		       return "Oops, abs failed!"
+	       }
+       if strings.HasPrefix(fullpath, owner_shared+"/") {
+	       return updateReshare(fullpath, sharee, -1, username)
+       }
 
 
        stmt, err = db.Prepare("SELECT count(1) FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?")
@@ -793,6 +998,15 @@ func unshareHandler(path string, sharee string, username string, cookie string)
 	       }
 
        if(found != 1){
+	       // they may not have accepted it yet
+	       res, err := db.Exec("DELETE FROM invitedata WHERE sharer=? AND sharee=? AND origpath=? AND transfer=0", username, sharee, fullpath)
+	       if err != nil {
+		       fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		       os.Exit(1)
+	       }
+	       if n, _ := res.RowsAffected(); n > 0 {
+		       return ""
+	       }
 	       return "You have not shared this file with the specified user.\n"
        }
 
@@ -804,23 +1018,29 @@ func unshareHandler(path string, sharee string, username string, cookie string)
        var sym_to_remove string
 	       err = stmt.QueryRow(username, sharee, fullpath).Scan(&sym_to_remove)
 
-	       err = os.Remove(sym_to_remove)
+       o := beginOp()
+	       err = o.removeLink(sym_to_remove)
 	       if err != nil {
+		       o.rollback()
 		       return err.Error()
 	       }   
 
-       stmt, err = db.Prepare("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?")
+       _, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", username, sharee, fullpath)
 	       if err != nil {
-		       fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			       os.Exit(1)
-	       }
-
-       _, err = stmt.Exec(username, sharee, fullpath)
-
-	       if err != nil {
-		       fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-			       os.Exit(1)
+		       o.fatal("could not update database", err)
 	       }
+       // they may still have it through a group, and what they shared onward goes too
+       ret := syncGroupShares(o, sharee)
+       if ret == "" {
+	       ret = pruneReshares(o, username)
+       }
+       if ret != "" {
+	       o.rollback()
+	       return ret
+       }
+       if o.commit() != nil {
+	       return "Could not unshare!"
+       }
 
        return ""
    } else {
@@ -848,59 +1068,49 @@ func uploadHandler(path, username string, body []byte, cookie string) string {
 				       return err.Error()
 			       }
 
-				shared := isSharedFile(storepath)
-
-				if(shared==""){
+				sharer, sharerpath, errmsg := uploadTarget(storepath, username)
+				if errmsg != "" {
+					return errmsg
+				}
+				if(sharer==username && isSharedFile(storepath)==""){
 					return uploadHelper(storepath, username, body)
-				}else{
-					//case the file is shared
-					if(shared=="sharer"){
-						//sharerupload
-
-						return sharerUpload(username, storepath, body)
-
-					}else{
-						// need to change this to have one more argument
-
-						perms:=getPerms(storepath, username)
-				    	if(perms==0){
-					      return "Permission Denied"
-
-				      	}	else{
-					      //get sharer and pass in 
-					      	stmt, err := db.Prepare("SELECT sharer, origpath FROM sharedata WHERE shareepath=?")
-						      if err != nil {
-							      fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-								      os.Exit(1)
-						      }
-					      	var sharerpath string
-						    var foundsharer string
-						    err = stmt.QueryRow(storepath).Scan(&foundsharer, &sharerpath)
-						    if err != nil {
-							      fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
-								      os.Exit(1)
-						      }					
-					      	sharerUpload(foundsharer, sharerpath, body)
-						      return "File Shared!"
-				      	}
-
-
 				}
 
-
-					return shared
+				//case the file is shared
+				o := beginOp()
+				ret := sharerUpload(o, sharer, sharerpath, body)
+				if ret != "" {
+					o.rollback()
+					return ret
+				}
+				if o.commit() != nil {
+					return "Couldn't upload :("
 				}
+				return ""
 	       }else{
 		       return "Path does not exist on the server!"
 	       }
+}
 
 
-       return ""
-
-
+// Takes in the absolute path a user is uploading to and works out whose file the upload goes to:
+// the user's own unless it is a file shared with them or in a directory shared with them, in which
+// case it goes to the sharer's tree, provided they are allowed to write to it. Returns the owner
+// and the absolute path of the file in the owner's tree, or an error message.
+func uploadTarget(storepath string, username string) (string, string, string) {
+	sharer, sharerpath, perms, ok := resolveShare(storepath, username)
+	if !ok {
+		return username, storepath, ""
+	}
+	if(perms==0){
+		return "", "", "Permission Denied"
+	}
+	if fi, err := os.Lstat(sharerpath); err == nil && fi.IsDir() {
+		return "", "", "That is a shared directory!"
+	}
+	return sharer, sharerpath, ""
 }
 
-
 // Allows a user with access to a file at path relative to server to download the file given a valied cookie.
 func downloadHandler(path, username, cookie string) internal.DownloadReturn {
 	if(checkCookie(username, cookie)==false){
@@ -913,17 +1123,20 @@ func downloadHandler(path, username, cookie string) internal.DownloadReturn {
 		       if err != nil {
 			       return internal.DownloadReturn{Err: err.Error()}
 		       }
+	       if shareLapsed(abspath, username) {
+		       return internal.DownloadReturn{Err: "That share has expired"}
+	       }
 	       filedata, err := os.Lstat(abspath)
 		       if err != nil {
 			       return internal.DownloadReturn{Err: err.Error()}
 		       }  
 
-	       if filedata.Mode()&os.ModeSymlink != 0 {
-		       newpath, err := os.Readlink(abspath)
+	       if filedata.Mode()&os.ModeSymlink != 0 && !isDirLink(abspath) {
+		       key, err := linkKey(abspath)
 			       if err != nil {
 				       return internal.DownloadReturn{Err: err.Error()}
-			       }  
-		       body, err := ioutil.ReadFile(newpath)
+			       }
+		       body, err := readFile(key)
 			       if err != nil {
 				       return internal.DownloadReturn{Err: err.Error()}
 			       }   
@@ -949,14 +1162,17 @@ func listHandler(path, username, cookie string) internal.ListReturn {
 
 	allow := checkpath(path, username)
 	if(allow==true){
-		fis, err := ioutil.ReadDir(path)
+		dir, err := filepath.Abs(path)
+		if err != nil {
+			return internal.ListReturn{Err: err.Error()}
+		}
+		fis, err := ioutil.ReadDir(dir)
 		if err != nil {
 			return internal.ListReturn{Err: err.Error()}
 		}
 		var entries []internal.DirEnt
 		for _, fi := range fis {
-			entries = append(entries, internal.DirEnt{
-			IsDir_: fi.IsDir(), Name_:  fi.Name(),})
+			entries = append(entries, direntOf(filepath.Join(dir, fi.Name()), username, fi))
 		}
 		return internal.ListReturn{Entries: entries}
 	}else{
@@ -965,13 +1181,24 @@ func listHandler(path, username, cookie string) internal.ListReturn {
 }
 
 // Given a valid path at which a directory doesn't already exist, creates a dir. The path is sent from client side.
+// Inside a directory shared with the user the dir is made in the sharer's tree, if they are allowed to write to it.
 func mkdirHandler(path string, username string, cookie string) string {
 	if(checkCookie(username, cookie)==false){
 		return "reauth"
 	}
 	allow := checkpath(path, username)
 	if(allow==true){
-		err := os.Mkdir(path, 0775)
+		abspath, err := filepath.Abs(path)
+		if err != nil {
+			return err.Error()
+		}
+		if _, sharerpath, perm, ok := resolveShare(abspath, username); ok {
+			if perm == 0 {
+				return "Permission Denied"
+			}
+			abspath = sharerpath
+		}
+		err = os.Mkdir(abspath, 0775)
 	    if err != nil {
 		     return err.Error()
 	    }
@@ -985,6 +1212,22 @@ func mkdirHandler(path string, username string, cookie string) string {
 // Takes in a path relative to the server and a username. Checks if the path is accessible to the user and is a file or
 // an empty directory and removes it from the different parts of the server (database that stores the files etc)
 func remove(path string, username string) string {
+	o := beginOp()
+	ret := removeFile(o, path, username)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't remove :("
+	}
+	return ""
+}
+
+// Does the work of remove as part of o, leaving it to the caller to commit or roll back.
+// Nothing is deleted: the file or empty directory is moved to the user's trash along with
+// everything that refers to it.
+func removeFile(o *op, path string, username string) string {
 
 	allow := checkpath(path, username)
 
@@ -1003,74 +1246,18 @@ func remove(path string, username string) string {
 		       }  
 	       // If that path is a legitimate symbolic link in their directory
 	       if filedata.Mode()&os.ModeSymlink != 0 {
-		       // Get the file the path links to
-		       newpath, err := os.Readlink(abspath)
-			       if err != nil {
-				       return err.Error()
-			       }  
-		       err = os.Remove(abspath)
-			       if err != nil {
-				       return err.Error()
-			       }   
-					       // Get the name of the origin file and the number of users who have access to the file before deletion
-				parts := strings.Split(newpath, "/")
-				   origin_name := parts[len(parts) - 1]
-				   stmt, err := db.Prepare("SELECT numowners FROM filedata WHERE filename=?")
-				   if err != nil {
-				       fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-					       os.Exit(1)
-				   }
-				var curr_num int
-				   err = stmt.QueryRow(origin_name).Scan(&curr_num)
-
-				   new_num := curr_num - 1
-
-				   if new_num > 0 {
-				       stmt, err = db.Prepare("UPDATE filedata SET numowners=? WHERE filename=?")
-					       if err != nil {
-						       fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-							       os.Exit(1)
-					       }
-				       result, err := stmt.Exec(new_num, origin_name)
-					       if err != nil {
-						       fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-							       os.Exit(1)
-					       }
-				       _, err = result.RowsAffected()
-					       if err != nil {
-						       fmt.Fprintf(os.Stderr, "could not access affected parts of database: %v\n", err)
-							       os.Exit(1)
-					       }
-
-				   } else {
-				       err = os.Remove(newpath)
-					       if err != nil {
-						       return err.Error()
-					       }
-				       stmt, err = db.Prepare("DELETE FROM filedata WHERE filename=?")
-					       if err != nil {
-						       fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-							       os.Exit(1)
-					       }
-				       _, err := stmt.Exec(origin_name)
-					       if err != nil {
-						       fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-							       os.Exit(1)
-					       }
-
-				   }
-
-				return ""
+				return trashPath(o, username, abspath)
 	        } else {
 		       notallow,err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
 			       if err != nil {
 				       return err.Error()
 			       }
 		       if(abspath!=notallow){
-			       err = os.Remove(abspath)
-				       if err != nil {
+			       entries, err := ioutil.ReadDir(abspath)
+				       if err != nil || len(entries) > 0 {
 					       return "That directory isn't empty!\n"
-				       }	
+				       }
+			       return trashPath(o, username, abspath)
 		       }else{
 			       return "You can't remove your Shared directory!\n"
 		       }
@@ -1099,92 +1286,364 @@ func removeHandler(path string, username string, cookie string) string {
 				       return ""
 		       }
 
-	       if _, err := os.Stat(fullpath); os.IsNotExist(err) {
+	       if _, err := os.Lstat(fullpath); os.IsNotExist(err) {
 		       return "That resource doesn't exist!\n"
 	       }
 
 	shared := isSharedFile(fullpath)
 
 	if shared == "" {
+		if sharer, sharerpath, perm, ok := resolveShare(fullpath, username); ok {
+			// something inside a directory shared with the user goes from the sharer's tree
+			if perm == 0 {
+				return "Permission Denied"
+			}
+			return remove(sharerpath, sharer)
+		}
 		return remove(path, username)
-	} else{
-		if shared == "sharee" {
-			err = os.Remove(fullpath)
-				if err != nil {
-					return err.Error()
-				}  
-			stmt, err := db.Prepare("DELETE FROM sharedata WHERE sharee=? AND shareepath=?")
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-						os.Exit(1)
-				}
-			_, err = stmt.Exec(username, fullpath)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
-						os.Exit(1)
-				} 
+	}
+	if shared == "sharee" {
+		var group string
+		err = db.QueryRow("SELECT grp FROM sharedata WHERE sharee=? AND shareepath=?", username, fullpath).Scan(&group)
+		if err == nil && group != "" {
+			return "That is shared with @" + group + "; leave the group to get rid of it\n"
+		}
+	}
 
+	// The links and share records all go in one transaction along with the file itself
+	o := beginOp()
+	ret := ""
+	if shared == "sharee" {
+		var sharer string
+		err = o.tx.QueryRow("SELECT sharer FROM sharedata WHERE sharee=? AND shareepath=?", username, fullpath).Scan(&sharer)
+		if err != nil {
+			o.fatal("could not make query", err)
+		}
+		err = o.removeLink(fullpath)
+		if err != nil {
+			ret = err.Error()
 		} else {
-			stmt, err := db.Prepare("SELECT shareepath FROM sharedata where sharer=? AND origpath=?")
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-						os.Exit(1)
-				}
-			rows, err := stmt.Query(username, fullpath)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
-						os.Exit(1)
-				}
-			var sharee_list []string
-				defer rows.Close()
-				for rows.Next() {
-					var shareepath string
-						err = rows.Scan(&shareepath)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
-								os.Exit(1)
-						}
-
-
-					sharee_list = append(sharee_list, shareepath)
-				}
+			_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharee=? AND shareepath=?", username, fullpath)
+			if err != nil {
+				o.fatal("could not update database", err)
+			}
+			// what they shared onward goes with it
+			ret = pruneReshares(o, sharer)
+		}
+	} else {
+		// the shares go to the trash along with the file
+		ret = removeFile(o, path, username)
+	}
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't remove :("
+	}
+	return ""
 
-			stmt, err = db.Prepare("DELETE FROM sharedata where sharer=? AND origpath=? AND shareepath=?")
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "could not make prepared statement: %v\n", err)
-						os.Exit(1)
-				}
-			defer rows.Close()
+	} else {
+		return "This isn't something in your directory!"
+	}
+}
 
-				size := len(sharee_list)
-				for i := 0; i < size; i += 1 {
-			shareepath := sharee_list[i]
+// Takes in a path relative to the server, a username and a cookie and removes the file or
+// directory at path along with everything under it. Like any other removal the whole tree goes
+// to the user's trash in a single operation, taking the shares of everything in it with it, so
+// either all of it is removed or none of it is. Directories inside one shared with the user go to
+// the sharer's trash instead. Returns how much was removed.
+func removeAllHandler(path string, username string, cookie string) internal.RemoveReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.RemoveReturn{Err: "reauth"}
+	}
+	if !checkpath(path, username) {
+		return internal.RemoveReturn{Err: "This isn't something in your directory!"}
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return internal.RemoveReturn{Err: err.Error()}
+	}
+	fi, err := os.Lstat(abspath)
+	if os.IsNotExist(err) {
+		return internal.RemoveReturn{Err: "That resource doesn't exist!\n"}
+	}
+	if err != nil {
+		return internal.RemoveReturn{Err: err.Error()}
+	}
+	if !fi.IsDir() {
+		// a single file is removed as usual
+		ret := removeHandler(path, username, cookie)
+		if ret != "" {
+			return internal.RemoveReturn{Err: ret}
+		}
+		return internal.RemoveReturn{Files: 1}
+	}
 
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return internal.RemoveReturn{Err: "Error finding path..."}
+	}
+	shared := filepath.Join(root, "Shared_with_me")
+	if abspath == root {
+		return internal.RemoveReturn{Err: "You can't remove your whole directory!\n"}
+	}
+	owner := username
+	if abspath == shared || strings.HasPrefix(abspath, shared+"/") {
+		// the only directories in there are inside directories shared with the user
+		sharer, sharerpath, perm, ok := resolveShare(abspath, username)
+		if !ok {
+			return internal.RemoveReturn{Err: "You can't remove your Shared directory!\n"}
+		}
+		if perm == 0 {
+			return internal.RemoveReturn{Err: "Permission Denied"}
+		}
+		owner, abspath = sharer, sharerpath
+	}
 
-		    err = os.Remove(shareepath)
-		    if err != nil {
-			    fmt.Println(err)
-				    return "Could not unshare with someone"
-		    }	
-			_, err = stmt.Exec(username, fullpath, shareepath)
-		    if err != nil {
-			    fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
-				    os.Exit(1)
-		    }
+	var ret internal.RemoveReturn
+	err = filepath.Walk(abspath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			ret.Dirs++
+		} else {
+			ret.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return internal.RemoveReturn{Err: "Couldn't remove :("}
+	}
 
-				}
-			return remove(path, username)
+	o := beginOp()
+	err = o.tx.QueryRow("SELECT count(*) FROM sharedata WHERE sharer=? AND grp='' AND (origpath=? OR origpath GLOB ?)", owner, abspath, underPath(abspath)).Scan(&ret.Shares)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	errmsg := trashPath(o, owner, abspath)
+	if errmsg != "" {
+		o.rollback()
+		return internal.RemoveReturn{Err: errmsg}
+	}
+	if o.commit() != nil {
+		return internal.RemoveReturn{Err: "Couldn't remove :("}
+	}
+	return ret
+}
 
-			}
+// Takes in two paths relative to the server, a username and a cookie and moves the file or
+// directory at from to to, or into to if that is a directory. Everything that refers to the moved
+// files by path, their shares and versions, is moved along with them, so sharees keep their
+// access. Sharees can rename what is shared with them within Shared_with_me, but nothing can be
+// moved into or out of it, or around inside shared directories. Returns a string with an error if
+// need be.
+func moveHandler(from string, to string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if !checkpath(from, username) || !checkpath(to, username) {
+		return "You can't go outside of your directory!\n"
+	}
+	src, err := filepath.Abs(from)
+	if err != nil {
+		return err.Error()
+	}
+	dst, err := filepath.Abs(to)
+	if err != nil {
+		return err.Error()
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return "That resource doesn't exist!\n"
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "Something is already there!\n"
+	}
+	if fi, err := os.Stat(filepath.Dir(dst)); err != nil || !fi.IsDir() {
+		return "There is no such directory to move it to!\n"
+	}
 
-		}   
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return "Error finding path..."
+	}
+	shared := filepath.Join(root, "Shared_with_me")
+	if src == root || src == shared {
+		return "You can't move that directory!\n"
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return "You can't move a directory into itself!\n"
+	}
+	srcShared := strings.HasPrefix(src, shared+"/")
+	dstShared := dst == shared || strings.HasPrefix(dst, shared+"/")
+	if srcShared != dstShared {
+		return "You can't move things into or out of Shared_with_me!\n"
+	}
+	if srcShared && (filepath.Dir(src) != shared || filepath.Dir(dst) != shared) {
+		return "You can't move things inside a directory shared with you!\n"
+	}
 
+	o := beginOp()
+	err = o.rename(src, dst)
+	if err != nil {
+		o.rollback()
+		return "Couldn't move :("
+	}
+	if srcShared {
+		_, err = o.tx.Exec("UPDATE sharedata SET shareepath=? WHERE sharee=? AND shareepath=?", dst, username, src)
 	} else {
-		return "This isn't something in your directory!"
+		_, err = o.tx.Exec("UPDATE sharedata SET origpath=? || substr(origpath, ?) WHERE sharer=? AND (origpath=? OR origpath GLOB ?)", dst, utf8.RuneCountInString(src)+1, username, src, underPath(src))
 	}
-    return ""
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	if !srcShared {
+		moveVersions(o, username, src, dst)
+		moveLinks(o, username, src, dst)
+		moveInvites(o, username, src, dst)
+		moveReshares(o, username, src, dst)
+		// what was re-shared through a share of a directory it was moved out of goes
+		ret := relinkDirShares(o, username, dst)
+		if ret == "" {
+			ret = pruneReshares(o, username)
+		}
+		if ret != "" {
+			o.rollback()
+			return ret
+		}
+	}
+	if o.commit() != nil {
+		return "Couldn't move :("
+	}
+	return ""
 }
 
+// Takes in two paths relative to the server, whether to copy directories, a username and a cookie
+// and copies the file at from to to, or into to if that is a directory. With recursive set
+// directories are copied along with everything in them. No file contents are read or written:
+// every copy is just another link to the file that is already stored, owned by the user. Files
+// and directories shared with the user can be copied out of Shared_with_me into their own tree,
+// but nothing can be copied into it. Returns a string with an error if need be.
+func copyHandler(from string, to string, recursive bool, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if !checkpath(from, username) || !checkpath(to, username) {
+		return "You can't go outside of your directory!\n"
+	}
+	src, err := filepath.Abs(from)
+	if err != nil {
+		return err.Error()
+	}
+	dst, err := filepath.Abs(to)
+	if err != nil {
+		return err.Error()
+	}
+	if shareLapsed(src, username) {
+		return "That share has expired\n"
+	}
+	// What is shared with the user is copied from the sharer's tree, where shared directories are
+	// directories rather than links to them
+	walkroot := src
+	if _, sharerpath, _, ok := resolveShare(src, username); ok {
+		walkroot = sharerpath
+	}
+	srcinfo, err := os.Lstat(walkroot)
+	if err != nil {
+		return "That resource doesn't exist!\n"
+	}
+	if srcinfo.IsDir() && !recursive {
+		return "That is a directory; use cp -r to copy it\n"
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	if fi, err := os.Lstat(dst); err == nil && (srcinfo.IsDir() || fi.IsDir()) {
+		return "Something is already there!\n"
+	}
+	if fi, err := os.Stat(filepath.Dir(dst)); err != nil || !fi.IsDir() {
+		return "There is no such directory to copy it to!\n"
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return "You can't copy something onto or into itself!\n"
+	}
+	shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	if err != nil {
+		return "Error finding path..."
+	}
+	if dst == shared || strings.HasPrefix(dst, shared+"/") {
+		return "You cannot copy anything into Shared_with_me"
+	}
+
+	// Work out everything to copy first, so the quota can be checked for all of it at once
+	type entry struct {
+		path string
+		dir  bool
+	}
+	var entries []entry
+	var size int64
+	dirlinks := false
+	err = filepath.Walk(walkroot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			entries = append(entries, entry{path, true})
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			if isDirLink(path) {
+				dirlinks = true
+				return nil
+			}
+			entries = append(entries, entry{path, false})
+			size += linkSize(db, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "Couldn't copy :("
+	}
+	if dirlinks {
+		return "Directories shared with you have to be copied one at a time\n"
+	}
+
+	o := beginOp()
+	ret := checkQuota(o.tx, username, dst, size)
+	for _, e := range entries {
+		if ret != "" {
+			break
+		}
+		target := dst + strings.TrimPrefix(e.path, walkroot)
+		if e.dir {
+			err = o.mkdir(target, 0775)
+			if err != nil {
+				ret = "Couldn't copy :("
+			}
+			continue
+		}
+		key, err := linkKey(e.path)
+		if err != nil {
+			ret = "Couldn't copy :("
+			continue
+		}
+		ret = linkFile(o, target, username, key)
+		if ret == "" && !srcinfo.IsDir() {
+			// copying over a file the user shares updates it for the sharees too
+			ret = relinkSharees(o, username, target)
+		}
+	}
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't copy :("
+	}
+	return ""
+}
 
 // This is called but only to check if reauthorization is required, however the client's root file system data is stored on client side
 func pwdHandler(username string, cookie string) internal.PWDReturn {
@@ -1239,10 +1698,11 @@ func cdHandler(path string, username string, cookie string) string {
        return ""
 }
 
-// Updates the filecount file which keeps track of the number of deduplicated files ever created so each of them can 
-// have a unique name. 
-
+// Called when the server is shut down. Blobs are named after their content, so there is no
+// state left to save here; everything else already lives in the database.
 func finalizer() {
-	ioutil.WriteFile("./filecount.txt", []byte(strconv.Itoa(filecount)), 0664)
+	// wait for anything running in the background, which never gets the lock back
+	serverMtx.Lock()
+	db.Close()
 		fmt.Println("Shutting down...")
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// test that moving a directory takes the shares, versions and quota charges of the files under
+// it along, that sharees can rename what is shared with them, and that moves that make no sense
+// are refused
+func TestMove(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d", "userfs/ann/e", "userfs/bob/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+	for _, body := range []string{"old", "new"} {
+		if ret := uploadHandler("userfs/ann/d/one", "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploading %q: %v", body, ret)
+		}
+	}
+	if ret := shareHandler("userfs/ann/d/one", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+
+	used, err := quotaUsage(db, "ann")
+	if err != nil {
+		t.Fatalf("quotaUsage: %v", err)
+	}
+
+	refused := []struct{ from, to string }{
+		{"userfs/ann/d", "userfs/ann/d/x"},
+		{"userfs/ann/d", "userfs/ann/Shared_with_me"},
+		{"userfs/ann/Shared_with_me", "userfs/ann/x"},
+		{"userfs/ann/nothing", "userfs/ann/x"},
+		{"userfs/ann/d/one", "userfs/ann/nowhere/one"},
+		{"userfs/ann/d", "userfs/bob/d"},
+	}
+	for _, tt := range refused {
+		if ret := moveHandler(tt.from, tt.to, "ann", ann); ret == "" {
+			t.Fatalf("moveHandler(%v, %v): got no error; want it refused", tt.from, tt.to)
+		}
+	}
+
+	// moving into a directory keeps the name
+	if ret := moveHandler("userfs/ann/d", "userfs/ann/e", "ann", ann); ret != "" {
+		t.Fatalf("moveHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/ann/e/d/one", "ann", ann); got.Err != "" || string(got.Body) != "new" {
+		t.Fatalf("downloading the moved file: got %q, %v; want %q", got.Body, got.Err, "new")
+	}
+	if got := historyHandler("userfs/ann/e/d/one", "ann", ann); got.Err != "" || len(got.Versions) != 1 {
+		t.Fatalf("history of the moved file: got %+v; want its one version", got)
+	}
+	if ret := moveHandler("userfs/ann/e/d/one", "userfs/ann/e/d/two", "ann", ann); ret != "" {
+		t.Fatalf("moveHandler: %v", ret)
+	}
+	if ret := moveHandler("userfs/bob/Shared_with_me/one", "userfs/bob/Shared_with_me/mine", "bob", bob); ret != "" {
+		t.Fatalf("bob renaming: %v", ret)
+	}
+	if u, err := quotaUsage(db, "ann"); err != nil || u != used {
+		t.Fatalf("after moving: ann uses %v, %v; want %v as before", u, err, used)
+	}
+	if ret := uploadHandler("userfs/ann/e/d/two", "ann", []byte("newer"), ann); ret != "" {
+		t.Fatalf("uploading after moving: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/mine", "bob", bob); got.Err != "" || string(got.Body) != "newer" {
+		t.Fatalf("bob downloading after both moves: got %q, %v; want %q", got.Body, got.Err, "newer")
+	}
+}
+
+// test that copying links to what is already stored, charging the copies to the user copying them,
+// that copying over a shared file updates it for its sharees, and that copies past the quota or
+// into Shared_with_me are refused
+func TestCopy(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d/sub", "userfs/bob/Shared_with_me")()
+	defer setVersions(0)()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+	for path, body := range map[string]string{"userfs/ann/d/one": "one", "userfs/ann/d/sub/two": "two!", "userfs/ann/mine": "mine"} {
+		if ret := uploadHandler(path, "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", path, ret)
+		}
+	}
+	if ret := shareHandler("userfs/ann/mine", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+	usage := func(when, user string, want int64) {
+		if u, err := quotaUsage(db, user); err != nil || u != want {
+			t.Fatalf("%v: %v uses %v, %v; want %v", when, user, u, err, want)
+		}
+	}
+
+	refused := []struct {
+		from, to  string
+		recursive bool
+	}{
+		{"userfs/ann/d", "userfs/ann/e", false},
+		{"userfs/ann/d", "userfs/ann/d/sub", true},
+		{"userfs/ann/d", "userfs/ann/Shared_with_me", true},
+		{"userfs/ann/d/one", "userfs/ann/Shared_with_me/one", false},
+		{"userfs/ann/nothing", "userfs/ann/x", false},
+		{"userfs/ann/d/one", "userfs/ann/nowhere/one", false},
+		{"userfs/ann/d", "userfs/bob/d", true},
+	}
+	for _, tt := range refused {
+		if ret := copyHandler(tt.from, tt.to, tt.recursive, "ann", ann); ret == "" {
+			t.Fatalf("copyHandler(%v, %v, %v): got no error; want it refused", tt.from, tt.to, tt.recursive)
+		}
+	}
+
+	if ret := copyHandler("userfs/ann/d", "userfs/ann/e", true, "ann", ann); ret != "" {
+		t.Fatalf("copyHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/ann/e/sub/two", "ann", ann); got.Err != "" || string(got.Body) != "two!" {
+		t.Fatalf("downloading the copy: got %q, %v; want %q", got.Body, got.Err, "two!")
+	}
+	usage("after copying d", "ann", 2*(3+4)+4)
+	if counts := refcounts(t); counts[contentKey([]byte("one"))] != 2 || counts[contentKey([]byte("two!"))] != 2 {
+		t.Fatalf("after copying d: got refcounts %v; want 2 for each file copied", counts)
+	}
+
+	// copying over the shared file reaches bob, and bob copying it out is charged to bob
+	if ret := copyHandler("userfs/ann/d/one", "userfs/ann/mine", false, "ann", ann); ret != "" {
+		t.Fatalf("copying over a shared file: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/mine", "bob", bob); got.Err != "" || string(got.Body) != "one" {
+		t.Fatalf("bob downloading what ann copied over: got %q, %v; want %q", got.Body, got.Err, "one")
+	}
+	if ret := copyHandler("userfs/bob/Shared_with_me/mine", "userfs/bob", false, "bob", bob); ret != "" {
+		t.Fatalf("bob copying out of Shared_with_me: %v", ret)
+	}
+	usage("after bob copied", "bob", 3)
+
+	_, err := db.Exec("INSERT INTO quotadata(username, quota) values(?,?)", "ann", 20)
+	if err != nil {
+		t.Fatalf("could not set quota: %v", err)
+	}
+	usage("before going over the quota", "ann", 2*(3+4)+3)
+	if ret := copyHandler("userfs/ann/d", "userfs/ann/f", true, "ann", ann); ret == "" {
+		t.Fatalf("copying past the quota: got no error")
+	}
+	if _, err := os.Lstat("userfs/ann/f"); !os.IsNotExist(err) {
+		t.Fatalf("userfs/ann/f after the copy was refused: got %v; want nothing", err)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// A shared file shows up in the sharee's Shared_with_me as a link to the same file as the
+// sharer's link, and is relinked whenever the sharer's file changes. A shared directory shows up
+// there as a symlink to the sharer's directory itself, so the sharee sees whatever is in it at the
+// time, including anything added after it was shared. The directory's share applies to
+// everything under it: sharees with write access can upload, make directories and remove things
+// anywhere inside it, and all of that is done to the sharer's tree as if the sharer had done it,
+// so it is charged to the sharer's quota and removals go to the sharer's trash. Nothing inside a
+// shared directory can be moved by its sharees, since that would take it out of the sharer's tree.
+//
+// Directory links hold the absolute path of the directory rather than a key, so whenever the
+// sharer moves the directory, or restores it from the trash, the links are made again.
+//
+// A share can be made to last for a while only, in which case expires holds when it runs out.
+// Expired shares stop giving access to anything straight away: findShare ignores them, and reading
+// a file through a link one left behind is refused by shareLapsed. shareExpiryLoop removes them
+// and their links within a minute. A share that expires while it is in the trash isn't given
+// back when it is restored.
+//
+// Sharees given rws can share onward what is shared with them, with anyone but its owner and with
+// any permissions. Such a re-share is kept in sharedata as a share from the owner like any other,
+// but records in parent who shared it onward and in parentpath the original path of what their own
+// share is of, which is what the re-share is of or a directory above it. Re-shares only last as
+// long as the share they were made through allows them: whenever a share is taken away, loses rws
+// or stops covering what was re-shared through it, pruneReshares takes away everything that was
+// re-shared through it, and everything re-shared through those in turn.
+
+// Takes in the path of a link in a user's tree and returns whether it is a sharee's link to a
+// shared directory rather than a link to a file. Only links to directories hold an absolute path
+// into userfs; links to files hold a key, or the absolute path of a blob in the filestore for old
+// ones, so what they point at is never looked at, since a directory named like a key could be.
+func isDirLink(path string) bool {
+	target, err := os.Readlink(path)
+	if err != nil || !filepath.IsAbs(target) {
+		return false
+	}
+	userfs, err := filepath.Abs("./userfs")
+	return err == nil && strings.HasPrefix(target, userfs+"/")
+}
+
+// Takes in an absolute path in username's tree, already cleaned, and the absolute path of the
+// user's root, and returns whether it really is in their tree once symlinks are followed, or in
+// what the share it is inside of is of. A path can stay in the user's tree as written and still
+// lead out of it, since a shared directory is a symlink and the OS follows it before any ".."
+// after it.
+func realPathAllowed(abspath string, root string, username string) bool {
+	realroot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	// what the path is of may not exist yet, and links to files don't lead to anything that does,
+	// so for those the nearest directory above it that exists counts
+	dir := abspath
+	rest := ""
+	real, err := filepath.EvalSymlinks(dir)
+	for err != nil && dir != root && dir != "/" {
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = filepath.Dir(dir)
+		real, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return false
+	}
+	real = filepath.Join(real, rest)
+	if real == realroot || strings.HasPrefix(real, realroot+"/") {
+		return true
+	}
+	_, _, shareOrigpath, _, _, ok := findShare(abspath, username)
+	if !ok {
+		return false
+	}
+	realshare, err := filepath.EvalSymlinks(shareOrigpath)
+	if err != nil {
+		return false
+	}
+	return real == realshare || strings.HasPrefix(real, realshare+"/")
+}
+
+// Takes in the absolute path of something in username's Shared_with_me and works out what it is
+// in the tree of whoever shared it: either the path of a file or directory shared with the user,
+// or of something inside a directory shared with them. Returns the sharer, the absolute path in
+// the sharer's tree and the user's permissions on it, or false if it isn't shared with them.
+func resolveShare(abspath string, username string) (string, string, int, bool) {
+	sharer, sharerpath, _, perm, _, ok := findShare(abspath, username)
+	return sharer, sharerpath, perm, ok
+}
+
+// Returns whether abspath is in username's Shared_with_me but no share gives them access to it any
+// more, as happens to the links of shares that have expired until shareExpiryLoop removes them.
+func shareLapsed(abspath string, username string) bool {
+	shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	if err != nil || !strings.HasPrefix(abspath, shared+"/") {
+		return false
+	}
+	_, _, _, ok := resolveShare(abspath, username)
+	return !ok
+}
+
+// Does the work of resolveShare, also returning the original path of what the share is of, which
+// is the path returned or a directory above it, and when the share expires, or 0 if it never does.
+// Shares that have expired are treated as gone.
+func findShare(abspath string, username string) (string, string, string, int, int64, bool) {
+	shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	if err != nil {
+		return "", "", "", 0, 0, false
+	}
+	for p := abspath; strings.HasPrefix(p, shared+"/"); p = filepath.Dir(p) {
+		var sharer, origpath string
+		var perm int
+		var expires int64
+		err = db.QueryRow("SELECT sharer, origpath, perm, expires FROM sharedata WHERE sharee=? AND shareepath=? AND (expires=0 OR expires>?)", username, p, time.Now().Unix()).Scan(&sharer, &origpath, &perm, &expires)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+			os.Exit(1)
+		}
+		return sharer, origpath + strings.TrimPrefix(abspath, p), origpath, perm, expires, true
+	}
+	return "", "", "", 0, 0, false
+}
+
+// Returns when a share made now to last for ttl seconds expires, or 0 if ttl is 0 and it lasts
+// until it is unshared.
+func shareExpiry(ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Unix() + ttl
+}
+
+// Removes every share and invitation that has expired, along with the sharee's link. Each share is
+// removed in an op of its own, so one that can't be removed doesn't hold up the rest. What members
+// got through an expired share with a group is taken away from them, sharees who still get
+// something through a group keep it, and what was re-shared through an expired share goes too.
+func expireShares() {
+	type share struct{ sharer, sharee, origpath, shareepath string }
+	rows, err := db.Query("SELECT sharer, sharee, origpath, shareepath FROM sharedata WHERE grp='' AND expires!=0 AND expires<=?", time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var shares []share
+	for rows.Next() {
+		var sh share
+		err = rows.Scan(&sh.sharer, &sh.sharee, &sh.origpath, &sh.shareepath)
+		if err != nil {
+			rows.Close()
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		shares = append(shares, sh)
+	}
+	rows.Close()
+
+	// invitations to expired shares can't be accepted any more either
+	_, err = db.Exec("DELETE FROM invitedata WHERE expires!=0 AND expires<=?", time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, sh := range shares {
+		o := beginOp()
+		if sh.shareepath != "" {
+			err = o.removeLink(sh.shareepath)
+			if err != nil && !os.IsNotExist(err) {
+				o.rollback()
+				fmt.Fprintf(os.Stderr, "could not remove expired share of %v with %v\n", sh.origpath, sh.sharee)
+				continue
+			}
+		}
+		_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", sh.sharer, sh.sharee, sh.origpath)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		var ret string
+		if strings.HasPrefix(sh.sharee, "@") {
+			ret = syncMembers(o, groupMembers(o.tx, sh.sharee[1:]))
+		} else {
+			ret = syncGroupShares(o, sh.sharee)
+		}
+		if ret == "" {
+			ret = pruneReshares(o, sh.sharer)
+		}
+		if ret != "" {
+			o.rollback()
+			fmt.Fprintf(os.Stderr, "could not remove expired share of %v with %v\n", sh.origpath, sh.sharee)
+			continue
+		}
+		o.commit()
+	}
+}
+
+// Removes expired shares in the background, checking once a minute.
+func shareExpiryLoop() {
+	for {
+		runLocked(expireShares)
+		time.Sleep(time.Minute)
+	}
+}
+
+// Makes the sharees' links to every directory sharer shares at or under abspath point at where
+// the directory now is, as part of o.
+func relinkDirShares(o *op, sharer string, abspath string) string {
+	rows, err := o.tx.Query("SELECT origpath, shareepath FROM sharedata WHERE sharer=? AND shareepath!='' AND (origpath=? OR origpath GLOB ?)", sharer, abspath, underPath(abspath))
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	type link struct{ origpath, shareepath string }
+	var links []link
+	for rows.Next() {
+		var l link
+		err = rows.Scan(&l.origpath, &l.shareepath)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+
+	for _, l := range links {
+		if fi, err := os.Lstat(l.origpath); err != nil || !fi.IsDir() {
+			continue
+		}
+		err = o.removeLink(l.shareepath)
+		if err != nil && !os.IsNotExist(err) {
+			return "Error removing from sharee"
+		}
+		err = o.symlink(l.origpath, l.shareepath)
+		if err != nil {
+			return "Error relinking for sharee"
+		}
+	}
+	return ""
+}
+
+// Takes in a path relative to the server, or "" for everything, a user to filter by, or "" for
+// everyone, a username and a cookie and returns what the user shares with others and what others
+// share with them, from sharedata. Only shares of what is at or under path are returned, and only
+// shares with or from who, which can also be a group given as "@" and its name.
+func sharesHandler(path string, who string, username string, cookie string) internal.SharesReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.SharesReturn{Err: "reauth"}
+	}
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return internal.SharesReturn{Err: "Error finding path..."}
+	}
+	// GLOB matches everything when there is no path to filter by
+	under, at := "*", ""
+	if path != "" {
+		if !checkpath(path, username) {
+			return internal.SharesReturn{Err: "You can't go outside of your directory!\n"}
+		}
+		at, err = filepath.Abs(path)
+		if err != nil {
+			return internal.SharesReturn{Err: err.Error()}
+		}
+		under = underPath(at)
+	}
+
+	var ret internal.SharesReturn
+	// what members get through a group is shown as the share with the group, invitations that
+	// haven't been accepted yet along with the shares, and what the user shared onward where it is
+	// in their Shared_with_me
+	now := time.Now().Unix()
+	rows, err := db.Query("SELECT path, sharee, perm, expires, pending, via FROM ("+
+		"SELECT origpath AS path, sharee, perm, expires, 0 AS pending, parent AS via FROM sharedata WHERE sharer=? AND grp='' "+
+		"UNION ALL SELECT origpath, sharee, perm, expires, 1, parent FROM invitedata WHERE sharer=? AND transfer=0 AND grp='' "+
+		"UNION ALL SELECT p.shareepath || substr(c.origpath, length(c.parentpath)+1), c.sharee, c.perm, c.expires, 0, '' FROM sharedata c JOIN sharedata p ON p.sharer=c.sharer AND p.sharee=c.parent AND p.origpath=c.parentpath WHERE c.parent=? "+
+		"UNION ALL SELECT p.shareepath || substr(c.origpath, length(c.parentpath)+1), c.sharee, c.perm, c.expires, 1, '' FROM invitedata c JOIN sharedata p ON p.sharer=c.sharer AND p.sharee=c.parent AND p.origpath=c.parentpath WHERE c.parent=?"+
+		") WHERE (?='' OR sharee=?) AND (path=? OR path GLOB ?) AND (expires=0 OR expires>?) ORDER BY path, sharee", username, username, username, username, who, who, at, under, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	for rows.Next() {
+		var e internal.OutShareEnt
+		var origpath string
+		var perm int
+		err = rows.Scan(&origpath, &e.Sharee, &perm, &e.Expires, &e.Pending, &e.Via)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		e.Path = strings.TrimPrefix(origpath, root)
+		e.Perm = permString(perm)
+		ret.Out = append(ret.Out, e)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT shareepath, sharer, origpath, perm, grp, expires, parent FROM sharedata WHERE sharee=? AND (?='' OR sharer=? OR '@'||grp=?) AND (shareepath=? OR shareepath GLOB ?) AND (expires=0 OR expires>?) ORDER BY shareepath", username, who, who, who, at, under, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	for rows.Next() {
+		var e internal.InShareEnt
+		var shareepath, origpath string
+		var perm int
+		err = rows.Scan(&shareepath, &e.Sharer, &origpath, &perm, &e.Group, &e.Expires, &e.Via)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		e.Name = strings.TrimPrefix(shareepath, root)
+		e.Origname = filepath.Base(origpath)
+		e.Perm = permString(perm)
+		ret.In = append(ret.In, e)
+	}
+	rows.Close()
+	return ret
+}
+
+// Does the work of shareHandler when the user shares onward something at the absolute path
+// fullpath in their Shared_with_me, which they need rws on. The re-share can't last longer than
+// the user's own share.
+func reshare(fullpath string, sharee string, perm int, expires int64, username string) string {
+	sharer, origpath, parentpath, have, until, ok := findShare(fullpath, username)
+	if !ok || have < 2 {
+		return "Dude, you don't own this!"
+	}
+	if sharee == sharer {
+		return "They own it, silly!"
+	}
+	if until != 0 && (expires == 0 || expires > until) {
+		expires = until
+	}
+	var found int
+	err := db.QueryRow("SELECT count(1) FROM sharedata WHERE sharer=? AND sharee=? AND origpath=? AND grp=''", sharer, sharee, origpath).Scan(&found)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	if found > 0 {
+		return "This is already shared with this user!\n"
+	}
+
+	// they are asked whether they want it unless they accept everything from the user
+	if !autoAccepts(sharee, username) {
+		return inviteUser(origpath, sharee, perm, expires, sharer, username, parentpath)
+	}
+	o := beginOp()
+	ret := linkShare(o, sharer, sharee, origpath, "", perm, expires, username, parentpath)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Could not share!"
+	}
+	return ""
+}
+
+// Does the work of unshareHandler and chpermHandler for a share with sharee of something at the
+// absolute path fullpath in the user's Shared_with_me that they shared onward: with perm below zero
+// the share is taken away, and otherwise its permissions are changed to perm.
+func updateReshare(fullpath string, sharee string, perm int, username string) string {
+	sharer, origpath, _, _, _, ok := findShare(fullpath, username)
+	if !ok {
+		return "Dude, you don't own this!"
+	}
+	o := beginOp()
+	var shareepath string
+	err := o.tx.QueryRow("SELECT shareepath FROM sharedata WHERE sharer=? AND sharee=? AND origpath=? AND parent=?", sharer, sharee, origpath, username).Scan(&shareepath)
+	if err == sql.ErrNoRows {
+		// they may not have accepted it yet
+		var res sql.Result
+		if perm < 0 {
+			res, err = o.tx.Exec("DELETE FROM invitedata WHERE sharer=? AND sharee=? AND origpath=? AND parent=? AND transfer=0", sharer, sharee, origpath, username)
+		} else {
+			res, err = o.tx.Exec("UPDATE invitedata SET perm=? WHERE sharer=? AND sharee=? AND origpath=? AND parent=? AND transfer=0", perm, sharer, sharee, origpath, username)
+		}
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			o.rollback()
+			return "You have not shared this with the specified user.\n"
+		}
+	} else if err != nil {
+		o.fatal("could not make query", err)
+	} else if perm < 0 {
+		err = o.removeLink(shareepath)
+		if err != nil && !os.IsNotExist(err) {
+			o.rollback()
+			return err.Error()
+		}
+		_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", sharer, sharee, origpath)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+		// they may still have it through a group
+		ret := syncGroupShares(o, sharee)
+		if ret != "" {
+			o.rollback()
+			return ret
+		}
+	} else {
+		_, err = o.tx.Exec("UPDATE sharedata SET perm=? WHERE sharer=? AND sharee=? AND origpath=?", perm, sharer, sharee, origpath)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+	ret := pruneReshares(o, sharer)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Could not update the share!"
+	}
+	return ""
+}
+
+// What a re-share c in sharedata or invitedata has to meet to be allowed: the share it was made
+// through still has rws, and is of what c is of or a directory above it.
+const reshareAllowed = "EXISTS (SELECT 1 FROM sharedata p WHERE p.sharer=c.sharer AND p.sharee=c.parent AND p.origpath=c.parentpath AND p.perm>=2) AND (c.origpath=c.parentpath OR substr(c.origpath, 1, length(c.parentpath)+1)=c.parentpath||'/')"
+
+// Takes away every re-share of what sharer owns that the share it was made through no longer
+// allows, along with everything re-shared through it in turn and invitations to such re-shares,
+// as part of o.
+func pruneReshares(o *op, sharer string) string {
+	type share struct{ sharee, origpath, shareepath string }
+	for {
+		rows, err := o.tx.Query("SELECT c.sharee, c.origpath, c.shareepath FROM sharedata c WHERE c.sharer=? AND c.parent!='' AND NOT ("+reshareAllowed+")", sharer)
+		if err != nil {
+			o.fatal("could not access database", err)
+		}
+		var shares []share
+		for rows.Next() {
+			var sh share
+			err = rows.Scan(&sh.sharee, &sh.origpath, &sh.shareepath)
+			if err != nil {
+				rows.Close()
+				o.fatal("could not access database", err)
+			}
+			shares = append(shares, sh)
+		}
+		rows.Close()
+		if len(shares) == 0 {
+			break
+		}
+
+		// taking these away can leave more that aren't allowed, so go round again
+		for _, sh := range shares {
+			err = o.removeLink(sh.shareepath)
+			if err != nil && !os.IsNotExist(err) {
+				return "Could not unshare with someone"
+			}
+			_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", sharer, sh.sharee, sh.origpath)
+			if err != nil {
+				o.fatal("could not update database", err)
+			}
+			ret := syncGroupShares(o, sh.sharee)
+			if ret != "" {
+				return ret
+			}
+		}
+	}
+
+	_, err := o.tx.Exec("DELETE FROM invitedata WHERE id IN (SELECT c.id FROM invitedata c WHERE c.sharer=? AND c.parent!='' AND NOT ("+reshareAllowed+"))", sharer)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	return ""
+}
+
+// Makes the re-shares of what sharer owns that were made through shares of anything at or under
+// from record where it is now that it has been moved to to, as part of o.
+func moveReshares(o *op, sharer string, from string, to string) {
+	_, err := o.tx.Exec("UPDATE sharedata SET parentpath=? || substr(parentpath, ?) WHERE sharer=? AND parent!='' AND (parentpath=? OR parentpath GLOB ?)", to, utf8.RuneCountInString(from)+1, sharer, from, underPath(from))
+	if err == nil {
+		_, err = o.tx.Exec("UPDATE invitedata SET parentpath=? || substr(parentpath, ?) WHERE sharer=? AND parent!='' AND (parentpath=? OR parentpath GLOB ?)", to, utf8.RuneCountInString(from)+1, sharer, from, underPath(from))
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
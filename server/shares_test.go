@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// test that a shared directory is a live view of the sharer's directory for its sharees, that
+// what sharees with write access do in it is done to the sharer's tree and charged to the sharer,
+// that read-only sharees can't change it, and that the sharees' links follow it when it is moved
+func TestShareDir(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d/sub", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me")()
+	defer setVersions(0)()
+	ann, bob, cat := addTestUser(t, "ann"), addTestUser(t, "bob"), addTestUser(t, "cat")
+	autoAcceptFrom(t, "ann", "bob", "cat")
+	if ret := uploadHandler("userfs/ann/d/sub/one", "ann", []byte("one"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/d", "bob", "rw", "ann", ann); ret != "" {
+		t.Fatalf("sharing with bob: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/d", "cat", "r", "ann", ann); ret != "" {
+		t.Fatalf("sharing with cat: %v", ret)
+	}
+	if !isDirLink("userfs/bob/Shared_with_me/d") {
+		t.Fatalf("bob's link to d: isDirLink is false; want it to be a directory link")
+	}
+
+	// added after it was shared, and seen by the sharees straight away
+	if ret := uploadHandler("userfs/ann/d/two", "ann", []byte("two"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if isDirLink("userfs/ann/d/two") {
+		t.Fatalf("ann's link to two: isDirLink is true; want it to be a file link")
+	}
+	if got := downloadHandler("userfs/cat/Shared_with_me/d/two", "cat", cat); got.Err != "" || string(got.Body) != "two" {
+		t.Fatalf("cat downloading a file added later: got %q, %v; want %q", got.Body, got.Err, "two")
+	}
+
+	if ret := uploadHandler("userfs/bob/Shared_with_me/d/sub/three", "bob", []byte("three"), bob); ret != "" {
+		t.Fatalf("bob uploading into d: %v", ret)
+	}
+	if ret := mkdirHandler("userfs/bob/Shared_with_me/d/made", "bob", bob); ret != "" {
+		t.Fatalf("bob making a directory in d: %v", ret)
+	}
+	if got := downloadHandler("userfs/ann/d/sub/three", "ann", ann); got.Err != "" || string(got.Body) != "three" {
+		t.Fatalf("ann downloading what bob uploaded: got %q, %v; want %q", got.Body, got.Err, "three")
+	}
+	if list := listHandler("userfs/ann/d/made", "ann", ann); list.Err != "" {
+		t.Fatalf("listing the directory bob made: %v", list.Err)
+	}
+	for user, want := range map[string]int64{"ann": 3 + 3 + 5, "bob": 0} {
+		if u, err := quotaUsage(db, user); err != nil || u != want {
+			t.Fatalf("%v uses %v, %v; want %v", user, u, err, want)
+		}
+	}
+	if ret := removeHandler("userfs/bob/Shared_with_me/d/two", "bob", bob); ret != "" {
+		t.Fatalf("bob removing from d: %v", ret)
+	}
+	if entries := trashHandler("ann", ann); len(entries.Entries) != 1 || entries.Entries[0].Path != "/d/two" {
+		t.Fatalf("ann's trash: got %+v; want /d/two that bob removed", entries)
+	}
+
+	if ret := uploadHandler("userfs/cat/Shared_with_me/d/four", "cat", []byte("four"), cat); ret == "" {
+		t.Fatalf("cat uploading with read access only: got no error")
+	}
+	if ret := mkdirHandler("userfs/cat/Shared_with_me/d/mine", "cat", cat); ret == "" {
+		t.Fatalf("cat making a directory with read access only: got no error")
+	}
+	if ret := removeHandler("userfs/cat/Shared_with_me/d/sub/one", "cat", cat); ret == "" {
+		t.Fatalf("cat removing with read access only: got no error")
+	}
+	if ret := moveHandler("userfs/bob/Shared_with_me/d/sub", "userfs/bob/sub", "bob", bob); ret == "" {
+		t.Fatalf("bob moving something out of d: got no error")
+	}
+
+	// going up from inside the shared directory leads back to bob's own tree, not ann's
+	list := listHandler("userfs/bob/Shared_with_me/d/../..", "bob", bob)
+	if list.Err != "" || len(list.Entries) != 1 || list.Entries[0].Name_ != "Shared_with_me" {
+		t.Fatalf("listing up through d: got %+v; want bob's root", list)
+	}
+
+	if ret := moveHandler("userfs/ann/d", "userfs/ann/e", "ann", ann); ret != "" {
+		t.Fatalf("moveHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/d/sub/one", "bob", bob); got.Err != "" || string(got.Body) != "one" {
+		t.Fatalf("bob downloading after ann moved d: got %q, %v; want %q", got.Body, got.Err, "one")
+	}
+}
+
+// test that shares lists what the user shares and what is shared with them, shows what members
+// get through a group as the group's share, and filters by path and by user or group
+func TestShares(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me")()
+	ann, bob, cat := addTestUser(t, "ann"), addTestUser(t, "bob"), addTestUser(t, "cat")
+	autoAcceptFrom(t, "ann", "bob", "cat")
+	autoAcceptFrom(t, "bob", "ann")
+	cookies := map[string]string{"ann": ann, "bob": bob}
+	for path, user := range map[string]string{"userfs/ann/a": "ann", "userfs/ann/d/b": "ann", "userfs/bob/c": "bob"} {
+		if ret := uploadHandler(path, user, []byte(path), cookies[user]); ret != "" {
+			t.Fatalf("uploading %v: %v", path, ret)
+		}
+	}
+	ret := groupCreateHandler("team", "ann", ann)
+	if ret == "" {
+		ret = groupAddHandler("team", "cat", "ann", ann)
+	}
+	if ret != "" {
+		t.Fatalf("could not make the group: %v", ret)
+	}
+	shares := []struct{ path, sharee, perm, user, cookie string }{
+		{"userfs/ann/a", "bob", "r", "ann", ann},
+		{"userfs/ann/d/b", "bob", "rw", "ann", ann},
+		{"userfs/ann/d/b", "@team", "r", "ann", ann},
+		{"userfs/bob/c", "ann", "r", "bob", bob},
+	}
+	for _, s := range shares {
+		if ret := shareHandler(s.path, s.sharee, s.perm, s.user, s.cookie); ret != "" {
+			t.Fatalf("sharing %v with %v: %v", s.path, s.sharee, ret)
+		}
+	}
+
+	got := sharesHandler("", "", "ann", ann)
+	if got.Err != "" || len(got.Out) != 3 || len(got.In) != 1 {
+		t.Fatalf("sharesHandler: got %+v; want 3 shares out and 1 in", got)
+	}
+	if e := got.Out[1]; e.Path != "/d/b" || e.Sharee != "@team" || e.Perm != "r" {
+		t.Fatalf("sharesHandler: got %+v second; want /d/b shared with @team", e)
+	}
+	if e := got.In[0]; e.Name != "/Shared_with_me/c" || e.Sharer != "bob" || e.Origname != "c" || e.Perm != "r" {
+		t.Fatalf("sharesHandler: got %+v in; want c from bob", e)
+	}
+
+	got = sharesHandler("userfs/ann/d", "", "ann", ann)
+	if got.Err != "" || len(got.Out) != 2 || len(got.In) != 0 {
+		t.Fatalf("sharesHandler under d: got %+v; want the 2 shares of d/b", got)
+	}
+	got = sharesHandler("", "bob", "ann", ann)
+	if got.Err != "" || len(got.Out) != 2 || len(got.In) != 1 {
+		t.Fatalf("sharesHandler with bob: got %+v; want 2 out and 1 in", got)
+	}
+	got = sharesHandler("", "@team", "cat", cat)
+	if got.Err != "" || len(got.Out) != 0 || len(got.In) != 1 || got.In[0].Group != "team" || got.In[0].Sharer != "ann" {
+		t.Fatalf("sharesHandler for cat: got %+v; want d/b from ann through team", got)
+	}
+	if got := sharesHandler("userfs/bob", "", "ann", ann); got.Err == "" {
+		t.Fatalf("sharesHandler outside ann's tree: got no error")
+	}
+}
+
+// test that a share made to expire gives no access once it has, not even to a download already
+// under way or through the link it leaves behind, and that expireShares then removes it and the link
+func TestShareExpiry(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	defer resetTransfers()()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+	if ret := uploadHandler("userfs/ann/a", "ann", []byte("hello"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if ret := shareUntilHandler("userfs/ann/a", "bob", "r", -1, "ann", ann); ret == "" {
+		t.Fatalf("sharing until a time in the past: got no error")
+	}
+	if ret := shareUntilHandler("userfs/ann/a", "bob", "r", 3600, "ann", ann); ret != "" {
+		t.Fatalf("shareUntilHandler: %v", ret)
+	}
+	got := statHandler("userfs/bob/Shared_with_me/a", "bob", bob)
+	if got.Err != "" || got.Entry.Expires <= time.Now().Unix() || got.Entry.Expires > time.Now().Unix()+3600 {
+		t.Fatalf("statHandler as bob: got %+v; want it to expire within the hour", got)
+	}
+	opened := downloadOpenHandler("userfs/bob/Shared_with_me/a", "bob", bob)
+	if opened.Err != "" {
+		t.Fatalf("downloadOpenHandler: %v", opened.Err)
+	}
+
+	_, err := db.Exec("UPDATE sharedata SET expires=? WHERE sharee='bob'", time.Now().Unix()-1)
+	if err != nil {
+		t.Fatalf("could not make the share expire: %v", err)
+	}
+	if got := downloadReadHandler(opened.ID, 0, 5, "bob", bob); got.Err == "" {
+		t.Fatalf("reading after the share expired: got %q; want an error", got.Body)
+	}
+	if _, ok := downloads[opened.ID]; ok {
+		t.Fatalf("download session still open after the share expired")
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/a", "bob", bob); got.Err == "" {
+		t.Fatalf("downloading after the share expired: got %q; want an error", got.Body)
+	}
+	if ret := copyHandler("userfs/bob/Shared_with_me/a", "userfs/bob/a", false, "bob", bob); ret == "" {
+		t.Fatalf("copying after the share expired: got no error")
+	}
+
+	expireShares()
+	if _, err := os.Lstat("userfs/bob/Shared_with_me/a"); !os.IsNotExist(err) {
+		t.Fatalf("bob's link after expireShares: got %v; want it gone", err)
+	}
+	if shares := sharesHandler("", "", "ann", ann); shares.Err != "" || len(shares.Out) != 0 {
+		t.Fatalf("sharesHandler after expireShares: got %+v; want no shares", shares)
+	}
+	if got := downloadHandler("userfs/ann/a", "ann", ann); got.Err != "" || string(got.Body) != "hello" {
+		t.Fatalf("ann downloading their own file: got %q, %v; want %q", got.Body, got.Err, "hello")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../internal"
+)
+
+// Returns the permission string a perm column in sharedata stands for.
+func permString(perm int) string {
+	switch perm {
+	case 1:
+		return "rw"
+	case 2:
+		return "rws"
+	}
+	return "r"
+}
+
+// Returns the perm column value the permission string perm stands for, or -1 if it isn't one.
+func parsePerm(perm string) int {
+	switch perm {
+	case "r":
+		return 0
+	case "rw":
+		return 1
+	case "rws":
+		return 2
+	}
+	return -1
+}
+
+// Takes in the absolute path of something in username's tree and what os.Lstat says about it and
+// returns its directory entry with everything there is to know about it: the size and hash of the
+// file it links to, who the user shares it with, and for what is in Shared_with_me who shared it,
+// with what permission and until when. The modification time of a file is when its link was last replaced,
+// which is when it was last uploaded to.
+func direntOf(abspath string, username string, fi os.FileInfo) internal.DirEnt {
+	d := internal.DirEnt{IsDir_: fi.IsDir(), Name_: fi.Name(), ModTime: fi.ModTime().Unix()}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if isDirLink(abspath) {
+			d.IsDir_ = true
+		} else {
+			d.Hash, _ = linkKey(abspath)
+			d.Size = linkSize(db, abspath)
+		}
+	}
+
+	rows, err := db.Query("SELECT sharee, perm, expires FROM sharedata WHERE sharer=? AND origpath=? AND grp='' AND (expires=0 OR expires>?) ORDER BY sharee", username, abspath, time.Now().Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	for rows.Next() {
+		var s internal.ShareEnt
+		var perm int
+		err = rows.Scan(&s.User, &perm, &s.Expires)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		s.Perm = permString(perm)
+		d.Shares = append(d.Shares, s)
+	}
+	rows.Close()
+
+	if sharer, _, _, perm, expires, ok := findShare(abspath, username); ok {
+		d.SharedBy = sharer
+		d.Perm = permString(perm)
+		d.Expires = expires
+	}
+	return d
+}
+
+// Takes in a path relative to the server, a username and a cookie and returns the directory entry
+// of whatever is at path, with all of its metadata.
+func statHandler(path string, username string, cookie string) internal.StatReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.StatReturn{Err: "reauth"}
+	}
+	if !checkpath(path, username) {
+		return internal.StatReturn{Err: "Path does not exist!"}
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return internal.StatReturn{Err: err.Error()}
+	}
+	fi, err := os.Lstat(abspath)
+	if err != nil {
+		return internal.StatReturn{Err: "That resource doesn't exist!\n"}
+	}
+	return internal.StatReturn{Entry: direntOf(abspath, username, fi)}
+}
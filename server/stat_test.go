@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+// test that listings and stat give the size and hash of files, who their owner shares them with,
+// and who shared the files in Shared_with_me and with what permission
+func TestStat(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d", "userfs/bob/Shared_with_me", "userfs/cat/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	addTestUser(t, "cat")
+	autoAcceptFrom(t, "ann", "bob", "cat")
+	if ret := uploadHandler("userfs/ann/a", "ann", []byte("hello"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	for _, s := range []struct{ user, perm string }{{"cat", "r"}, {"bob", "rw"}} {
+		if ret := shareHandler("userfs/ann/a", s.user, s.perm, "ann", ann); ret != "" {
+			t.Fatalf("sharing with %v: %v", s.user, ret)
+		}
+	}
+
+	got := statHandler("userfs/ann/a", "ann", ann)
+	e := got.Entry
+	if got.Err != "" || e.IsDir_ || e.Name_ != "a" || e.Size != 5 || e.Hash != contentKey([]byte("hello")) || e.ModTime == 0 {
+		t.Fatalf("statHandler: got %+v; want a file of 5 bytes", got)
+	}
+	if len(e.Shares) != 2 || e.Shares[0].User != "bob" || e.Shares[0].Perm != "rw" || e.Shares[1].User != "cat" || e.Shares[1].Perm != "r" {
+		t.Fatalf("statHandler: got shares %+v; want bob rw and cat r", e.Shares)
+	}
+	if e.SharedBy != "" || e.Perm != "" {
+		t.Fatalf("statHandler: got %+v; want it not shared with ann", e)
+	}
+
+	got = statHandler("userfs/bob/Shared_with_me/a", "bob", bob)
+	if got.Err != "" || got.Entry.SharedBy != "ann" || got.Entry.Perm != "rw" || got.Entry.Size != 5 || len(got.Entry.Shares) != 0 {
+		t.Fatalf("statHandler as bob: got %+v; want it shared by ann with rw", got)
+	}
+	if got := statHandler("userfs/ann/nothing", "ann", ann); got.Err == "" {
+		t.Fatalf("statHandler of nothing: got %+v; want an error", got)
+	}
+	if got := statHandler("userfs/ann/a", "bob", bob); got.Err == "" {
+		t.Fatalf("statHandler outside bob's tree: got %+v; want an error", got)
+	}
+
+	list := listHandler("userfs/ann", "ann", ann)
+	if list.Err != "" {
+		t.Fatalf("listHandler: %v", list.Err)
+	}
+	entries := make(map[string]int)
+	for i, e := range list.Entries {
+		entries[e.Name_] = i
+	}
+	if i, ok := entries["a"]; !ok || list.Entries[i].Size != 5 || len(list.Entries[i].Shares) != 2 {
+		t.Fatalf("listHandler: got %+v; want a with its size and shares", list.Entries)
+	}
+	if i, ok := entries["d"]; !ok || !list.Entries[i].IsDir_ || list.Entries[i].Hash != "" {
+		t.Fatalf("listHandler: got %+v; want d as a directory", list.Entries)
+	}
+}
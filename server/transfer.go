@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../internal"
+)
+
+// Files too large to move in one call are streamed in pieces of at most
+// internal.TransferPieceSize bytes, so neither side ever holds a whole file in memory.
+//
+// An upload session is begun for a path and a size. Its pieces are sent in order and appended to
+// a spool file under ./uploads, and committing it stores the spooled file the same way a regular
+// upload is stored, reading it back a chunk at a time. A download session remembers which chunks
+// the file was made of when the session was opened, and each read returns a range of it
+// reassembled from only the chunks that range covers. It doesn't hold on to them, though: if the
+// file is overwritten or removed and its chunks are deleted meanwhile, reads fail and the client
+// has to open the file again. Every read checks again that the user can still get at the file
+// through the path the session was opened on, so unsharing a file cuts off downloads of it that
+// are under way.
+//
+// Upload sessions are kept in uploaddata next to their spool files, so they survive both the
+// client losing its connection and the server restarting. Beginning an upload of the same size to
+// the same path picks up the unfinished session there if there is one, and upload-status tells the
+// client how much of it the server already has. Every call is safe to repeat: pieces already
+// received are ignored, and committing a session that was committed already succeeds without doing
+// anything, so a client that lost the reply to a call can simply make it again.
+//
+// Sessions belong to the user who began them. Upload sessions are dropped once they have been idle
+// for uploadIdle, and download sessions, which only live in memory, after downloadIdle. A user can
+// have at most maxOpenUploads unfinished upload sessions at once, and the sizes they were begun
+// with count against the quota of whoever the file will be charged to until they are finished, so
+// spool files can't be used to store more than the quota allows.
+
+const uploadIdle = 24 * time.Hour
+const downloadIdle = time.Hour
+const maxOpenUploads = 8
+
+// An upload session as kept in uploaddata.
+type uploadSession struct {
+	id       string
+	owner    string // who began it
+	path     string // absolute path being uploaded to
+	size     int64  // size of the file, given when the session was begun
+	received int64  // bytes spooled so far
+	seq      int    // number of the next piece expected
+	done     bool   // whether it has been committed
+}
+
+type downloadSession struct {
+	owner   string
+	path    string // path relative to the server it was opened on
+	chunks  []storedChunk
+	size    int64
+	touched time.Time
+}
+
+var downloads = make(map[string]*downloadSession)
+
+// Returns where the pieces of the upload session with the given ID are spooled.
+func spoolPath(id string) string {
+	return filepath.Join("./uploads", id)
+}
+
+// Brings the spool directory in line with uploaddata after a restart. A piece that was being
+// written when the server stopped is cut off again, and sessions whose spool file doesn't match
+// what uploaddata says was received are dropped, as are spool files without a session.
+func initTransfers() {
+	err := os.MkdirAll("./uploads", 0775)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not set up uploads: %v\n", err)
+		os.Exit(1)
+	}
+	rows, err := db.Query("SELECT id, received FROM uploaddata WHERE done=0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	live := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var received int64
+		err = rows.Scan(&id, &received)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		live[id] = received
+	}
+	rows.Close()
+
+	for id, received := range live {
+		fi, err := os.Stat(spoolPath(id))
+		if err != nil || fi.Size() < received {
+			endUpload(id)
+		} else if fi.Size() > received && os.Truncate(spoolPath(id), received) != nil {
+			endUpload(id)
+		}
+	}
+	entries, err := ioutil.ReadDir("./uploads")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not set up uploads: %v\n", err)
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		if _, ok := live[e.Name()]; !ok {
+			os.Remove(spoolPath(e.Name()))
+		}
+	}
+}
+
+// Returns a new random session ID.
+func newTransferID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate session id: %v\n", err)
+		os.Exit(1)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Drops every session that has been idle for too long.
+func expireTransfers() {
+	rows, err := db.Query("SELECT id FROM uploaddata WHERE touched<?", time.Now().Add(-uploadIdle).Unix())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+			os.Exit(1)
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	for _, id := range expired {
+		endUpload(id)
+	}
+
+	cutoff := time.Now().Add(-downloadIdle)
+	for id, d := range downloads {
+		if d.touched.Before(cutoff) {
+			delete(downloads, id)
+		}
+	}
+}
+
+// Returns username's upload session with the given ID, or nil if they have none, and marks it as
+// just used.
+func uploadSessionOf(id string, username string) *uploadSession {
+	u := uploadSession{id: id}
+	err := db.QueryRow("SELECT owner, path, size, received, seq, done FROM uploaddata WHERE id=?", id).Scan(&u.owner, &u.path, &u.size, &u.received, &u.seq, &u.done)
+	if err == sql.ErrNoRows || (err == nil && u.owner != username) {
+		return nil
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE uploaddata SET touched=? WHERE id=?", time.Now().Unix(), id)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	return &u
+}
+
+// Drops the upload session with the given ID along with its spool file.
+func endUpload(id string) {
+	_, err := db.Exec("DELETE FROM uploaddata WHERE id=?", id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	os.Remove(spoolPath(id))
+}
+
+// Takes in a path relative to the server, the size of the file to be uploaded there, a username
+// and a cookie and begins an upload session for it, or picks up the unfinished one the user
+// already has for a file of that size there. The same checks as for a regular upload are made up
+// front, so that nothing is sent only to be refused; they are made again on commit.
+func uploadBeginHandler(path string, size int64, username string, cookie string) internal.UploadBeginReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.UploadBeginReturn{Err: "reauth"}
+	}
+	if !checkpath(path, username) {
+		return internal.UploadBeginReturn{Err: "Path does not exist on the server!"}
+	}
+	if size < 0 {
+		return internal.UploadBeginReturn{Err: "Invalid size"}
+	}
+	storepath, err := filepath.Abs(path)
+	if err != nil {
+		return internal.UploadBeginReturn{Err: err.Error()}
+	}
+	owner, ownerpath, errmsg := uploadTarget(storepath, username)
+	if errmsg != "" {
+		return internal.UploadBeginReturn{Err: errmsg}
+	}
+	shared, err := filepath.Abs("./userfs/" + owner + "/Shared_with_me")
+	if err != nil {
+		return internal.UploadBeginReturn{Err: "Error finding path..."}
+	}
+	if strings.HasPrefix(ownerpath, shared) {
+		return internal.UploadBeginReturn{Err: "You cannot upload a new file to Shared_with_me"}
+	}
+
+	expireTransfers()
+	var id string
+	err = db.QueryRow("SELECT id FROM uploaddata WHERE owner=? AND path=? AND size=? AND done=0 ORDER BY touched DESC", username, storepath, size).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	// what other unfinished uploads will be charged to the owner is spoken for already
+	var pending int64
+	var open int
+	err = db.QueryRow("SELECT coalesce(sum(size),0) FROM uploaddata WHERE chargedto=? AND done=0 AND id!=?", owner, id).Scan(&pending)
+	if err == nil {
+		err = db.QueryRow("SELECT count(1) FROM uploaddata WHERE owner=? AND done=0", username).Scan(&open)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	errmsg = checkQuota(db, owner, ownerpath, size+pending)
+	if errmsg != "" {
+		if pending > 0 {
+			errmsg += fmt.Sprintf(", with %v bytes more on their way in unfinished uploads", pending)
+		}
+		return internal.UploadBeginReturn{Err: errmsg}
+	}
+	if id != "" {
+		uploadSessionOf(id, username)
+		return internal.UploadBeginReturn{ID: id}
+	}
+	if open >= maxOpenUploads {
+		return internal.UploadBeginReturn{Err: fmt.Sprintf("You already have %v unfinished uploads; finish or abort one first", open)}
+	}
+	id = newTransferID()
+	f, err := os.Create(spoolPath(id))
+	if err != nil {
+		return internal.UploadBeginReturn{Err: "Couldn't upload :("}
+	}
+	f.Close()
+	_, err = db.Exec("INSERT INTO uploaddata(id, owner, path, size, received, seq, touched, chargedto) values(?,?,?,?,?,?,?,?)", id, username, storepath, size, 0, 0, time.Now().Unix(), owner)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return internal.UploadBeginReturn{ID: id}
+}
+
+// Takes in the ID of an upload session and returns how much of the file the server has: the
+// number of bytes and pieces received, and the SHA-256 of those bytes so that the client can
+// check they are the ones it is about to resume sending.
+func uploadStatusHandler(id string, username string, cookie string) internal.UploadStatusReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.UploadStatusReturn{Err: "reauth"}
+	}
+	u := uploadSessionOf(id, username)
+	if u == nil {
+		return internal.UploadStatusReturn{Err: "There is no such upload!"}
+	}
+	ret := internal.UploadStatusReturn{Size: u.size, Received: u.received, Pieces: u.seq, Done: u.done}
+	if u.done {
+		return ret
+	}
+	f, err := os.Open(spoolPath(id))
+	if err != nil {
+		return internal.UploadStatusReturn{Err: "Couldn't read the upload :("}
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.CopyN(h, f, u.received)
+	if err != nil {
+		return internal.UploadStatusReturn{Err: "Couldn't read the upload :("}
+	}
+	ret.Digest = hex.EncodeToString(h.Sum(nil))
+	return ret
+}
+
+// Takes in the ID of an upload session, the number of the piece being sent and the piece itself
+// and appends it to what has been received. Pieces must come in order, starting from 0; a piece
+// that has already been received is ignored, so a piece can safely be sent again if the reply to
+// it was lost.
+func uploadPutHandler(id string, seq int, data []byte, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	u := uploadSessionOf(id, username)
+	if u == nil {
+		return "There is no such upload!"
+	}
+	if u.done {
+		return "That upload is already finished!"
+	}
+	if seq < u.seq {
+		return ""
+	}
+	if seq > u.seq {
+		return fmt.Sprintf("Expected piece %v but got piece %v", u.seq, seq)
+	}
+	if len(data) > internal.TransferPieceSize {
+		return "That piece is too big!"
+	}
+	if u.received+int64(len(data)) > u.size {
+		return "That is more than the size the upload was begun with!"
+	}
+
+	f, err := os.OpenFile(spoolPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return "Couldn't upload :("
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// whatever part of the piece made it to disk is cut off again, so it can be sent again
+		os.Truncate(spoolPath(id), u.received)
+		return "Couldn't upload :("
+	}
+	_, err = db.Exec("UPDATE uploaddata SET received=?, seq=? WHERE id=?", u.received+int64(len(data)), u.seq+1, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not update database: %v\n", err)
+		os.Exit(1)
+	}
+	return ""
+}
+
+// Takes in the ID of an upload session that has received everything and stores the file, in one
+// operation just like a regular upload. The session is only marked as done rather than dropped, so
+// committing it again succeeds; if storing the file fails, the session is dropped.
+func uploadCommitHandler(id string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	u := uploadSessionOf(id, username)
+	if u == nil {
+		return "There is no such upload!"
+	}
+	if u.done {
+		return ""
+	}
+	if u.received != u.size {
+		return fmt.Sprintf("The upload is incomplete: %v of %v bytes were received", u.received, u.size)
+	}
+	ret := commitUpload(u)
+	if ret != "" {
+		endUpload(id)
+	}
+	return ret
+}
+
+// Does the work of uploadCommitHandler.
+func commitUpload(u *uploadSession) string {
+	owner, ownerpath, errmsg := uploadTarget(u.path, u.owner)
+	if errmsg != "" {
+		return errmsg
+	}
+
+	f, err := os.Open(spoolPath(u.id))
+	if err != nil {
+		return "Couldn't upload :("
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "Couldn't upload :("
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	o := beginOp()
+	ret := storeStream(o, ownerpath, owner, hash, u.size, f)
+	if ret == "" {
+		ret = relinkSharees(o, owner, ownerpath)
+	}
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	_, err = o.tx.Exec("UPDATE uploaddata SET done=1 WHERE id=?", u.id)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	o.afterCommit(func() { os.Remove(spoolPath(u.id)) })
+	if o.commit() != nil {
+		return "Couldn't upload :("
+	}
+	return ""
+}
+
+// Takes in the ID of an upload session and drops it along with everything it received.
+func uploadAbortHandler(id string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	if uploadSessionOf(id, username) == nil {
+		return "There is no such upload!"
+	}
+	endUpload(id)
+	return ""
+}
+
+// Takes in a path relative to the server and a username and returns the key of the file there,
+// or an error message if the user can't download it.
+func downloadTarget(path string, username string) (string, string) {
+	if !checkpath(path, username) {
+		return "", "Path does not exist!"
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err.Error()
+	}
+	if shareLapsed(abspath, username) {
+		return "", "That share has expired"
+	}
+	fi, err := os.Lstat(abspath)
+	if err != nil {
+		return "", err.Error()
+	}
+	if fi.Mode()&os.ModeSymlink == 0 || isDirLink(abspath) {
+		return "", "Invalid file :(\n"
+	}
+	key, err := linkKey(abspath)
+	if err != nil {
+		return "", err.Error()
+	}
+	return key, ""
+}
+
+// Takes in a path relative to the server and a username and returns the chunks of the file there
+// and its size, or an error message.
+func chunksAt(path string, username string) ([]storedChunk, int64, string) {
+	key, errmsg := downloadTarget(path, username)
+	if errmsg != "" {
+		return nil, 0, errmsg
+	}
+	chunks, err := fileChunks(key)
+	if err != nil {
+		return nil, 0, err.Error()
+	}
+	var size int64
+	for _, c := range chunks {
+		size += c.size
+	}
+	return chunks, size, ""
+}
+
+// Takes in a path relative to the server, a username and a cookie and opens a download session
+// for the file there. Returns the session's ID and the size of the file.
+func downloadOpenHandler(path string, username string, cookie string) internal.DownloadOpenReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.DownloadOpenReturn{Err: "reauth"}
+	}
+	chunks, size, errmsg := chunksAt(path, username)
+	if errmsg != "" {
+		return internal.DownloadOpenReturn{Err: errmsg}
+	}
+
+	expireTransfers()
+	id := newTransferID()
+	downloads[id] = &downloadSession{owner: username, path: path, chunks: chunks, size: size, touched: time.Now()}
+	return internal.DownloadOpenReturn{ID: id, Size: size}
+}
+
+// Takes in a path relative to the server, an offset and a length and returns up to that many
+// bytes of the file there starting at offset, along with the size of the whole file, without
+// needing a session. No more than internal.TransferPieceSize bytes are returned at once, and
+// nothing once offset reaches the end of the file.
+func downloadRangeHandler(path string, offset int64, length int64, username string, cookie string) internal.DownloadRangeReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.DownloadRangeReturn{Err: "reauth"}
+	}
+	if offset < 0 || length < 0 {
+		return internal.DownloadRangeReturn{Err: "Invalid range"}
+	}
+	chunks, size, errmsg := chunksAt(path, username)
+	if errmsg != "" {
+		return internal.DownloadRangeReturn{Err: errmsg}
+	}
+	if length > internal.TransferPieceSize {
+		length = internal.TransferPieceSize
+	}
+	body, err := readRange(chunks, offset, length)
+	if err != nil {
+		return internal.DownloadRangeReturn{Err: err.Error()}
+	}
+	return internal.DownloadRangeReturn{Body: body, Size: size}
+}
+
+// Takes in the ID of a download session, an offset and a length and returns up to that many bytes
+// of the file starting at offset, but never more than internal.TransferPieceSize. The body is
+// empty once offset reaches the end of the file. The session is dropped if the user can no longer
+// get at the file it was opened on.
+func downloadReadHandler(id string, offset int64, length int, username string, cookie string) internal.DownloadReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.DownloadReturn{Err: "reauth"}
+	}
+	d := downloads[id]
+	if d == nil || d.owner != username {
+		return internal.DownloadReturn{Err: "There is no such download!"}
+	}
+	if _, errmsg := downloadTarget(d.path, username); errmsg != "" {
+		delete(downloads, id)
+		return internal.DownloadReturn{Err: "You no longer have access to that file!"}
+	}
+	d.touched = time.Now()
+	if offset < 0 || length < 0 {
+		return internal.DownloadReturn{Err: "Invalid range"}
+	}
+	if length > internal.TransferPieceSize {
+		length = internal.TransferPieceSize
+	}
+	body, err := readRange(d.chunks, offset, int64(length))
+	if err != nil {
+		// the file may have been overwritten and released since the session was opened
+		return internal.DownloadReturn{Err: "The file is gone or damaged :("}
+	}
+	return internal.DownloadReturn{Body: body}
+}
+
+// Takes in the ID of a download session and closes it.
+func downloadCloseHandler(id string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	d := downloads[id]
+	if d == nil || d.owner != username {
+		return "There is no such download!"
+	}
+	delete(downloads, id)
+	return ""
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"../internal"
+)
+
+// Forgets every download session, and returns a function that does so again. Upload sessions go
+// along with the database.
+func resetTransfers() func() {
+	downloads = make(map[string]*downloadSession)
+	return func() { downloads = make(map[string]*downloadSession) }
+}
+
+// test that a file sent in pieces is stored once everything has arrived, that pieces out of
+// order are refused and repeated ones ignored, that an upload cut short is picked up again after a
+// restart, and that reading it back in pieces gives the same
+func TestTransfer(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "uploads")()
+	defer resetTransfers()()
+	ann := addTestUser(t, "ann")
+	body := randomBytes(14, internal.TransferPieceSize+internal.TransferPieceSize/2)
+
+	begun := uploadBeginHandler("userfs/ann/big", int64(len(body)), "ann", ann)
+	if begun.Err != "" {
+		t.Fatalf("uploadBeginHandler: %v", begun.Err)
+	}
+	first, second := body[:internal.TransferPieceSize], body[internal.TransferPieceSize:]
+	if ret := uploadPutHandler(begun.ID, 1, second, "ann", ann); ret == "" {
+		t.Fatalf("sending piece 1 first: got no error")
+	}
+	for _, p := range [][]byte{first, first} {
+		if ret := uploadPutHandler(begun.ID, 0, p, "ann", ann); ret != "" {
+			t.Fatalf("sending piece 0: %v", ret)
+		}
+	}
+	if ret := uploadCommitHandler(begun.ID, "ann", ann); !strings.HasPrefix(ret, "The upload is incomplete") {
+		t.Fatalf("committing half an upload: got %q; want it refused", ret)
+	}
+
+	// the server stops while the second piece is being written
+	f, err := os.OpenFile(spoolPath(begun.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.Write(second[:100])
+		f.Close()
+	}
+	if err != nil {
+		t.Fatalf("could not write part of a piece: %v", err)
+	}
+	initTransfers()
+	again := uploadBeginHandler("userfs/ann/big", int64(len(body)), "ann", ann)
+	if again.Err != "" || again.ID != begun.ID {
+		t.Fatalf("beginning the same upload again: got %+v; want session %v back", again, begun.ID)
+	}
+	h := sha256.Sum256(first)
+	status := uploadStatusHandler(begun.ID, "ann", ann)
+	if status.Err != "" || status.Received != int64(len(first)) || status.Pieces != 1 || status.Digest != hex.EncodeToString(h[:]) {
+		t.Fatalf("uploadStatusHandler: got %+v; want the first piece alone", status)
+	}
+	if ret := uploadPutHandler(begun.ID, 1, second, "ann", ann); ret != "" {
+		t.Fatalf("sending piece 1: %v", ret)
+	}
+	for i := 0; i < 2; i++ {
+		if ret := uploadCommitHandler(begun.ID, "ann", ann); ret != "" {
+			t.Fatalf("uploadCommitHandler, time %v: %v", i+1, ret)
+		}
+	}
+	if _, err := os.Stat(spoolPath(begun.ID)); !os.IsNotExist(err) {
+		t.Fatalf("spool file after committing: got %v; want it gone", err)
+	}
+
+	opened := downloadOpenHandler("userfs/ann/big", "ann", ann)
+	if opened.Err != "" || opened.Size != int64(len(body)) {
+		t.Fatalf("downloadOpenHandler: got %+v; want %v bytes", opened, len(body))
+	}
+	var got []byte
+	for {
+		piece := downloadReadHandler(opened.ID, int64(len(got)), internal.TransferPieceSize, "ann", ann)
+		if piece.Err != "" {
+			t.Fatalf("downloadReadHandler: %v", piece.Err)
+		}
+		if len(piece.Body) == 0 {
+			break
+		}
+		got = append(got, piece.Body...)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("downloaded %v bytes that differ from the %v uploaded", len(got), len(body))
+	}
+	if ret := downloadCloseHandler(opened.ID, "ann", ann); ret != "" {
+		t.Fatalf("downloadCloseHandler: %v", ret)
+	}
+}
+
+// test that unfinished uploads count against the quota and are capped per user, and that a
+// download under way is cut off once the file is unshared
+func TestTransferLimits(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me", "uploads")()
+	defer resetTransfers()()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+
+	_, err := db.Exec("INSERT INTO quotadata(username, quota) values(?,?)", "ann", 100)
+	if err != nil {
+		t.Fatalf("could not set quota: %v", err)
+	}
+	if begun := uploadBeginHandler("userfs/ann/a", 60, "ann", ann); begun.Err != "" {
+		t.Fatalf("beginning an upload within the quota: %v", begun.Err)
+	}
+	if begun := uploadBeginHandler("userfs/ann/b", 60, "ann", ann); begun.Err == "" {
+		t.Fatalf("beginning a second upload that only fits on its own: got no error")
+	}
+	for i := 1; i < maxOpenUploads; i++ {
+		if begun := uploadBeginHandler(fmt.Sprintf("userfs/ann/empty%v", i), 0, "ann", ann); begun.Err != "" {
+			t.Fatalf("beginning upload %v: %v", i+1, begun.Err)
+		}
+	}
+	if begun := uploadBeginHandler("userfs/ann/one-too-many", 0, "ann", ann); begun.Err == "" {
+		t.Fatalf("beginning more than %v uploads: got no error", maxOpenUploads)
+	}
+
+	if ret := uploadHandler("userfs/ann/shared", "ann", []byte("shared"), ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if ret := shareHandler("userfs/ann/shared", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+	opened := downloadOpenHandler("userfs/bob/Shared_with_me/shared", "bob", bob)
+	if opened.Err != "" {
+		t.Fatalf("downloadOpenHandler: %v", opened.Err)
+	}
+	if got := downloadReadHandler(opened.ID, 0, 3, "bob", bob); got.Err != "" || string(got.Body) != "sha" {
+		t.Fatalf("reading while shared: got %q, %v; want %q", got.Body, got.Err, "sha")
+	}
+	if ret := unshareHandler("userfs/ann/shared", "bob", "ann", ann); ret != "" {
+		t.Fatalf("unshareHandler: %v", ret)
+	}
+	if got := downloadReadHandler(opened.ID, 3, 3, "bob", bob); got.Err == "" {
+		t.Fatalf("reading after unsharing: got %q; want an error", got.Body)
+	}
+	if _, ok := downloads[opened.ID]; ok {
+		t.Fatalf("download session still open after access was lost")
+	}
+}
+
+// test that ranges of a file made of many chunks come back whole wherever they start and end,
+// are cut off at the end of the file and at internal.TransferPieceSize, and that bad ones are
+// refused
+func TestDownloadRange(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me")()
+	ann := addTestUser(t, "ann")
+	body := randomBytes(16, 3*internal.TransferPieceSize/2)
+	if ret := uploadHandler("userfs/ann/big", "ann", body, ann); ret != "" {
+		t.Fatalf("uploadHandler: %v", ret)
+	}
+	if chunks, _, _ := chunksAt("userfs/ann/big", "ann"); len(chunks) < 3 {
+		t.Fatalf("the file is only %v chunks; want several to read across", len(chunks))
+	}
+
+	size := int64(len(body))
+	tests := []struct {
+		offset, length int64
+		want           []byte
+	}{
+		{0, 10, body[:10]},
+		{12345, 300000, body[12345 : 12345+300000]},
+		{size - 5, 10, body[size-5:]},
+		{size, 10, nil},
+		{size + 10, 10, nil},
+		{7, 2 * internal.TransferPieceSize, body[7 : 7+internal.TransferPieceSize]},
+	}
+	for _, tt := range tests {
+		got := downloadRangeHandler("userfs/ann/big", tt.offset, tt.length, "ann", ann)
+		if got.Err != "" || got.Size != size || !bytes.Equal(got.Body, tt.want) {
+			t.Fatalf("downloadRangeHandler(%v, %v): got %v bytes of a file of %v, %v; want %v bytes of %v", tt.offset, tt.length, len(got.Body), got.Size, got.Err, len(tt.want), size)
+		}
+	}
+	for _, r := range [][2]int64{{-1, 10}, {0, -1}} {
+		if got := downloadRangeHandler("userfs/ann/big", r[0], r[1], "ann", ann); got.Err == "" {
+			t.Fatalf("downloadRangeHandler(%v, %v): got no error", r[0], r[1])
+		}
+	}
+	if got := downloadRangeHandler("userfs/bob/big", 0, 10, "ann", ann); got.Err == "" {
+		t.Fatalf("reading outside ann's tree: got no error")
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"../internal"
+)
+
+// Removing a file or directory moves it into the user's trash instead of deleting it. Every
+// removal gets an entry in trashdata and a directory of its own, ./trash/<user>/<id>, which the
+// removed file or directory is moved into under its own name. Links in the trash keep owning their
+// files and versions move along with them, so nothing is released until the entry is purged.
+//
+// When a sharer removes a shared file or directory, the sharees' links go away as usual, but the
+// shares are kept in trashshares and given back when the entry is restored. Sharees removing what is
+// shared with them only remove their own link, so that never goes to the trash, but what sharees
+// with write access remove from inside a shared directory goes to the sharer's trash.
+//
+// Entries are purged by "empty-trash", or automatically once they are older than -trash-age.
+// Files in the trash are still charged to their owner until then, or repeatedly uploading and
+// removing files would store any amount for as long as -trash-age.
+
+// Takes in the absolute path of a file or directory in username's tree and moves it to their
+// trash as part of o.
+func trashPath(o *op, username string, abspath string) string {
+	res, err := o.tx.Exec("INSERT INTO trashdata(owner, origpath, trashpath, deleted) values(?,?,?,?)", username, abspath, "", time.Now().Unix())
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+
+	userdir, err := filepath.Abs("./trash/" + username)
+	if err != nil {
+		return "Error finding path..."
+	}
+	err = os.MkdirAll(userdir, 0775)
+	if err != nil {
+		return "Couldn't move it to the trash :("
+	}
+	entrydir := filepath.Join(userdir, strconv.FormatInt(id, 10))
+	err = o.mkdir(entrydir, 0775)
+	if err != nil {
+		return "Couldn't move it to the trash :("
+	}
+	trashpath := filepath.Join(entrydir, filepath.Base(abspath))
+
+	// Put the shares of everything being removed aside. What members got through a group share
+	// is only taken away, since they get it again when the group share is given back.
+	type share struct {
+		sharee, origpath, shareepath, group string
+		perm                                int
+		expires                             int64
+		parent, parentpath                  string
+	}
+	rows, err := o.tx.Query("SELECT sharee, origpath, shareepath, perm, grp, expires, parent, parentpath FROM sharedata WHERE sharer=? AND (origpath=? OR origpath GLOB ?)", username, abspath, underPath(abspath))
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var sh share
+		err = rows.Scan(&sh.sharee, &sh.origpath, &sh.shareepath, &sh.perm, &sh.group, &sh.expires, &sh.parent, &sh.parentpath)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		shares = append(shares, sh)
+	}
+	rows.Close()
+	for _, sh := range shares {
+		if sh.shareepath != "" {
+			err = o.removeLink(sh.shareepath)
+			if err != nil && !os.IsNotExist(err) {
+				return "Could not unshare with someone"
+			}
+		}
+		if sh.group == "" {
+			_, err = o.tx.Exec("INSERT INTO trashshares(trashid, sharee, origpath, shareepath, perm, expires, parent, parentpath) values(?,?,?,?,?,?,?,?)", id, sh.sharee, sh.origpath, sh.shareepath, sh.perm, sh.expires, sh.parent, sh.parentpath)
+			if err != nil {
+				o.fatal("could not update database", err)
+			}
+		}
+		_, err = o.tx.Exec("DELETE FROM sharedata WHERE sharer=? AND sharee=? AND origpath=?", username, sh.sharee, sh.origpath)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+
+	moveVersions(o, username, abspath, trashpath)
+	moveLinks(o, username, abspath, trashpath)
+	dropInvites(o, username, abspath)
+	err = o.rename(abspath, trashpath)
+	if err != nil {
+		return "Couldn't move it to the trash :("
+	}
+	_, err = o.tx.Exec("UPDATE trashdata SET trashpath=? WHERE id=?", trashpath, id)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	return ""
+}
+
+// Moves the trash entry with the given id back into username's tree as part of o, at target or
+// where it was removed from if target is empty. The shares it had are given back too, under their
+// old names unless something has taken them since, but re-shares only if the shares they were
+// made through still allow them.
+func restoreTrash(o *op, username string, id int64, target string) string {
+	var origpath, trashpath string
+	err := o.tx.QueryRow("SELECT origpath, trashpath FROM trashdata WHERE id=? AND owner=?", id, username).Scan(&origpath, &trashpath)
+	if err == sql.ErrNoRows {
+		return "There is no such item in your trash!"
+	}
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	if target == "" {
+		target = origpath
+	}
+
+	shared, err := filepath.Abs("./userfs/" + username + "/Shared_with_me")
+	if err != nil {
+		return "Error finding path..."
+	}
+	if target == shared || strings.HasPrefix(target, shared+"/") {
+		return "You cannot restore into Shared_with_me"
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "Something is already there; restore it somewhere else"
+	}
+	if fi, err := os.Stat(filepath.Dir(target)); err != nil || !fi.IsDir() {
+		return "The directory it was in is gone; restore it somewhere else"
+	}
+
+	err = o.rename(trashpath, target)
+	if err != nil {
+		return "Couldn't restore :("
+	}
+	moveVersions(o, username, trashpath, target)
+	moveLinks(o, username, trashpath, target)
+
+	type share struct {
+		sharee, origpath, shareepath string
+		perm                         int
+		expires                      int64
+		parent, parentpath           string
+	}
+	// shares that expired while in the trash are left out
+	rows, err := o.tx.Query("SELECT sharee, origpath, shareepath, perm, expires, parent, parentpath FROM trashshares WHERE trashid=? AND (expires=0 OR expires>?)", id, time.Now().Unix())
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var sh share
+		err = rows.Scan(&sh.sharee, &sh.origpath, &sh.shareepath, &sh.perm, &sh.expires, &sh.parent, &sh.parentpath)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		shares = append(shares, sh)
+	}
+	rows.Close()
+	var groups []string
+	for _, sh := range shares {
+		neworig := target + strings.TrimPrefix(sh.origpath, origpath)
+		// re-shares made through a share of something else that was removed with it move with it
+		if sh.parentpath == origpath || strings.HasPrefix(sh.parentpath, origpath+"/") {
+			sh.parentpath = target + strings.TrimPrefix(sh.parentpath, origpath)
+		}
+		if strings.HasPrefix(sh.sharee, "@") {
+			// shares with groups have no link of their own; the members get theirs below
+			_, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires) values(?,?,?,?,?,?)", username, sh.sharee, neworig, "", sh.perm, sh.expires)
+			if err != nil {
+				o.fatal("could not update database", err)
+			}
+			groups = append(groups, sh.sharee[1:])
+			continue
+		}
+		fi, err := os.Lstat(neworig)
+		if err != nil {
+			continue
+		}
+		// shared directories are linked to directly, files by what the sharer's link points at
+		realfile := neworig
+		if !fi.IsDir() {
+			realfile, err = os.Readlink(neworig)
+			if err != nil {
+				continue
+			}
+		}
+		shareepath := sh.shareepath
+		if _, err := os.Lstat(shareepath); err == nil {
+			dir := filepath.Dir(shareepath)
+			shareepath = filepath.Join(dir, freeShareeName(dir, filepath.Base(shareepath)))
+		}
+		err = o.symlink(realfile, shareepath)
+		if err != nil {
+			return "Could not share with someone again"
+		}
+		_, err = o.tx.Exec("INSERT INTO sharedata(sharer, sharee, origpath, shareepath, perm, expires, parent, parentpath) values(?,?,?,?,?,?,?,?)", username, sh.sharee, neworig, shareepath, sh.perm, sh.expires, sh.parent, sh.parentpath)
+		if err != nil {
+			o.fatal("could not update database", err)
+		}
+	}
+
+	for _, name := range groups {
+		ret := syncMembers(o, groupMembers(o.tx, name))
+		if ret != "" {
+			return ret
+		}
+	}
+	ret := pruneReshares(o, username)
+	if ret != "" {
+		return ret
+	}
+
+	_, err = o.tx.Exec("DELETE FROM trashshares WHERE trashid=?", id)
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM trashdata WHERE id=?", id)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	err = o.removeDir(filepath.Dir(trashpath))
+	if err != nil {
+		return "Couldn't restore :("
+	}
+	return ""
+}
+
+// Deletes the trash entry with the given id for good as part of o, releasing every file in it.
+func purgeTrash(o *op, owner string, id int64, trashpath string) string {
+	type entry struct {
+		path string
+		link bool
+	}
+	var entries []entry
+	err := filepath.Walk(trashpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path, info.Mode()&os.ModeSymlink != 0})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "Couldn't empty the trash :("
+	}
+
+	// Children come after their parents, so go backwards to empty directories before removing them
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.link {
+			key, err := linkKey(e.path)
+			if err != nil {
+				return "Couldn't empty the trash :("
+			}
+			// the link goes first, while the size its owner is charged for can still be looked up
+			err = o.removeLink(e.path)
+			if err == nil {
+				releaseFile(o, key)
+				dropVersions(o, owner, e.path)
+			}
+		} else {
+			err = o.removeDir(e.path)
+		}
+		if err != nil {
+			return "Couldn't empty the trash :("
+		}
+	}
+
+	dropLinks(o, owner, trashpath)
+	_, err = o.tx.Exec("DELETE FROM trashshares WHERE trashid=?", id)
+	if err == nil {
+		_, err = o.tx.Exec("DELETE FROM trashdata WHERE id=?", id)
+	}
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	err = o.removeDir(filepath.Dir(trashpath))
+	if err != nil && !os.IsNotExist(err) {
+		return "Couldn't empty the trash :("
+	}
+	return ""
+}
+
+// A trash entry as kept in trashdata.
+type trashEntry struct {
+	id        int64
+	owner     string
+	origpath  string
+	trashpath string
+	deleted   int64
+}
+
+// Returns the trash entries matching the given condition on trashdata, oldest first.
+func trashEntries(q querier, where string, args ...interface{}) ([]trashEntry, error) {
+	rows, err := q.Query("SELECT id, owner, origpath, trashpath, deleted FROM trashdata WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []trashEntry
+	for rows.Next() {
+		var e trashEntry
+		err = rows.Scan(&e.id, &e.owner, &e.origpath, &e.trashpath, &e.deleted)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Takes in a username and a cookie and returns what is in the user's trash.
+func trashHandler(username string, cookie string) internal.TrashReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.TrashReturn{Err: "reauth"}
+	}
+	root, err := filepath.Abs("./userfs/" + username)
+	if err != nil {
+		return internal.TrashReturn{Err: "Error finding path..."}
+	}
+	entries, err := trashEntries(db, "owner=?", username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	var ret internal.TrashReturn
+	for _, e := range entries {
+		fi, err := os.Lstat(e.trashpath)
+		ret.Entries = append(ret.Entries, internal.TrashEnt{
+			ID:      e.id,
+			Path:    strings.TrimPrefix(e.origpath, root),
+			IsDir:   err == nil && fi.IsDir(),
+			Deleted: e.deleted,
+		})
+	}
+	return ret
+}
+
+// Takes in the id of an entry in the user's trash and the path to restore it to, relative to the
+// server, or "" to put it back where it was. Returns a string with an error if need be.
+func restoreTrashHandler(id int64, path string, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	target := ""
+	if path != "" {
+		if !checkpath(path, username) {
+			return "You can't go outside of your directory!\n"
+		}
+		var err error
+		target, err = filepath.Abs(path)
+		if err != nil {
+			return err.Error()
+		}
+	}
+
+	o := beginOp()
+	ret := restoreTrash(o, username, id, target)
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't restore :("
+	}
+	return ""
+}
+
+// Takes in a username and a cookie and purges everything in the user's trash.
+func emptyTrashHandler(username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	o := beginOp()
+	entries, err := trashEntries(o.tx, "owner=?", username)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	for _, e := range entries {
+		ret := purgeTrash(o, e.owner, e.id, e.trashpath)
+		if ret != "" {
+			o.rollback()
+			return ret
+		}
+	}
+	if o.commit() != nil {
+		return "Couldn't empty the trash :("
+	}
+	return ""
+}
+
+// Purges every trash entry older than -trash-age. Each entry is purged in an op of its own, so
+// one that can't be purged doesn't hold up the rest.
+func purgeOldTrash() {
+	cutoff := time.Now().Add(-*trashAgeFlag).Unix()
+	entries, err := trashEntries(db, "deleted<?", cutoff)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access database: %v\n", err)
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		o := beginOp()
+		ret := purgeTrash(o, e.owner, e.id, e.trashpath)
+		if ret != "" {
+			o.rollback()
+			fmt.Fprintf(os.Stderr, "could not purge trash entry %v of %v\n", e.id, e.owner)
+			continue
+		}
+		o.commit()
+	}
+}
+
+// Purges old trash in the background, checking once a minute. Does nothing if -trash-age is 0.
+func trashLoop() {
+	if *trashAgeFlag <= 0 {
+		return
+	}
+	for {
+		runLocked(purgeOldTrash)
+		time.Sleep(time.Minute)
+	}
+}
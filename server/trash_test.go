@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// test that removing a file moves it to the trash with its shares put aside and still charged,
+// that restoring it gives both back, and that purging the trash releases everything in it
+func TestTrash(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/bob/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+	usage := func(when string, want int64) {
+		if u, err := quotaUsage(db, "ann"); err != nil || u != want {
+			t.Fatalf("%v: ann uses %v, %v; want %v", when, u, err, want)
+		}
+	}
+	if ret := mkdirHandler("userfs/ann/d", "ann", ann); ret != "" {
+		t.Fatalf("mkdirHandler: %v", ret)
+	}
+	for path, body := range map[string]string{"userfs/ann/d/one": "one", "userfs/ann/d/two": "two!"} {
+		if ret := uploadHandler(path, "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", path, ret)
+		}
+	}
+	if ret := shareHandler("userfs/ann/d/one", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+
+	if ret := removeHandler("userfs/ann/d/one", "ann", ann); ret != "" {
+		t.Fatalf("removeHandler: %v", ret)
+	}
+	entries := trashHandler("ann", ann)
+	if entries.Err != "" || len(entries.Entries) != 1 || entries.Entries[0].Path != "/d/one" || entries.Entries[0].IsDir {
+		t.Fatalf("trashHandler: got %+v; want /d/one alone", entries)
+	}
+	if _, err := os.Lstat("userfs/ann/d/one"); !os.IsNotExist(err) {
+		t.Fatalf("userfs/ann/d/one after removing: got %v; want it gone", err)
+	}
+	if _, err := os.Lstat("userfs/bob/Shared_with_me/one"); !os.IsNotExist(err) {
+		t.Fatalf("bob's link after removing: got %v; want it gone", err)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/one", "bob", bob); got.Err == "" {
+		t.Fatalf("bob downloading what ann removed: got no error")
+	}
+	usage("after removing", 7)
+
+	id := entries.Entries[0].ID
+	if ret := restoreTrashHandler(id, "", "ann", ann); ret != "" {
+		t.Fatalf("restoreTrashHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/one", "bob", bob); got.Err != "" || string(got.Body) != "one" {
+		t.Fatalf("bob downloading after ann restored it: got %q, %v; want %q", got.Body, got.Err, "one")
+	}
+	if ret := restoreTrashHandler(id, "", "ann", ann); ret != "There is no such item in your trash!" {
+		t.Fatalf("restoring the same entry twice: got %q; want it refused", ret)
+	}
+	usage("after restoring", 7)
+
+	// everything removed again and left long enough to be purged in the background
+	for _, path := range []string{"userfs/ann/d/one", "userfs/ann/d/two", "userfs/ann/d"} {
+		if ret := removeHandler(path, "ann", ann); ret != "" {
+			t.Fatalf("removeHandler(%v): %v", path, ret)
+		}
+	}
+	usage("after removing everything", 7)
+	_, err := db.Exec("UPDATE trashdata SET deleted=?", time.Now().Add(-2*time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("could not age the trash: %v", err)
+	}
+	old := *trashAgeFlag
+	*trashAgeFlag = time.Hour
+	defer func() { *trashAgeFlag = old }()
+	purgeOldTrash()
+	if entries := trashHandler("ann", ann); len(entries.Entries) != 0 {
+		t.Fatalf("trashHandler after purging: got %+v; want nothing", entries.Entries)
+	}
+	usage("after purging", 0)
+	if counts := refcounts(t); len(counts) != 0 {
+		t.Fatalf("after purging: got refcounts %v; want every chunk gone", counts)
+	}
+	var shares int
+	err = db.QueryRow("SELECT (SELECT count(1) FROM sharedata) + (SELECT count(1) FROM trashshares)").Scan(&shares)
+	if err != nil || shares != 0 {
+		t.Fatalf("after purging: %v shares left, %v; want none", shares, err)
+	}
+}
+
+// test that removing a directory with everything in it trashes it as one entry, taking the shares
+// of the files under it along, and that the user's root and Shared_with_me can't be removed
+func TestRemoveAll(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me", "userfs/ann/d/sub", "userfs/bob/Shared_with_me")()
+	ann, bob := addTestUser(t, "ann"), addTestUser(t, "bob")
+	autoAcceptFrom(t, "ann", "bob")
+	for path, body := range map[string]string{"userfs/ann/d/one": "one", "userfs/ann/d/sub/two": "two!"} {
+		if ret := uploadHandler(path, "ann", []byte(body), ann); ret != "" {
+			t.Fatalf("uploading %v: %v", path, ret)
+		}
+	}
+	if ret := shareHandler("userfs/ann/d/sub/two", "bob", "r", "ann", ann); ret != "" {
+		t.Fatalf("shareHandler: %v", ret)
+	}
+
+	for _, path := range []string{"userfs/ann", "userfs/ann/Shared_with_me", "userfs/bob"} {
+		if ret := removeAllHandler(path, "ann", ann); ret.Err == "" {
+			t.Fatalf("removeAllHandler(%v): got %+v; want it refused", path, ret)
+		}
+	}
+	ret := removeAllHandler("userfs/ann/d", "ann", ann)
+	if ret.Err != "" || ret.Files != 2 || ret.Dirs != 2 || ret.Shares != 1 {
+		t.Fatalf("removeAllHandler: got %+v; want 2 files, 2 directories and 1 share", ret)
+	}
+	if _, err := os.Lstat("userfs/bob/Shared_with_me/two"); !os.IsNotExist(err) {
+		t.Fatalf("bob's link after removing: got %v; want it gone", err)
+	}
+	entries := trashHandler("ann", ann)
+	if len(entries.Entries) != 1 || entries.Entries[0].Path != "/d" || !entries.Entries[0].IsDir {
+		t.Fatalf("trashHandler: got %+v; want /d alone", entries)
+	}
+	if u, err := quotaUsage(db, "ann"); err != nil || u != 7 {
+		t.Fatalf("after removing: ann uses %v, %v; want 7", u, err)
+	}
+
+	if ret := restoreTrashHandler(entries.Entries[0].ID, "", "ann", ann); ret != "" {
+		t.Fatalf("restoreTrashHandler: %v", ret)
+	}
+	if got := downloadHandler("userfs/bob/Shared_with_me/two", "bob", bob); got.Err != "" || string(got.Body) != "two!" {
+		t.Fatalf("bob downloading after ann restored it: got %q, %v; want %q", got.Body, got.Err, "two!")
+	}
+}
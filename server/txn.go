@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// An op groups everything one request changes so that it either happens completely or not at
+// all. Database changes all go through tx, so they commit together. Filesystem changes can't
+// be part of the transaction, so each one made through the op records how to undo it; if the
+// op is abandoned, or the commit itself fails, those are run in reverse order. Blobs that lose
+// their last owner are only deleted once the commit has gone through, since that can't be undone.
+// Links made, removed or moved through the op also change what their owners are charged for in
+// usagedata, as part of the transaction.
+//
+// While an op is open every query has to go through o.tx: sqlite only allows one writer, so
+// writing through db directly would wait on the op's own transaction.
+type op struct {
+	tx     *sql.Tx
+	undo   []func() error
+	after  []func()
+	doomed map[string]bool // blobs to delete after the commit
+}
+
+// Either db itself or an op's tx, for helpers that are called both inside and outside of ops.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Takes in an absolute path and returns a GLOB pattern matching everything under it, for
+// queries that need to find every record of a directory's contents. GLOB is used rather than
+// LIKE since it is case sensitive, like the paths themselves.
+func underPath(path string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(path) + "/*"
+}
+
+// Starts a new op. Exits if the transaction can't be started, like the rest of the server does
+// when the database fails.
+func beginOp() *op {
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not begin transaction: %v\n", err)
+		os.Exit(1)
+	}
+	return &op{tx: tx, doomed: make(map[string]bool)}
+}
+
+// Undoes the filesystem changes made so far, newest first.
+func (o *op) undoFS() {
+	for i := len(o.undo) - 1; i >= 0; i-- {
+		err := o.undo[i]()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not undo filesystem change: %v\n", err)
+		}
+	}
+	o.undo = nil
+	o.after = nil
+	o.doomed = make(map[string]bool)
+}
+
+// Abandons the op, rolling back the transaction and undoing its filesystem changes.
+func (o *op) rollback() {
+	o.tx.Rollback()
+	o.undoFS()
+}
+
+// Commits the transaction. If that fails the filesystem changes are undone and the error is
+// returned; otherwise the work deferred until after the commit is run.
+func (o *op) commit() error {
+	err := o.tx.Commit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not commit transaction: %v\n", err)
+		o.undoFS()
+		return err
+	}
+	for key := range o.doomed {
+		err = store.Delete(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not delete blob %v: %v\n", key, err)
+		}
+	}
+	for _, f := range o.after {
+		f()
+	}
+	o.undo = nil
+	o.after = nil
+	o.doomed = make(map[string]bool)
+	return nil
+}
+
+// Rolls the op back and exits. Used where the rest of the server would exit on a database error.
+func (o *op) fatal(msg string, err error) {
+	o.rollback()
+	fmt.Fprintf(os.Stderr, "%v: %v\n", msg, err)
+	os.Exit(1)
+}
+
+// Runs f after the op commits.
+func (o *op) afterCommit(f func()) {
+	o.after = append(o.after, f)
+}
+
+// Creates a symlink at path pointing at target.
+func (o *op) symlink(target string, path string) error {
+	err := os.Symlink(target, path)
+	if err != nil {
+		return err
+	}
+	o.undo = append(o.undo, func() error { return os.Remove(path) })
+	charge(o, chargedTo(path), targetSize(o.tx, target))
+	return nil
+}
+
+// Removes the symlink at path, remembering its target so it can be put back.
+func (o *op) removeLink(path string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	o.undo = append(o.undo, func() error { return os.Symlink(target, path) })
+	charge(o, chargedTo(path), -targetSize(o.tx, target))
+	return nil
+}
+
+// Removes the empty directory at path.
+func (o *op) removeDir(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	o.undo = append(o.undo, func() error { return os.Mkdir(path, fi.Mode().Perm()) })
+	return nil
+}
+
+// Creates the directory at path.
+func (o *op) mkdir(path string, perm os.FileMode) error {
+	err := os.Mkdir(path, perm)
+	if err != nil {
+		return err
+	}
+	o.undo = append(o.undo, func() error { return os.Remove(path) })
+	return nil
+}
+
+// Moves whatever is at from to to. What it holds is charged to whoever owns it at to from then on.
+func (o *op) rename(from string, to string) error {
+	err := os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	o.undo = append(o.undo, func() error { return os.Rename(to, from) })
+	if was, is := chargedTo(from), chargedTo(to); was != is {
+		size, err := treeSize(o.tx, to)
+		if err != nil {
+			return err
+		}
+		charge(o, was, -size)
+		charge(o, is, size)
+	}
+	return nil
+}
+
+// Stores body in the blob store under key. If the op doesn't commit the blob is deleted again,
+// or put back the way it was if something was already stored under key.
+func (o *op) putBlob(key string, body []byte) error {
+	// Something released earlier in the op may be needed again after all
+	delete(o.doomed, key)
+	old, oldErr := store.Get(key)
+	err := store.Put(key, body)
+	if err != nil {
+		return err
+	}
+	if oldErr == nil {
+		o.undo = append(o.undo, func() error { return store.Put(key, old) })
+	} else {
+		o.undo = append(o.undo, func() error { return store.Delete(key) })
+	}
+	return nil
+}
+
+// Deletes the blob stored under key once the op has committed, unless the op stores it again first.
+func (o *op) deleteBlob(key string) {
+	o.doomed[key] = true
+}
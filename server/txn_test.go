@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Moves into a new temporary directory holding ann's tree and trash, with a link to each of two
+// files, an empty directory and a directory with a file in it, and returns a function that moves
+// back out and removes it.
+func useTestTree(t *testing.T) func() {
+	cleanup := useTempDir(t, "userfs/ann/empty", "userfs/ann/d", "trash/ann")
+	for path, key := range map[string]string{"userfs/ann/one": "k1", "userfs/ann/d/two": "k2"} {
+		err := os.Symlink(key, path)
+		if err != nil {
+			cleanup()
+			t.Fatalf("could not link %v: %v", path, err)
+		}
+	}
+	return cleanup
+}
+
+// Describes everything under the current directory, every blob in the memBlobStore in place of
+// store, every row of filedata and chunkdata and ann's usage, so that they can be compared before
+// and after.
+func snapshot(t *testing.T) string {
+	var lines []string
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, path+" -> "+target)
+		} else {
+			lines = append(lines, fmt.Sprintf("%v %v", path, info.Mode()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not walk the tree: %v", err)
+	}
+	for key, body := range store.(*memBlobStore).blobs {
+		lines = append(lines, "blob "+key+" = "+string(body))
+	}
+	rows, err := db.Query("SELECT 'file ' || filename FROM filedata UNION ALL SELECT 'chunk ' || chunkhash || ' used ' || refcount || ' times' FROM chunkdata")
+	if err != nil {
+		t.Fatalf("could not read the database: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatalf("could not read the database: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	used, err := quotaUsage(db, "ann")
+	if err != nil {
+		t.Fatalf("could not read usage: %v", err)
+	}
+	lines = append(lines, fmt.Sprintf("ann uses %v", used))
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// test that abandoning an op partway through, after any mix of changes, leaves the filesystem, the
+// blob store and the database the way they were, and that committing keeps every change
+func TestOpRollback(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTestTree(t)()
+	for key, body := range map[string]string{"k1": "one", "k2": "two!"} {
+		_, err := db.Exec("INSERT INTO filedata(filename, filehash, size) values(?,?,?)", key, key, len(body))
+		if err == nil {
+			_, err = db.Exec("INSERT INTO filechunks(filehash, seq, chunkhash) values(?,?,?)", key, 0, key)
+		}
+		if err == nil {
+			_, err = db.Exec("INSERT INTO chunkdata(chunkhash, size, refcount) values(?,?,?)", key, len(body), 1)
+		}
+		if err == nil {
+			err = store.Put(key, []byte(body))
+		}
+		if err != nil {
+			t.Fatalf("could not add %v: %v", key, err)
+		}
+	}
+	_, err := db.Exec("INSERT INTO usagedata(username, used) values(?,?)", "ann", 7)
+	if err != nil {
+		t.Fatalf("could not add usage: %v", err)
+	}
+
+	// each step returns an error if it failed; the last one of every test fails
+	type step func(o *op) error
+	mkdir := func(path string) step { return func(o *op) error { return o.mkdir(path, 0775) } }
+	symlink := func(target, path string) step { return func(o *op) error { return o.symlink(target, path) } }
+	removeLink := func(path string) step { return func(o *op) error { return o.removeLink(path) } }
+	removeDir := func(path string) step { return func(o *op) error { return o.removeDir(path) } }
+	rename := func(from, to string) step { return func(o *op) error { return o.rename(from, to) } }
+	putBlob := func(key, body string) step { return func(o *op) error { return o.putBlob(key, []byte(body)) } }
+	deleteBlob := func(key string) step { return func(o *op) error { o.deleteBlob(key); return nil } }
+	exec := func(query string) step { return func(o *op) error { _, err := o.tx.Exec(query); return err } }
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"directories and links made", []step{
+			mkdir("userfs/ann/new"), mkdir("userfs/ann/new/sub"), symlink("k1", "userfs/ann/new/sub/copy"), symlink("k2", "userfs/ann/empty/copy"),
+			mkdir("userfs/ann/new")}},
+		{"links and directories removed", []step{
+			removeLink("userfs/ann/one"), removeLink("userfs/ann/d/two"), removeDir("userfs/ann/empty"), removeDir("userfs/ann/d"),
+			removeDir("userfs")}},
+		{"link replaced", []step{
+			removeLink("userfs/ann/one"), symlink("k2", "userfs/ann/one"),
+			removeLink("userfs/ann/gone")}},
+		{"moved into the trash and around", []step{
+			rename("userfs/ann/d", "trash/ann/d"), rename("userfs/ann/one", "userfs/ann/empty/one"), mkdir("userfs/ann/d"),
+			rename("userfs/ann/gone", "userfs/ann/x")}},
+		{"moved out of ann's tree", []step{
+			rename("userfs/ann/d", "elsewhere"),
+			removeLink("userfs/ann/d/two")}},
+		{"blobs stored, replaced and deleted", []step{
+			putBlob("k3", "three"), putBlob("k1", "changed"), deleteBlob("k2"), symlink("k3", "userfs/ann/three"),
+			putBlob("../k4", "bad key")}},
+		{"database changed", []step{
+			exec("UPDATE chunkdata SET refcount=refcount+1 WHERE chunkhash='k1'"), symlink("k1", "userfs/ann/again"),
+			exec("INSERT INTO nosuchtable values(1)")}},
+	}
+	for _, tt := range tests {
+		before := snapshot(t)
+		o := beginOp()
+		for i, s := range tt.steps {
+			err := s(o)
+			if i < len(tt.steps)-1 && err != nil {
+				o.rollback()
+				t.Fatalf("%v: step %v: %v", tt.name, i, err)
+			}
+			if i == len(tt.steps)-1 && err == nil {
+				o.rollback()
+				t.Fatalf("%v: last step: got no error; want it to fail", tt.name)
+			}
+		}
+		o.rollback()
+		if after := snapshot(t); after != before {
+			t.Fatalf("%v: after rolling back got\n%v\nwant\n%v", tt.name, after, before)
+		}
+	}
+
+	// the same changes stick once committed, and blobs deleted by the op are only gone then
+	before := snapshot(t)
+	o := beginOp()
+	for _, s := range []step{removeLink("userfs/ann/d/two"), deleteBlob("k2"), exec("DELETE FROM filedata WHERE filename='k2'"), exec("DELETE FROM chunkdata WHERE chunkhash='k2'"), symlink("k1", "userfs/ann/d/one")} {
+		if err := s(o); err != nil {
+			o.rollback()
+			t.Fatalf("committed op: %v", err)
+		}
+	}
+	if _, err := store.Get("k2"); err != nil {
+		o.rollback()
+		t.Fatalf("blob k2 before committing: %v; want it still there", err)
+	}
+	if err := o.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	after := snapshot(t)
+	if !strings.Contains(after, "userfs/ann/d/one -> k1") {
+		t.Fatalf("after committing got\n%v\nwant it to hold %q", after, "userfs/ann/d/one -> k1")
+	}
+	if strings.Contains(after, "k2") || after == before {
+		t.Fatalf("after committing got\n%v\nwant k2 and its link gone", after)
+	}
+	if !strings.Contains(after, "ann uses 6") {
+		t.Fatalf("after committing got\n%v\nwant ann charged for one less link to k2 and one more to k1", after)
+	}
+}
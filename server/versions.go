@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// Overwriting a file keeps what was there before as a version of it. Versions live in
+// versiondata, keyed by the owner and absolute path of the file, and are numbered from 1 up in
+// the order they were saved. A version keeps the file it holds alive just like a link does: it is
+// one of the file's owners and holds a reference to each of its chunks, so keeping a version of
+// content that is still linked somewhere, or that is the same as another version, costs nothing
+// but a row.
+//
+// Only the newest -versions versions of each file are kept. Uploads made by sharees with write
+// access replace the sharer's file, so their versions are kept under the sharer and the sharer can
+// always get back what was there before. Versions are charged to the owner's quota for their full
+// size, like files stored twice are, until they are dropped. Removing a file takes its versions
+// to the trash with it, and they are dropped when it is purged from there.
+
+// Keeps the file with the given hash as the newest version of username's file at path, as part of
+// o. The version takes over an owner the caller already holds on the file, such as the link that
+// is about to be replaced.
+func keepVersion(o *op, username string, path string, hash string) {
+	var latest int
+	err := o.tx.QueryRow("SELECT coalesce(max(version),0) FROM versiondata WHERE owner=? AND path=?", username, path).Scan(&latest)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	var size int64
+	err = o.tx.QueryRow("SELECT size FROM filedata WHERE filehash=?", hash).Scan(&size)
+	if err == sql.ErrNoRows {
+		// not something we're keeping track of, so there is nothing to keep
+		return
+	}
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	_, err = o.tx.Exec("INSERT INTO versiondata(owner, path, version, filehash, size, saved) values(?,?,?,?,?,?)", username, path, latest+1, hash, size, time.Now().Unix())
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+	charge(o, username, size)
+	pruneVersions(o, username, path, latest+1-*versionsFlag)
+}
+
+// Drops every version of username's file at path numbered up to and including upto, as part of o.
+func pruneVersions(o *op, username string, path string, upto int) {
+	rows, err := o.tx.Query("SELECT filehash, size FROM versiondata WHERE owner=? AND path=? AND version<=?", username, path, upto)
+	if err != nil {
+		o.fatal("could not access database", err)
+	}
+	var hashes []string
+	var freed int64
+	for rows.Next() {
+		var hash string
+		var size int64
+		err = rows.Scan(&hash, &size)
+		if err != nil {
+			rows.Close()
+			o.fatal("could not access database", err)
+		}
+		hashes = append(hashes, hash)
+		freed += size
+	}
+	rows.Close()
+
+	for _, hash := range hashes {
+		releaseFile(o, hash)
+	}
+	charge(o, username, -freed)
+	_, err = o.tx.Exec("DELETE FROM versiondata WHERE owner=? AND path=? AND version<=?", username, path, upto)
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
+
+// Drops every version of username's file at path, as part of o.
+func dropVersions(o *op, username string, path string) {
+	var latest int
+	err := o.tx.QueryRow("SELECT coalesce(max(version),0) FROM versiondata WHERE owner=? AND path=?", username, path).Scan(&latest)
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	pruneVersions(o, username, path, latest)
+}
+
+// Takes in a path relative to the server and works out whose file it is. For files in the user's
+// own tree that is the user, and for files shared with them, or in directories shared with them,
+// it is the sharer. Returns the owner, the absolute path of the file in the owner's tree and the
+// user's permissions on it (1 for their own files), or an error message.
+func versionedFile(path string, username string) (string, string, int, string) {
+	if !checkpath(path, username) {
+		return "", "", 0, "Path does not exist on the server!"
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", 0, err.Error()
+	}
+	fi, err := os.Lstat(abspath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 || isDirLink(abspath) {
+		return "", "", 0, "That isn't a file!"
+	}
+	sharer, origpath, perm, ok := resolveShare(abspath, username)
+	if !ok {
+		return username, abspath, 1, ""
+	}
+	return sharer, origpath, perm, ""
+}
+
+// Takes in a path, a username and a cookie and returns the saved versions of the file at path,
+// oldest first.
+func historyHandler(path string, username string, cookie string) internal.HistoryReturn {
+	if(checkCookie(username, cookie)==false){
+		return internal.HistoryReturn{Err: "reauth"}
+	}
+	owner, origpath, _, errmsg := versionedFile(path, username)
+	if errmsg != "" {
+		return internal.HistoryReturn{Err: errmsg}
+	}
+
+	rows, err := db.Query("SELECT version, size, saved FROM versiondata WHERE owner=? AND path=? ORDER BY version", owner, origpath)
+	if err != nil {
+		return internal.HistoryReturn{Err: "Couldn't get the history :("}
+	}
+	defer rows.Close()
+	var versions []internal.VersionEnt
+	for rows.Next() {
+		var v internal.VersionEnt
+		err = rows.Scan(&v.Number, &v.Size, &v.Saved)
+		if err != nil {
+			return internal.HistoryReturn{Err: "Couldn't get the history :("}
+		}
+		versions = append(versions, v)
+	}
+	return internal.HistoryReturn{Versions: versions}
+}
+
+// Takes in a path, a version number, a username and a cookie and makes that version the current
+// content of the file. What was there before becomes the newest version, so a restore can be
+// undone like any other overwrite. Sharees need write access to restore a shared file.
+func restoreHandler(path string, version int, username string, cookie string) string {
+	if(checkCookie(username, cookie)==false){
+		return "reauth"
+	}
+	owner, origpath, perm, errmsg := versionedFile(path, username)
+	if errmsg != "" {
+		return errmsg
+	}
+	if perm == 0 {
+		return "Permission Denied"
+	}
+
+	o := beginOp()
+	var hash string
+	var size int64
+	err := o.tx.QueryRow("SELECT filehash, size FROM versiondata WHERE owner=? AND path=? AND version=?", owner, origpath, version).Scan(&hash, &size)
+	if err == sql.ErrNoRows {
+		o.rollback()
+		return "There is no such version!"
+	}
+	if err != nil {
+		o.fatal("could not make query", err)
+	}
+	ret := checkQuota(o.tx, owner, origpath, size)
+	if ret == "" {
+		ret = linkFile(o, origpath, owner, hash)
+	}
+	if ret == "" {
+		ret = relinkSharees(o, owner, origpath)
+	}
+	if ret != "" {
+		o.rollback()
+		return ret
+	}
+	if o.commit() != nil {
+		return "Couldn't restore :("
+	}
+	return ""
+}
+
+// Returns how many bytes the versions of username's file at path take up, for the quota.
+func versionsSize(q querier, username string, path string) int64 {
+	var size int64
+	err := q.QueryRow("SELECT coalesce(sum(size),0) FROM versiondata WHERE owner=? AND path=?", username, path).Scan(&size)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+		os.Exit(1)
+	}
+	return size
+}
+
+// Returns how many bytes overwriting username's file at path gives back: with versioning on, the
+// file it replaces becomes a version and only the versions that pushes out are freed.
+func replacedSize(q querier, username string, path string) int64 {
+	if *versionsFlag <= 0 {
+		return linkSize(q, path)
+	}
+	var latest int
+	err := q.QueryRow("SELECT coalesce(max(version),0) FROM versiondata WHERE owner=? AND path=?", username, path).Scan(&latest)
+	if err == nil {
+		var size int64
+		err = q.QueryRow("SELECT coalesce(sum(size),0) FROM versiondata WHERE owner=? AND path=? AND version<=?", username, path, latest+1-*versionsFlag).Scan(&size)
+		if err == nil {
+			return size
+		}
+	}
+	fmt.Fprintf(os.Stderr, "could not make query: %v\n", err)
+	os.Exit(1)
+	return 0
+}
+
+// Moves the versions of username's file at from, or of every file under it if it is a directory,
+// so that they are kept under the same paths beneath to, as part of o.
+func moveVersions(o *op, username string, from string, to string) {
+	_, err := o.tx.Exec("UPDATE versiondata SET path=? || substr(path, ?) WHERE owner=? AND (path=? OR path GLOB ?)", to, utf8.RuneCountInString(from)+1, username, from, underPath(from))
+	if err != nil {
+		o.fatal("could not update database", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Adds a user with the given name along with a session for them, and returns its cookie.
+func addTestUser(t *testing.T, username string) string {
+	_, err := db.Exec("INSERT INTO userdata(username, passhash) values(?,?)", username, "")
+	if err != nil {
+		t.Fatalf("could not add %v: %v", username, err)
+	}
+	Cookiemap[username] = Cookie{sessionid: "cookie-" + username, expiretime: time.Now().Add(time.Hour)}
+	return "cookie-" + username
+}
+
+// Keeps n versions of each file, and returns a function that puts the old setting back.
+func setVersions(n int) func() {
+	old := *versionsFlag
+	*versionsFlag = n
+	return func() { *versionsFlag = old }
+}
+
+// test that overwriting keeps the newest versions, charged to their owner and holding on to their
+// chunks, that restoring one keeps what it replaces in turn, and that they are dropped once the
+// file is purged from the trash
+func TestVersions(t *testing.T) {
+	defer openTestDB(t)()
+	defer useMemBlobStore()()
+	defer useTempDir(t, "userfs/ann/Shared_with_me")()
+	defer setVersions(2)()
+	cookie := addTestUser(t, "ann")
+	history := func() map[int]int64 {
+		ret := historyHandler("userfs/ann/a", "ann", cookie)
+		if ret.Err != "" {
+			t.Fatalf("historyHandler: %v", ret.Err)
+		}
+		versions := make(map[int]int64)
+		for _, v := range ret.Versions {
+			versions[v.Number] = v.Size
+		}
+		return versions
+	}
+	check := func(when string, versions map[int]int64, used int64, refs map[string]int) {
+		got := history()
+		if len(got) != len(versions) {
+			t.Fatalf("%v: got versions %v; want %v", when, got, versions)
+		}
+		for n, size := range versions {
+			if got[n] != size {
+				t.Fatalf("%v: got versions %v; want %v", when, got, versions)
+			}
+		}
+		if u, err := quotaUsage(db, "ann"); err != nil || u != used {
+			t.Fatalf("%v: ann uses %v, %v; want %v", when, u, err, used)
+		}
+		counts := refcounts(t)
+		if len(counts) != len(refs) {
+			t.Fatalf("%v: got refcounts %v; want %v", when, counts, refs)
+		}
+		for body, n := range refs {
+			if counts[contentKey([]byte(body))] != n {
+				t.Fatalf("%v: got refcounts %v; want %v for %q", when, counts, n, body)
+			}
+		}
+	}
+
+	for _, body := range []string{"first", "second", "third", "fourth"} {
+		if ret := uploadHandler("userfs/ann/a", "ann", []byte(body), cookie); ret != "" {
+			t.Fatalf("uploading %q: %v", body, ret)
+		}
+	}
+	check("after four uploads", map[int]int64{2: 6, 3: 5}, 6+6+5, map[string]int{"second": 1, "third": 1, "fourth": 1})
+
+	if ret := restoreHandler("userfs/ann/a", 2, "ann", cookie); ret != "" {
+		t.Fatalf("restoreHandler: %v", ret)
+	}
+	check("after restoring", map[int]int64{3: 5, 4: 6}, 6+5+6, map[string]int{"second": 1, "third": 1, "fourth": 1})
+	if got, err := readFile(contentKey([]byte("second"))); err != nil || string(got) != "second" {
+		t.Fatalf("restored file: got %q, %v; want %q", got, err, "second")
+	}
+	if ret := restoreHandler("userfs/ann/a", 2, "ann", cookie); ret != "There is no such version!" {
+		t.Fatalf("restoring a dropped version: got %q; want it refused", ret)
+	}
+
+	// uploading what is already there changes nothing
+	if ret := uploadHandler("userfs/ann/a", "ann", []byte("second"), cookie); ret != "" {
+		t.Fatalf("uploading the same again: %v", ret)
+	}
+	check("after uploading the same again", map[int]int64{3: 5, 4: 6}, 6+5+6, map[string]int{"second": 1, "third": 1, "fourth": 1})
+
+	// the versions go to the trash along with the file, and only go when it is emptied
+	if ret := removeHandler("userfs/ann/a", "ann", cookie); ret != "" {
+		t.Fatalf("removeHandler: %v", ret)
+	}
+	if u, err := quotaUsage(db, "ann"); err != nil || u != 6+5+6 {
+		t.Fatalf("after removing: ann uses %v, %v; want %v", u, err, 6+5+6)
+	}
+	if ret := emptyTrashHandler("ann", cookie); ret != "" {
+		t.Fatalf("emptyTrashHandler: %v", ret)
+	}
+	if u, err := quotaUsage(db, "ann"); err != nil || u != 0 {
+		t.Fatalf("after emptying the trash: ann uses %v, %v; want 0", u, err)
+	}
+	if counts := refcounts(t); len(counts) != 0 {
+		t.Fatalf("after emptying the trash: got refcounts %v; want every chunk gone", counts)
+	}
+}